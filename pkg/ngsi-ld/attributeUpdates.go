@@ -0,0 +1,241 @@
+package ngsi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+//UpdateResult tells which attributes were updated by a request to update the attributes of
+//an entity, together with the reason why each of the remaining attributes was not
+type UpdateResult struct {
+	Updated    []string            `json:"updated"`
+	NotUpdated []NotUpdatedDetails `json:"notUpdated"`
+}
+
+//NotUpdatedDetails describes why an attribute was not updated
+type NotUpdatedDetails struct {
+	AttributeName string `json:"attributeName"`
+	Reason        string `json:"reason"`
+}
+
+//NewUpdateResult returns an empty UpdateResult
+func NewUpdateResult() *UpdateResult {
+	return &UpdateResult{
+		Updated:    []string{},
+		NotUpdated: []NotUpdatedDetails{},
+	}
+}
+
+//PartialUpdateError should be returned, or wrapped, by context sources that were only able to
+//update some of the attributes they were sent. The result tells why the others were not updated.
+type PartialUpdateError struct {
+	Result *UpdateResult
+}
+
+func (pue *PartialUpdateError) Error() string {
+	return fmt.Sprintf("%d of the attributes could not be updated", len(pue.Result.NotUpdated))
+}
+
+//attributeUpdate is the part of an attribute update request that should be sent to a
+//certain context source. The unclaimed attributes are sent to several sources, and only
+//have to be updated by one of them.
+type attributeUpdate struct {
+	source     ContextSource
+	attributes []string
+	unclaimed  []string
+}
+
+//nonAttributeMembers are sent to every context source that receives a part of an update
+var nonAttributeMembers = []string{"@context", "id", "type"}
+
+//decodeAttributeUpdate decodes the payload of an attribute update request into its members
+//and returns the names of the attributes that should be updated in alphabetical order
+func decodeAttributeUpdate(request Request) (map[string]json.RawMessage, []string, error) {
+	members := map[string]json.RawMessage{}
+	err := request.DecodeBodyInto(&members)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decode request payload into a JSON object: %s", err.Error())
+	}
+
+	names := []string{}
+	for name := range members {
+		if !isNonAttributeMember(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return members, names, nil
+}
+
+func isNonAttributeMember(name string) bool {
+	return containsString(nonAttributeMembers, name)
+}
+
+//splitAttributeUpdate decides which attributes each context source should be sent, based on
+//the attributes that the sources provide. An attribute that several sources provide is sent
+//to all of them. Attributes that none of the sources claim are sent to all of them, since
+//they all hold the entity and any of them may be the one that stores the attribute. Attributes
+//that an exclusive source has registered are only sent to that source.
+func splitAttributeUpdate(sources []ContextSource, attributeNames []string) []attributeUpdate {
+	claimed := make([][]string, len(sources))
+	unclaimed := []string{}
+	claims := exclusiveClaimsOf(sources)
+
+	for _, name := range attributeNames {
+		isClaimed := false
+		for idx, source := range sources {
+			if claims.allows(source, name) && source.ProvidesAttribute(name) {
+				claimed[idx] = append(claimed[idx], name)
+				isClaimed = true
+			}
+		}
+		if !isClaimed {
+			unclaimed = append(unclaimed, name)
+		}
+	}
+
+	updates := []attributeUpdate{}
+
+	for idx, source := range sources {
+		update := attributeUpdate{source: source, attributes: claimed[idx], unclaimed: []string{}}
+		for _, name := range unclaimed {
+			if claims.allows(source, name) {
+				update.unclaimed = append(update.unclaimed, name)
+			}
+		}
+		if len(update.attributes)+len(update.unclaimed) > 0 {
+			updates = append(updates, update)
+		}
+	}
+
+	return updates
+}
+
+//executeAttributeUpdates sends each context source its slice of the update and collects the
+//outcome for every attribute. An attribute that the sources claim is only updated if all the
+//sources that it was sent to could update it, while an unclaimed attribute is updated if any
+//of them could.
+func executeAttributeUpdates(ctx context.Context, r *http.Request, entityID string, members map[string]json.RawMessage, updates []attributeUpdate) *UpdateResult {
+	reasons := map[string]string{}
+	unclaimedReasons := map[string]string{}
+	accepted := map[string]bool{}
+	sent := []string{}
+
+	for _, update := range updates {
+		names := append(append([]string{}, update.attributes...), update.unclaimed...)
+
+		body, err := attributeSubset(members, names)
+		if err == nil {
+			request := newRequestWrapperWithBody(r, body)
+			err = NewContextAwareSource(update.source).UpdateEntityAttributesWithContext(ctx, entityID, request)
+		}
+
+		failures := attributeFailures(err, names)
+
+		for _, name := range names {
+			if !containsString(sent, name) {
+				sent = append(sent, name)
+			}
+		}
+
+		for _, name := range update.attributes {
+			if _, alreadyFailed := reasons[name]; !alreadyFailed && failures[name] != "" {
+				reasons[name] = failures[name]
+			}
+		}
+
+		for _, name := range update.unclaimed {
+			if failures[name] == "" {
+				accepted[name] = true
+			} else if _, alreadyFailed := unclaimedReasons[name]; !alreadyFailed {
+				unclaimedReasons[name] = failures[name]
+			}
+		}
+	}
+
+	for name, reason := range unclaimedReasons {
+		if !accepted[name] {
+			reasons[name] = reason
+		}
+	}
+
+	result := NewUpdateResult()
+	sort.Strings(sent)
+
+	for _, name := range sent {
+		if _, failed := reasons[name]; !failed {
+			result.Updated = append(result.Updated, name)
+		}
+	}
+
+	names := []string{}
+	for name := range reasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		result.NotUpdated = append(result.NotUpdated, NotUpdatedDetails{AttributeName: name, Reason: reasons[name]})
+	}
+
+	return result
+}
+
+//attributeFailures returns the reason why each of the attributes that a source was sent was
+//not updated. A PartialUpdateError only fails the attributes that it lists, while any other
+//error fails all of them.
+func attributeFailures(err error, attributeNames []string) map[string]string {
+	failures := map[string]string{}
+	if err == nil {
+		return failures
+	}
+
+	partial := &PartialUpdateError{}
+	if errors.As(err, &partial) {
+		for _, details := range partial.Result.NotUpdated {
+			reason := details.Reason
+			if reason == "" {
+				reason = err.Error()
+			}
+			failures[details.AttributeName] = reason
+		}
+		return failures
+	}
+
+	for _, name := range attributeNames {
+		failures[name] = err.Error()
+	}
+	return failures
+}
+
+//attributeSubset creates a payload with the given attributes and the members that are not
+//attributes, such as the @context
+func attributeSubset(members map[string]json.RawMessage, attributeNames []string) ([]byte, error) {
+	subset := map[string]json.RawMessage{}
+
+	for _, name := range nonAttributeMembers {
+		if value, ok := members[name]; ok {
+			subset[name] = value
+		}
+	}
+
+	for _, name := range attributeNames {
+		subset[name] = members[name]
+	}
+
+	return json.Marshal(subset)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
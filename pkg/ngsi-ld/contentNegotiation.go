@@ -0,0 +1,332 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+)
+
+const (
+	//ContentTypeJSONLD is the media type of NGSI-LD payloads that carry their own @context
+	ContentTypeJSONLD string = "application/ld+json"
+	//ContentTypeJSON is the media type of NGSI-LD payloads whose @context is sent in a Link header
+	ContentTypeJSON string = "application/json"
+
+	//JSONLDContextRel is the relation type of a Link header that refers to a JSON-LD @context
+	JSONLDContextRel string = "http://www.w3.org/ns/json-ld#context"
+	//CoreContextURL is the NGSI-LD core @context, which applies when no other context is given
+	CoreContextURL string = "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+)
+
+//entityContentTypes are the representations of entities that can be returned to a client, with
+//the preferred representation first
+var entityContentTypes = []string{ContentTypeJSONLD, ContentTypeJSON, geojson.ContentType}
+
+//mediaRange is a single media range from an Accept header
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+//parseAccept parses the media ranges in the Accept headers of a request. Ranges that can not be
+//parsed are ignored. A request without an Accept header accepts anything.
+func parseAccept(r *http.Request) []mediaRange {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return []mediaRange{{mediaType: "*/*", q: 1}}
+	}
+
+	ranges := []mediaRange{}
+
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+
+			q := 1.0
+			if qvalue, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(qvalue, 64)
+				if err != nil || q < 0 || q > 1 {
+					continue
+				}
+			}
+
+			ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+		}
+	}
+
+	return ranges
+}
+
+//qualityOf returns the q-value of the most specific media range that matches a content type
+func qualityOf(contentType string, ranges []mediaRange) float64 {
+	quality, specificity := 0.0, -1
+	mainType := strings.SplitN(contentType, "/", 2)[0]
+
+	for _, mr := range ranges {
+		s := -1
+		switch {
+		case mr.mediaType == contentType:
+			s = 2
+		case mr.mediaType == mainType+"/*":
+			s = 1
+		case mr.mediaType == "*/*":
+			s = 0
+		}
+
+		if s > specificity {
+			quality, specificity = mr.q, s
+		}
+	}
+
+	return quality
+}
+
+//negotiateContentType picks the offered content type that the client prefers, using the order of
+//the offers to break ties. The result is false if the client accepts none of the offers.
+func negotiateContentType(r *http.Request, offers []string) (string, bool) {
+	ranges := parseAccept(r)
+	best, bestQuality := "", 0.0
+
+	for _, offer := range offers {
+		if q := qualityOf(offer, ranges); q > bestQuality {
+			best, bestQuality = offer, q
+		}
+	}
+
+	return best, bestQuality > 0
+}
+
+//entityRepresentation converts the entities that are returned to a client into the representation
+//that was negotiated with it
+type entityRepresentation struct {
+	contentType string
+	convert     func(interface{}) interface{}
+	collection  *geojson.GeoJSONFeatureCollection
+	ldContext   interface{}
+}
+
+//newEntityRepresentation negotiates the representation of the entities in a response. The result
+//is false if the client accepts none of the representations that are supported.
+func newEntityRepresentation(r *http.Request) (*entityRepresentation, bool) {
+	contentType, ok := negotiateContentType(r, entityContentTypes)
+	if !ok {
+		return nil, false
+	}
+
+	rep := &entityRepresentation{contentType: contentType}
+
+	switch contentType {
+	case geojson.ContentType:
+		options := r.URL.Query().Get("options")
+		rep.collection = geojson.NewGeoJSONFeatureCollection([]geojson.GeoJSONFeature{}, true)
+		rep.convert = geojson.NewEntityConverter("location", options == "keyValues", rep.collection)
+	case ContentTypeJSON:
+		rep.convert = rep.withoutContext
+	default:
+		// The default representation does not need to convert anything
+		rep.convert = func(e interface{}) interface{} { return e }
+	}
+
+	return rep, true
+}
+
+//withoutContext removes the @context from an entity, so that it can be sent in a Link header
+//instead. The @context of the first entity is the one that is sent.
+func (rep *entityRepresentation) withoutContext(e interface{}) interface{} {
+	m, err := fragmentAsMap(e)
+	if err != nil {
+		return e
+	}
+
+	if rep.ldContext == nil {
+		rep.ldContext = m["@context"]
+	}
+
+	// Make a shallow copy, so that the entity that was passed in is left as it is
+	clone := map[string]interface{}{}
+	for k, v := range m {
+		if k != "@context" {
+			clone[k] = v
+		}
+	}
+
+	return clone
+}
+
+//writeHeaders sets the Content-Type of the response and, for plain JSON, the Link to the @context
+func (rep *entityRepresentation) writeHeaders(w http.ResponseWriter) {
+	switch rep.contentType {
+	case geojson.ContentType:
+		w.Header().Add("Content-Type", geojson.ContentType)
+	case ContentTypeJSON:
+		w.Header().Add("Content-Type", ContentTypeJSON+";charset=utf-8")
+		w.Header().Add("Link", contextLink(contextURL(rep.ldContext)))
+	default:
+		w.Header().Add("Content-Type", ContentTypeJSONLD+";charset=utf-8")
+	}
+}
+
+//reportNotAcceptable tells the client that none of the accepted representations are available
+func reportNotAcceptable(w http.ResponseWriter) {
+	errors.ReportNewNotAcceptable(
+		w,
+		"The requested content type is not available. Entities can be returned as "+strings.Join(entityContentTypes, ", ")+".",
+	)
+}
+
+//contextURL finds the URL of a @context that can be referred to from a Link header. The core
+//context is always in effect, so any other context is preferred to it.
+func contextURL(ldContext interface{}) string {
+	switch c := ldContext.(type) {
+	case string:
+		return c
+	case []interface{}:
+		for _, item := range c {
+			if u, ok := item.(string); ok && u != CoreContextURL {
+				return u
+			}
+		}
+	}
+
+	return CoreContextURL
+}
+
+func contextLink(target string) string {
+	return fmt.Sprintf("<%s>; rel=\"%s\"; type=\"%s\"", target, JSONLDContextRel, ContentTypeJSONLD)
+}
+
+//linkedContext returns the URL of the @context in the Link headers of a request, if there is one
+func linkedContext(r *http.Request) (string, bool, error) {
+	urls := []string{}
+
+	for _, value := range r.Header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, param := range parts[1:] {
+				name, value := splitLinkParam(param)
+				if name == "rel" && value == JSONLDContextRel {
+					urls = append(urls, target[1:len(target)-1])
+					break
+				}
+			}
+		}
+	}
+
+	if len(urls) > 1 {
+		return "", false, fmt.Errorf("a request must not have more than one JSON-LD context Link header")
+	}
+
+	if len(urls) == 0 {
+		return "", false, nil
+	}
+
+	return urls[0], true, nil
+}
+
+func splitLinkParam(param string) (string, string) {
+	nameAndValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+	if len(nameAndValue) != 2 {
+		return strings.ToLower(nameAndValue[0]), ""
+	}
+	return strings.ToLower(strings.TrimSpace(nameAndValue[0])), strings.Trim(strings.TrimSpace(nameAndValue[1]), "\"")
+}
+
+//newWriteRequestWrapper wraps an incoming request that carries a payload. Payloads must be
+//JSON or JSON-LD. When a JSON payload has its @context in a Link header, the context is moved
+//into the payload so that the context sources always receive JSON-LD. A problem is reported
+//to the response writer if the request can not be accepted, which includes requests that
+//have a payload without a Content-Type.
+func newWriteRequestWrapper(w http.ResponseWriter, r *http.Request) (Request, bool) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		if r.ContentLength == 0 {
+			return newRequestWrapper(r), true
+		}
+
+		errors.ReportNewUnsupportedMediaType(
+			w,
+			fmt.Sprintf("The request payload has no content type. Use %s or %s.", ContentTypeJSON, ContentTypeJSONLD),
+		)
+		return nil, false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != ContentTypeJSON && mediaType != ContentTypeJSONLD) {
+		errors.ReportNewUnsupportedMediaType(
+			w,
+			fmt.Sprintf("The content type %s is not supported. Use %s or %s.", contentType, ContentTypeJSON, ContentTypeJSONLD),
+		)
+		return nil, false
+	}
+
+	request := newRequestWrapper(r)
+	if mediaType != ContentTypeJSON {
+		return request, true
+	}
+
+	linked, found, err := linkedContext(r)
+	if err != nil {
+		errors.ReportNewBadRequestData(w, err.Error())
+		return nil, false
+	}
+
+	if !found {
+		return request, true
+	}
+
+	body, err := withContext(request, linked)
+	if err != nil {
+		errors.ReportNewBadRequestData(w, "Unable to add the linked @context to the request payload: "+err.Error())
+		return nil, false
+	}
+
+	withBody := r.Clone(r.Context())
+	withBody.Header.Set("Content-Type", ContentTypeJSONLD)
+	withBody.Header.Del("Link")
+
+	return newRequestWrapperWithBody(withBody, body), true
+}
+
+//withContext adds a @context to the payload of a request, or to each of the objects in it if the
+//payload is an array, unless they already have one
+func withContext(request Request, ldContext string) ([]byte, error) {
+	var payload interface{}
+	err := request.DecodeBodyInto(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	addContext := func(v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, hasContext := m["@context"]; !hasContext {
+				// An array, since that is how types.BaseEntity expects to find it
+				m["@context"] = []string{ldContext}
+			}
+		}
+	}
+
+	if items, ok := payload.([]interface{}); ok {
+		for _, item := range items {
+			addContext(item)
+		}
+	} else {
+		addContext(payload)
+	}
+
+	return json.Marshal(payload)
+}
@@ -0,0 +1,142 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/matryer/is"
+)
+
+func TestThatContentNegotiationRespectsQValues(t *testing.T) {
+	is := is.New(t)
+
+	testData := []struct {
+		accept      string
+		contentType string
+		acceptable  bool
+	}{
+		{"", ContentTypeJSONLD, true},
+		{"*/*", ContentTypeJSONLD, true},
+		{"application/geo+json;q=0.5, application/json", ContentTypeJSON, true},
+		{"application/ld+json;q=0.1, application/geo+json;q=0.9", geojson.ContentType, true},
+		{"application/*;q=0.5, application/ld+json;q=0", ContentTypeJSON, true},
+		{"text/html", "", false},
+		{"application/json;q=0", "", false},
+	}
+
+	for _, td := range testData {
+		req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:mydevice"), nil)
+		if td.accept != "" {
+			req.Header.Set("Accept", td.accept)
+		}
+
+		contentType, acceptable := negotiateContentType(req, entityContentTypes)
+		is.Equal(acceptable, td.acceptable)   // unexpected acceptability
+		is.Equal(contentType, td.contentType) // unexpected content type
+	}
+}
+
+func TestThatPlainJSONHasItsContextInALinkHeader(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("Device", "value")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.RetrieveEntityFunc = func(entityID string, _ Request) (Entity, error) {
+		return fiware.NewDevice(entityID, "on"), nil
+	}
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:mydevice"), nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	entity := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	is.Equal(w.Code, http.StatusOK)                                            // unexpected response code
+	is.Equal(w.Header().Get("Content-Type"), "application/json;charset=utf-8") // unexpected content type
+	is.Equal(entity["@context"], nil)                                          // the @context should not be in the body
+	is.Equal(w.Header().Get("Link"), `<https://schema.lab.fiware.org/ld/context>; rel="http://www.w3.org/ns/json-ld#context"; type="application/ld+json"`)
+}
+
+func TestThatUnacceptableRepresentationsAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:mydevice"), nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotAcceptable)                                // unexpected response code
+	is.Equal(w.Header().Get("Content-Type"), errors.ProblemReportContentType) // the response should be a problem report
+}
+
+func TestThatUnsupportedContentTypesAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 1)
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`id=urn:ngsi-ld:Device:mydevice`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusUnsupportedMediaType)                         // unexpected response code
+	is.Equal(w.Header().Get("Content-Type"), errors.ProblemReportContentType) // the response should be a problem report
+	is.Equal(len(sources[0].CreateEntityCalls()), 0)                          // no entity should be created
+}
+
+func TestThatPayloadsWithoutAContentTypeAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 1)
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusUnsupportedMediaType) // a payload without a content type should be rejected
+	is.Equal(len(sources[0].CreateEntityCalls()), 0)  // no entity should be created
+}
+
+func TestThatTheLinkedContextIsAddedToJSONPayloads(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 1)
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Link", contextLink("https://schema.lab.fiware.org/ld/context"))
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated) // unexpected response code
+
+	request := sources[0].CreateEntityCalls()[0].Request
+	body, _ := io.ReadAll(request.BodyReader())
+	entity := map[string]interface{}{}
+	json.Unmarshal(body, &entity)
+
+	is.Equal(entity["@context"], []interface{}{"https://schema.lab.fiware.org/ld/context"}) // the linked context should be in the payload
+	is.Equal(request.Request().Header.Get("Content-Type"), ContentTypeJSONLD)               // the payload should now be JSON-LD
+	is.Equal(request.Request().Header.Get("Link"), "")                                      // the Link header should be removed
+
+	req, _ = http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Link", contextLink("https://schema.lab.fiware.org/ld/context"))
+	req.Header.Add("Link", contextLink(CoreContextURL))
+	w = httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // more than one linked context should be rejected
+}
@@ -1,6 +1,17 @@
 package ngsi
 
-//ContextRegistry is where Context Sources register the information that they can provide
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//ContextRegistry is where Context Sources register the information that they can provide.
+//The default registry returned by NewContextRegistry is safe for concurrent use.
 type ContextRegistry interface {
 	GetContextSourcesForQuery(query Query) []ContextSource
 	GetContextSourcesForEntity(entityID string) []ContextSource
@@ -9,71 +20,493 @@ type ContextRegistry interface {
 	Register(source ContextSource)
 }
 
+//ManageableContextRegistry may be implemented by context registries that are able to list the
+//sources that have been registered, including those that have expired, and to remove them
+//again. The csource registration handlers and the ContextSourceJanitor need it to do their
+//work. The default registry implements it.
+type ManageableContextRegistry interface {
+	ListContextSources() []RegisteredContextSource
+	Unregister(sourceID string) error
+}
+
+//LockableContextRegistry may be implemented by context registries that hold a lock for the csource
+//registration handlers and the ContextSourceJanitor to take while they change the registrations, so
+//that the checks that they make are not invalidated by concurrent changes. The default registry
+//implements it. Changes to registries that do not implement it are not serialized.
+type LockableContextRegistry interface {
+	RegistrationLock() sync.Locker
+}
+
+//RegisteredContextSource is a context source together with the ID that it is registered with
+type RegisteredContextSource struct {
+	ID     string
+	Source ContextSource
+}
+
+//IdentifiableContextSource may be implemented by context sources that have an ID of their own.
+//Sources that do not implement it are given a generated ID when they are registered.
+//Registering a source with the same ID as an already registered source replaces that source.
+type IdentifiableContextSource interface {
+	ID() string
+}
+
+//IndexableContextSource may be implemented by context sources that are able to list all the
+//entity types and attributes that they provide, so that a registry can find them without asking
+//every registered source. An empty name in a list means that the source provides entities of any
+//type, or attributes of any name. The lists must not change while the source is registered.
+type IndexableContextSource interface {
+	ProvidedTypes() []string
+	ProvidedAttributes() []string
+}
+
+//ExpiringContextSource may be implemented by context sources that should only be used until a
+//certain point in time. Registries do not return expired sources from their lookups, and
+//a ContextSourceJanitor removes them from the registry.
+type ExpiringContextSource interface {
+	ExpiresAt() (time.Time, bool)
+}
+
+//HealthAwareContextSource may be implemented by context sources that keep track of their own
+//health. Registries do not return sources that report that they are unavailable from their lookups.
+type HealthAwareContextSource interface {
+	Available() bool
+}
+
+//GeoScopedContextSource may be implemented by context sources that only provide entities within
+//a certain area. Registries leave such sources out when looking up sources for geo-queries whose
+//area does not intersect with that of the source.
+type GeoScopedContextSource interface {
+	IntersectsGeoQuery(gq GeoQuery) bool
+}
+
+//RegistrationMode decides how requests are routed to a context source, see ModalContextSource
+type RegistrationMode string
+
+const (
+	//ModeInclusive sources provide some of the information about an entity. They get both reads and writes.
+	ModeInclusive RegistrationMode = "inclusive"
+	//ModeExclusive sources own the attributes that they provide, and no other sources are used for
+	//those. An exclusive source that does not restrict its attributes owns whole entities.
+	ModeExclusive RegistrationMode = "exclusive"
+	//ModeRedirect sources hold the entities that they provide elsewhere. They get both reads and writes.
+	ModeRedirect RegistrationMode = "redirect"
+	//ModeAuxiliary sources are never written to, and are only read from when no other source answers
+	ModeAuxiliary RegistrationMode = "auxiliary"
+)
+
+//ModalContextSource may be implemented by context sources that are registered with another mode
+//than ModeInclusive, which is assumed for all other sources
+type ModalContextSource interface {
+	RegistrationMode() RegistrationMode
+}
+
 //NewContextRegistry initializes and returns a new default context registry without
 //any registered context sources
 func NewContextRegistry() ContextRegistry {
-	return &registry{}
+	return &registry{
+		sources:     map[string]*registeredSource{},
+		byType:      map[string][]*registeredSource{},
+		byAttribute: map[string][]*registeredSource{},
+	}
+}
+
+type registeredSource struct {
+	id         string
+	seq        uint64
+	source     ContextSource
+	types      []string
+	attributes []string
 }
 
+//registry keeps its sources, as well as each of its indices, in slices that are ordered by
+//registration, so that lookups can return the sources in that order without sorting them
 type registry struct {
-	sources []ContextSource
+	mu      sync.RWMutex
+	nextSeq uint64
+
+	registrationMu sync.Mutex
+
+	sources     map[string]*registeredSource
+	ordered     []*registeredSource
+	byType      map[string][]*registeredSource
+	byAttribute map[string][]*registeredSource
+	unindexed   []*registeredSource
+}
+
+//RegistrationLock returns the lock that serializes the changes to the registrations in the registry
+func (r *registry) RegistrationLock() sync.Locker {
+	return &r.registrationMu
 }
 
 func (r *registry) GetContextSourcesForEntity(entityID string) []ContextSource {
-	matchingSources := []ContextSource{}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Entity IDs are matched against patterns, so there is no index to use here
+	return r.matching(r.ordered, func(src ContextSource) bool {
+		return src.ProvidesEntitiesWithMatchingID(entityID)
+	})
+}
+
+func (r *registry) GetContextSourcesForEntityType(entityType string) []ContextSource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	providesType := func(src ContextSource) bool {
+		return src.ProvidesType(entityType)
+	}
+
+	return r.matching(r.candidates(r.byType, []string{entityType}), providesType)
+}
 
-	// TODO: Fix potential race issue
-	for _, src := range r.sources {
-		if src.ProvidesEntitiesWithMatchingID(entityID) {
-			matchingSources = append(matchingSources, src)
+func (r *registry) GetContextSourcesForQuery(query Query) []ContextSource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entityTypeNames := query.EntityTypes()
+	entityAttributeNames := query.EntityAttributes()
+
+	// Narrow the search down using the most specific index. A name that is empty
+	// means "any type" or "any attribute" and can not be looked up in an index.
+	candidates := r.ordered
+	if !containsEmptyName(entityTypeNames) {
+		candidates = r.candidates(r.byType, entityTypeNames)
+	} else if !containsEmptyName(entityAttributeNames) {
+		candidates = r.candidates(r.byAttribute, entityAttributeNames)
+	}
+
+	return r.matching(candidates, func(src ContextSource) bool {
+		if query.IsGeoQuery() && !intersectsGeoQuery(src, query.Geo()) {
+			return false
 		}
+
+		return providesAny(entityTypeNames, src.ProvidesType) &&
+			providesAny(entityAttributeNames, src.ProvidesAttribute)
+	})
+}
+
+//ListContextSources lists the registered sources in the order that they were registered. Sources
+//that have expired are listed until they are removed, so that a ContextSourceJanitor can find them.
+func (r *registry) ListContextSources() []RegisteredContextSource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	registered := make([]RegisteredContextSource, 0, len(r.ordered))
+	for _, rs := range r.ordered {
+		registered = append(registered, RegisteredContextSource{ID: rs.id, Source: rs.source})
 	}
 
-	return matchingSources
+	return registered
 }
 
-func (r *registry) GetContextSourcesForEntityType(entityType string) []ContextSource {
+func (r *registry) Register(source ContextSource) {
+	rs := &registeredSource{source: source}
+
+	if ics, ok := source.(IdentifiableContextSource); ok && ics.ID() != "" {
+		rs.id = ics.ID()
+	} else {
+		rs.id = uuid.New().String()
+	}
+
+	indexable, isIndexable := source.(IndexableContextSource)
+	if isIndexable {
+		rs.types = indexable.ProvidedTypes()
+		rs.attributes = indexable.ProvidedAttributes()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A source that replaces another one with the same ID keeps its place in the registration order
+	if existing, ok := r.sources[rs.id]; ok {
+		rs.seq = existing.seq
+		r.remove(existing)
+	} else {
+		rs.seq = r.nextSeq
+		r.nextSeq++
+	}
+
+	r.sources[rs.id] = rs
+	r.ordered = insertByRegistration(r.ordered, rs)
+
+	if !isIndexable {
+		r.unindexed = insertByRegistration(r.unindexed, rs)
+		return
+	}
+
+	addToIndex(r.byType, rs.types, rs)
+	addToIndex(r.byAttribute, rs.attributes, rs)
+}
+
+func (r *registry) Unregister(sourceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rs, ok := r.sources[sourceID]
+	if !ok {
+		return fmt.Errorf("no context source with id %s is registered", sourceID)
+	}
+
+	r.remove(rs)
+
+	return nil
+}
+
+//remove removes a registered source from the registry. The caller must hold the write lock.
+func (r *registry) remove(rs *registeredSource) {
+	delete(r.sources, rs.id)
+	r.ordered = removeByRegistration(r.ordered, rs)
+	r.unindexed = removeByRegistration(r.unindexed, rs)
+	removeFromIndex(r.byType, rs.types, rs)
+	removeFromIndex(r.byAttribute, rs.attributes, rs)
+}
+
+//candidates returns the unindexed sources together with the sources that are indexed under
+//any of the given names, or under the empty name, in the order that they were registered.
+//The caller must hold the read lock.
+func (r *registry) candidates(index map[string][]*registeredSource, names []string) []*registeredSource {
+	lists := [][]*registeredSource{r.unindexed}
+
+	for _, name := range append([]string{""}, names...) {
+		lists = append(lists, index[name])
+	}
+
+	return mergeByRegistration(lists)
+}
+
+//matching returns the candidates that have not expired, are available and match the predicate,
+//in the order that they were registered
+func (r *registry) matching(candidates []*registeredSource, predicate func(ContextSource) bool) []ContextSource {
 	matchingSources := []ContextSource{}
+	now := time.Now()
 
-	// TODO: Fix potential race issue
-	for _, src := range r.sources {
-		if src.ProvidesType(entityType) {
-			matchingSources = append(matchingSources, src)
+	for _, rs := range candidates {
+		if !hasExpired(rs.source, now) && available(rs.source) && predicate(rs.source) {
+			matchingSources = append(matchingSources, rs.source)
 		}
 	}
 
 	return matchingSources
 }
 
-func (r *registry) GetContextSourcesForQuery(query Query) []ContextSource {
-	matchingSources := []ContextSource{}
+//insertByRegistration inserts a source into a slice that is ordered by registration
+func insertByRegistration(sources []*registeredSource, rs *registeredSource) []*registeredSource {
+	idx := sort.Search(len(sources), func(i int) bool {
+		return sources[i].seq >= rs.seq
+	})
 
-	entityTypeNames := query.EntityTypes()
-	entityAttributeNames := query.EntityAttributes()
+	sources = append(sources, nil)
+	copy(sources[idx+1:], sources[idx:])
+	sources[idx] = rs
+
+	return sources
+}
+
+//removeByRegistration removes a source from a slice that is ordered by registration, if it is there
+func removeByRegistration(sources []*registeredSource, rs *registeredSource) []*registeredSource {
+	idx := sort.Search(len(sources), func(i int) bool {
+		return sources[i].seq >= rs.seq
+	})
+
+	if idx == len(sources) || sources[idx] != rs {
+		return sources
+	}
 
-	// TODO: Fix potential race issue
-	for _, src := range r.sources {
-		for _, typeName := range entityTypeNames {
-			if typeName == "" || src.ProvidesType(typeName) {
-				for _, attributeName := range entityAttributeNames {
-					if attributeName == "" || src.ProvidesAttribute(attributeName) {
-						matchingSources = append(matchingSources, src)
-						break
-					}
-				}
+	copy(sources[idx:], sources[idx+1:])
+	sources[len(sources)-1] = nil
+
+	return sources[:len(sources)-1]
+}
+
+//mergeByRegistration merges slices that are ordered by registration into one ordered slice,
+//in which a source that is found in more than one of the slices only appears once
+func mergeByRegistration(lists [][]*registeredSource) []*registeredSource {
+	merged := []*registeredSource{}
+	positions := make([]int, len(lists))
+
+	for {
+		next := -1
+		for i, list := range lists {
+			if positions[i] < len(list) && (next == -1 || list[positions[i]].seq < lists[next][positions[next]].seq) {
+				next = i
 			}
 		}
+
+		if next == -1 {
+			return merged
+		}
+
+		rs := lists[next][positions[next]]
+		positions[next]++
+
+		if len(merged) == 0 || merged[len(merged)-1] != rs {
+			merged = append(merged, rs)
+		}
 	}
+}
 
-	return matchingSources
+func registrationModeOf(source ContextSource) RegistrationMode {
+	modal, ok := source.(ModalContextSource)
+	if !ok || modal.RegistrationMode() == "" {
+		return ModeInclusive
+	}
+
+	return modal.RegistrationMode()
 }
 
-func (r *registry) Register(source ContextSource) {
-	// TODO: Fix potential race issue
-	r.sources = append(r.sources, source)
+//sourcesWithModes returns the sources that are registered with any of the modes, keeping their order
+func sourcesWithModes(sources []ContextSource, modes ...RegistrationMode) []ContextSource {
+	result := []ContextSource{}
+
+	for _, source := range sources {
+		mode := registrationModeOf(source)
+		for _, m := range modes {
+			if mode == m {
+				result = append(result, source)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+//exclusiveClaims holds the attributes that exclusive sources have claimed for themselves. An
+//exclusive source that does not restrict its attributes claims whole entities.
+type exclusiveClaims struct {
+	wholeEntities bool
+	attributes    map[string]bool
+}
+
+func exclusiveClaimsOf(sources []ContextSource) exclusiveClaims {
+	claims := exclusiveClaims{attributes: map[string]bool{}}
+
+	for _, source := range sourcesWithModes(sources, ModeExclusive) {
+		indexable, ok := source.(IndexableContextSource)
+		if !ok || containsEmptyName(indexable.ProvidedAttributes()) {
+			claims.wholeEntities = true
+			continue
+		}
+
+		for _, name := range indexable.ProvidedAttributes() {
+			claims.attributes[name] = true
+		}
+	}
+
+	return claims
+}
+
+//allows returns true if a source may be used for an attribute. Exclusive sources are only used
+//for the attributes they provide, and other sources only for the attributes that no exclusive
+//source has claimed.
+func (ec exclusiveClaims) allows(source ContextSource, attributeName string) bool {
+	if registrationModeOf(source) == ModeExclusive {
+		return ec.wholeEntities || source.ProvidesAttribute(attributeName)
+	}
+	return !ec.wholeEntities && !ec.attributes[attributeName]
+}
+
+func (ec exclusiveClaims) allowsAny(source ContextSource, attributeNames []string) bool {
+	for _, name := range attributeNames {
+		if ec.allows(source, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//sourcesForWriting selects the sources that should receive a write request for the named
+//attributes, or for whole entities if no attributes are named. Exclusive sources own the
+//attributes they have registered, so no other source is written to for those. Auxiliary
+//sources are never written to.
+func sourcesForWriting(sources []ContextSource, attributeNames ...string) []ContextSource {
+	claims := exclusiveClaimsOf(sources)
+	if claims.wholeEntities {
+		return sourcesWithModes(sources, ModeExclusive)
+	}
+
+	writable := sourcesWithModes(sources, ModeExclusive, ModeInclusive, ModeRedirect)
+	if len(attributeNames) == 0 {
+		return writable
+	}
+
+	result := []ContextSource{}
+	for _, source := range writable {
+		if claims.allowsAny(source, attributeNames) {
+			result = append(result, source)
+		}
+	}
+
+	return result
+}
+
+//sourcesForReading splits the sources that should be read from into the primary sources and the
+//auxiliary sources, which should only be used when none of the primary sources answer. Other
+//sources are only left out if an exclusive source claims whole entities.
+func sourcesForReading(sources []ContextSource) (primary, auxiliary []ContextSource) {
+	if exclusiveClaimsOf(sources).wholeEntities {
+		return sourcesWithModes(sources, ModeExclusive), []ContextSource{}
+	}
+
+	return sourcesWithModes(sources, ModeExclusive, ModeInclusive, ModeRedirect), sourcesWithModes(sources, ModeAuxiliary)
 }
 
-//ContextSource provides query and subscription support for a set of entities
+func available(source ContextSource) bool {
+	if has, ok := source.(HealthAwareContextSource); ok {
+		return has.Available()
+	}
+	return true
+}
+
+func intersectsGeoQuery(source ContextSource, gq GeoQuery) bool {
+	scoped, ok := source.(GeoScopedContextSource)
+	return !ok || scoped.IntersectsGeoQuery(gq)
+}
+
+//hasExpired returns true if the source is an ExpiringContextSource that has expired at the given time
+func hasExpired(source ContextSource, now time.Time) bool {
+	if ecs, ok := source.(ExpiringContextSource); ok {
+		expiresAt, expires := ecs.ExpiresAt()
+		return expires && !now.Before(expiresAt)
+	}
+	return false
+}
+
+func addToIndex(index map[string][]*registeredSource, names []string, rs *registeredSource) {
+	for _, name := range names {
+		index[name] = insertByRegistration(index[name], rs)
+	}
+}
+
+func removeFromIndex(index map[string][]*registeredSource, names []string, rs *registeredSource) {
+	for _, name := range names {
+		index[name] = removeByRegistration(index[name], rs)
+		if len(index[name]) == 0 {
+			delete(index, name)
+		}
+	}
+}
+
+func containsEmptyName(names []string) bool {
+	for _, name := range names {
+		if name == "" {
+			return true
+		}
+	}
+	return len(names) == 0
+}
+
+func providesAny(names []string, provides func(string) bool) bool {
+	for _, name := range names {
+		if name == "" || provides(name) {
+			return true
+		}
+	}
+	return false
+}
+
+//ContextSource provides query and subscription support for a set of entities.
+//GetEntities is expected to honour the pagination offset and limit of the query.
 type ContextSource interface {
 	ProvidesAttribute(attributeName string) bool
 	ProvidesEntitiesWithMatchingID(entityID string) bool
@@ -81,7 +514,116 @@ type ContextSource interface {
 	ProvidesType(typeName string) bool
 
 	CreateEntity(typeName, entityID string, request Request) error
+	DeleteEntity(entityID string, request Request) error
 	GetEntities(query Query, callback QueryEntitiesCallback) error
 	RetrieveEntity(entityID string, request Request) (Entity, error)
+	AppendEntityAttributes(entityID string, noOverwrite bool, request Request) error
 	UpdateEntityAttributes(entityID string, request Request) error
+	DeleteEntityAttribute(entityID, attributeName string, request Request) error
+}
+
+//EntityCounter may be implemented by context sources that are able to count the entities
+//that match a query without returning them
+type EntityCounter interface {
+	CountEntities(ctx context.Context, query Query) (uint64, error)
+}
+
+//FilteredContextSource may be implemented by context sources that do not necessarily apply all
+//of a query themselves, such as remote sources that ignore the parameters they do not support.
+//The entities they return are matched against the query again before they are used.
+type FilteredContextSource interface {
+	NeedsQueryFiltering() bool
+}
+
+//ContextAwareSource is a ContextSource that also accepts a context.Context with each operation,
+//so that cancellation, deadlines and tracing information can be passed on to remote parties.
+//The handlers in this package use these methods for all sources, and sources that only implement
+//ContextSource are wrapped with NewContextAwareSource.
+type ContextAwareSource interface {
+	ContextSource
+
+	CreateEntityWithContext(ctx context.Context, typeName, entityID string, request Request) error
+	DeleteEntityWithContext(ctx context.Context, entityID string, request Request) error
+	GetEntitiesWithContext(ctx context.Context, query Query, callback QueryEntitiesCallback) error
+	RetrieveEntityWithContext(ctx context.Context, entityID string, request Request) (Entity, error)
+	AppendEntityAttributesWithContext(ctx context.Context, entityID string, noOverwrite bool, request Request) error
+	UpdateEntityAttributesWithContext(ctx context.Context, entityID string, request Request) error
+	DeleteEntityAttributeWithContext(ctx context.Context, entityID, attributeName string, request Request) error
+}
+
+//NewContextAwareSource returns the source as a ContextAwareSource. Sources that do not implement
+//the context aware methods themselves are wrapped in an adapter that checks the context before
+//each operation and stops passing entities to query callbacks once the context is done.
+func NewContextAwareSource(source ContextSource) ContextAwareSource {
+	if cas, ok := source.(ContextAwareSource); ok {
+		return cas
+	}
+
+	return &contextSourceAdapter{ContextSource: source}
+}
+
+type contextSourceAdapter struct {
+	ContextSource
+}
+
+func (csa *contextSourceAdapter) CreateEntityWithContext(ctx context.Context, typeName, entityID string, request Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return csa.CreateEntity(typeName, entityID, request)
+}
+
+func (csa *contextSourceAdapter) DeleteEntityWithContext(ctx context.Context, entityID string, request Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return csa.DeleteEntity(entityID, request)
+}
+
+func (csa *contextSourceAdapter) GetEntitiesWithContext(ctx context.Context, query Query, callback QueryEntitiesCallback) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := csa.GetEntities(query, func(entity Entity) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return callback(entity)
+	})
+
+	if err == nil {
+		// The source may have ignored the error from the callback, so check the context again
+		err = ctx.Err()
+	}
+
+	return err
+}
+
+func (csa *contextSourceAdapter) RetrieveEntityWithContext(ctx context.Context, entityID string, request Request) (Entity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return csa.RetrieveEntity(entityID, request)
+}
+
+func (csa *contextSourceAdapter) AppendEntityAttributesWithContext(ctx context.Context, entityID string, noOverwrite bool, request Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return csa.AppendEntityAttributes(entityID, noOverwrite, request)
+}
+
+func (csa *contextSourceAdapter) UpdateEntityAttributesWithContext(ctx context.Context, entityID string, request Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return csa.UpdateEntityAttributes(entityID, request)
+}
+
+func (csa *contextSourceAdapter) DeleteEntityAttributeWithContext(ctx context.Context, entityID, attributeName string, request Request) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return csa.DeleteEntityAttribute(entityID, attributeName, request)
 }
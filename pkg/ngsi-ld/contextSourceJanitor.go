@@ -0,0 +1,88 @@
+package ngsi
+
+import (
+	"sync"
+	"time"
+)
+
+//ExpiryCallback is called for every context source that a ContextSourceJanitor removes
+//from a registry because it has expired
+type ExpiryCallback func(source RegisteredContextSource)
+
+//ContextSourceJanitor periodically removes expired context sources from a ContextRegistry. Registries
+//that do not implement ManageableContextRegistry are left as they are.
+type ContextSourceJanitor struct {
+	ctxReg    ContextRegistry
+	onExpired ExpiryCallback
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+//StartContextSourceJanitor starts a janitor that looks for expired context sources in the registry
+//every interval. The callback, which may be nil, is called for each source that is removed.
+//Registrations are renewed by updating their expiresAt before they expire.
+func StartContextSourceJanitor(ctxReg ContextRegistry, interval time.Duration, onExpired ExpiryCallback) *ContextSourceJanitor {
+	janitor := &ContextSourceJanitor{
+		ctxReg:    ctxReg,
+		onExpired: onExpired,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go janitor.run(interval)
+
+	return janitor
+}
+
+//Stop stops the janitor and waits for it to finish any cleanup that is in progress
+func (j *ContextSourceJanitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
+
+func (j *ContextSourceJanitor) run(interval time.Duration) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case now := <-ticker.C:
+			j.removeExpired(now)
+		}
+	}
+}
+
+func (j *ContextSourceJanitor) removeExpired(now time.Time) {
+	manageable, ok := j.ctxReg.(ManageableContextRegistry)
+	if !ok {
+		return
+	}
+
+	expired := []RegisteredContextSource{}
+
+	// Keep the registration handlers from renewing a source between the check and its removal
+	lock := registrationLock(j.ctxReg)
+	lock.Lock()
+
+	for _, rs := range manageable.ListContextSources() {
+		if hasExpired(rs.Source, now) && manageable.Unregister(rs.ID) == nil {
+			expired = append(expired, rs)
+		}
+	}
+
+	lock.Unlock()
+
+	if j.onExpired != nil {
+		for _, rs := range expired {
+			j.onExpired(rs)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package ngsi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestThatExpiredSourcesAreNotReturnedFromLookups(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(newExpiringTestSource("WeatherObserved", time.Now().Add(-time.Minute)))
+	ctxRegistry.Register(newExpiringTestSource("WeatherObserved", time.Now().Add(time.Hour)))
+
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")), 1) // expired sources should not be returned
+	is.Equal(len(ctxRegistry.(ManageableContextRegistry).ListContextSources()), 2)  // expired sources should be listed until they are removed
+}
+
+func TestThatLookupsUseTheCurrentExpiryOfTheSources(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	source := newExpiringTestSource("WeatherObserved", time.Now().Add(-time.Minute))
+	ctxRegistry.Register(source)
+
+	registration := source.(*remoteContextSource).registration.(*ctxSrcReg)
+	registration.Expires = time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")), 1) // the renewed expiry should be used
+}
+
+func TestThatTheJanitorRemovesExpiredSources(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	expiringSource := newExpiringTestSource("WeatherObserved", time.Now().Add(20*time.Millisecond))
+	ctxRegistry.Register(expiringSource)
+	ctxRegistry.Register(newExpiringTestSource("WeatherObserved", time.Now().Add(time.Hour)))
+
+	expired := make(chan RegisteredContextSource, 1)
+	janitor := StartContextSourceJanitor(ctxRegistry, 5*time.Millisecond, func(rs RegisteredContextSource) {
+		expired <- rs
+	})
+	defer janitor.Stop()
+
+	select {
+	case rs := <-expired:
+		is.True(rs.Source == expiringSource) // the wrong source expired
+	case <-time.After(time.Second):
+		t.Fatal("the expired source was not removed")
+	}
+
+	is.Equal(len(ctxRegistry.(*registry).sources), 1) // the expired source should have been removed
+}
+
+func TestThatAStoppedJanitorDoesNotRemoveSources(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(newExpiringTestSource("WeatherObserved", time.Now().Add(20*time.Millisecond)))
+
+	janitor := StartContextSourceJanitor(ctxRegistry, 5*time.Millisecond, nil)
+	janitor.Stop()
+	janitor.Stop()
+
+	time.Sleep(40 * time.Millisecond)
+
+	is.Equal(len(ctxRegistry.(*registry).sources), 1) // a stopped janitor should not remove sources
+}
+
+func TestThatRegistrationsCanBeRenewed(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	expiresAt := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	body := `{"type":"ContextSourceRegistration","information":[{"entities":[{"type":"A"}]}],"expiresAt":"` + expiresAt + `","endpoint":"http://localhost:1234"}`
+
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusCreated) // registration should succeed
+
+	renewedAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	fragment := `{"expiresAt":"` + renewedAt.Format(time.RFC3339) + `"}`
+
+	req, _ = http.NewRequest("PATCH", "http://localhost:8080"+w.Header().Get("Location"), strings.NewReader(fragment))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w = httptest.NewRecorder()
+	NewUpdateContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusNoContent) // renewal should succeed
+
+	sources := ctxRegistry.GetContextSourcesForEntityType("A")
+	is.Equal(len(sources), 1) // expected one source
+
+	newExpiry, _ := sources[0].(*remoteContextSource).registration.(ExpiringContextSource).ExpiresAt()
+	is.True(newExpiry.Equal(renewedAt)) // the registration should have been renewed
+}
+
+func newExpiringTestSource(typeName string, expiresAt time.Time) ContextSource {
+	registration, _ := NewCsourceRegistration(typeName, []string{}, "http://localhost", nil)
+	registration.(*ctxSrcReg).Expires = expiresAt.Format(time.RFC3339Nano)
+	contextSource, _ := NewRemoteContextSource(registration)
+	return contextSource
+}
@@ -17,9 +17,18 @@ var _ ContextSource = &ContextSourceMock{}
 //
 // 		// make and configure a mocked ContextSource
 // 		mockedContextSource := &ContextSourceMock{
+// 			AppendEntityAttributesFunc: func(entityID string, noOverwrite bool, request Request) error {
+// 				panic("mock out the AppendEntityAttributes method")
+// 			},
 // 			CreateEntityFunc: func(typeName string, entityID string, request Request) error {
 // 				panic("mock out the CreateEntity method")
 // 			},
+// 			DeleteEntityFunc: func(entityID string, request Request) error {
+// 				panic("mock out the DeleteEntity method")
+// 			},
+// 			DeleteEntityAttributeFunc: func(entityID string, attributeName string, request Request) error {
+// 				panic("mock out the DeleteEntityAttribute method")
+// 			},
 // 			GetEntitiesFunc: func(query Query, callback QueryEntitiesCallback) error {
 // 				panic("mock out the GetEntities method")
 // 			},
@@ -48,9 +57,18 @@ var _ ContextSource = &ContextSourceMock{}
 //
 // 	}
 type ContextSourceMock struct {
+	// AppendEntityAttributesFunc mocks the AppendEntityAttributes method.
+	AppendEntityAttributesFunc func(entityID string, noOverwrite bool, request Request) error
+
 	// CreateEntityFunc mocks the CreateEntity method.
 	CreateEntityFunc func(typeName string, entityID string, request Request) error
 
+	// DeleteEntityFunc mocks the DeleteEntity method.
+	DeleteEntityFunc func(entityID string, request Request) error
+
+	// DeleteEntityAttributeFunc mocks the DeleteEntityAttribute method.
+	DeleteEntityAttributeFunc func(entityID string, attributeName string, request Request) error
+
 	// GetEntitiesFunc mocks the GetEntities method.
 	GetEntitiesFunc func(query Query, callback QueryEntitiesCallback) error
 
@@ -74,6 +92,15 @@ type ContextSourceMock struct {
 
 	// calls tracks calls to the methods.
 	calls struct {
+		// AppendEntityAttributes holds details about calls to the AppendEntityAttributes method.
+		AppendEntityAttributes []struct {
+			// EntityID is the entityID argument value.
+			EntityID string
+			// NoOverwrite is the noOverwrite argument value.
+			NoOverwrite bool
+			// Request is the request argument value.
+			Request Request
+		}
 		// CreateEntity holds details about calls to the CreateEntity method.
 		CreateEntity []struct {
 			// TypeName is the typeName argument value.
@@ -83,6 +110,22 @@ type ContextSourceMock struct {
 			// Request is the request argument value.
 			Request Request
 		}
+		// DeleteEntity holds details about calls to the DeleteEntity method.
+		DeleteEntity []struct {
+			// EntityID is the entityID argument value.
+			EntityID string
+			// Request is the request argument value.
+			Request Request
+		}
+		// DeleteEntityAttribute holds details about calls to the DeleteEntityAttribute method.
+		DeleteEntityAttribute []struct {
+			// EntityID is the entityID argument value.
+			EntityID string
+			// AttributeName is the attributeName argument value.
+			AttributeName string
+			// Request is the request argument value.
+			Request Request
+		}
 		// GetEntities holds details about calls to the GetEntities method.
 		GetEntities []struct {
 			// Query is the query argument value.
@@ -125,7 +168,10 @@ type ContextSourceMock struct {
 			Request Request
 		}
 	}
+	lockAppendEntityAttributes         sync.RWMutex
 	lockCreateEntity                   sync.RWMutex
+	lockDeleteEntity                   sync.RWMutex
+	lockDeleteEntityAttribute          sync.RWMutex
 	lockGetEntities                    sync.RWMutex
 	lockGetProvidedTypeFromID          sync.RWMutex
 	lockProvidesAttribute              sync.RWMutex
@@ -135,6 +181,45 @@ type ContextSourceMock struct {
 	lockUpdateEntityAttributes         sync.RWMutex
 }
 
+// AppendEntityAttributes calls AppendEntityAttributesFunc.
+func (mock *ContextSourceMock) AppendEntityAttributes(entityID string, noOverwrite bool, request Request) error {
+	if mock.AppendEntityAttributesFunc == nil {
+		panic("ContextSourceMock.AppendEntityAttributesFunc: method is nil but ContextSource.AppendEntityAttributes was just called")
+	}
+	callInfo := struct {
+		EntityID    string
+		NoOverwrite bool
+		Request     Request
+	}{
+		EntityID:    entityID,
+		NoOverwrite: noOverwrite,
+		Request:     request,
+	}
+	mock.lockAppendEntityAttributes.Lock()
+	mock.calls.AppendEntityAttributes = append(mock.calls.AppendEntityAttributes, callInfo)
+	mock.lockAppendEntityAttributes.Unlock()
+	return mock.AppendEntityAttributesFunc(entityID, noOverwrite, request)
+}
+
+// AppendEntityAttributesCalls gets all the calls that were made to AppendEntityAttributes.
+// Check the length with:
+//     len(mockedContextSource.AppendEntityAttributesCalls())
+func (mock *ContextSourceMock) AppendEntityAttributesCalls() []struct {
+	EntityID    string
+	NoOverwrite bool
+	Request     Request
+} {
+	var calls []struct {
+		EntityID    string
+		NoOverwrite bool
+		Request     Request
+	}
+	mock.lockAppendEntityAttributes.RLock()
+	calls = mock.calls.AppendEntityAttributes
+	mock.lockAppendEntityAttributes.RUnlock()
+	return calls
+}
+
 // CreateEntity calls CreateEntityFunc.
 func (mock *ContextSourceMock) CreateEntity(typeName string, entityID string, request Request) error {
 	if mock.CreateEntityFunc == nil {
@@ -174,6 +259,80 @@ func (mock *ContextSourceMock) CreateEntityCalls() []struct {
 	return calls
 }
 
+// DeleteEntity calls DeleteEntityFunc.
+func (mock *ContextSourceMock) DeleteEntity(entityID string, request Request) error {
+	if mock.DeleteEntityFunc == nil {
+		panic("ContextSourceMock.DeleteEntityFunc: method is nil but ContextSource.DeleteEntity was just called")
+	}
+	callInfo := struct {
+		EntityID string
+		Request  Request
+	}{
+		EntityID: entityID,
+		Request:  request,
+	}
+	mock.lockDeleteEntity.Lock()
+	mock.calls.DeleteEntity = append(mock.calls.DeleteEntity, callInfo)
+	mock.lockDeleteEntity.Unlock()
+	return mock.DeleteEntityFunc(entityID, request)
+}
+
+// DeleteEntityCalls gets all the calls that were made to DeleteEntity.
+// Check the length with:
+//     len(mockedContextSource.DeleteEntityCalls())
+func (mock *ContextSourceMock) DeleteEntityCalls() []struct {
+	EntityID string
+	Request  Request
+} {
+	var calls []struct {
+		EntityID string
+		Request  Request
+	}
+	mock.lockDeleteEntity.RLock()
+	calls = mock.calls.DeleteEntity
+	mock.lockDeleteEntity.RUnlock()
+	return calls
+}
+
+// DeleteEntityAttribute calls DeleteEntityAttributeFunc.
+func (mock *ContextSourceMock) DeleteEntityAttribute(entityID string, attributeName string, request Request) error {
+	if mock.DeleteEntityAttributeFunc == nil {
+		panic("ContextSourceMock.DeleteEntityAttributeFunc: method is nil but ContextSource.DeleteEntityAttribute was just called")
+	}
+	callInfo := struct {
+		EntityID      string
+		AttributeName string
+		Request       Request
+	}{
+		EntityID:      entityID,
+		AttributeName: attributeName,
+		Request:       request,
+	}
+	mock.lockDeleteEntityAttribute.Lock()
+	mock.calls.DeleteEntityAttribute = append(mock.calls.DeleteEntityAttribute, callInfo)
+	mock.lockDeleteEntityAttribute.Unlock()
+	return mock.DeleteEntityAttributeFunc(entityID, attributeName, request)
+}
+
+// DeleteEntityAttributeCalls gets all the calls that were made to DeleteEntityAttribute.
+// Check the length with:
+//     len(mockedContextSource.DeleteEntityAttributeCalls())
+func (mock *ContextSourceMock) DeleteEntityAttributeCalls() []struct {
+	EntityID      string
+	AttributeName string
+	Request       Request
+} {
+	var calls []struct {
+		EntityID      string
+		AttributeName string
+		Request       Request
+	}
+	mock.lockDeleteEntityAttribute.RLock()
+	calls = mock.calls.DeleteEntityAttribute
+	mock.lockDeleteEntityAttribute.RUnlock()
+	return calls
+}
+
 // GetEntities calls GetEntitiesFunc.
 func (mock *ContextSourceMock) GetEntities(query Query, callback QueryEntitiesCallback) error {
 	if mock.GetEntitiesFunc == nil {
@@ -0,0 +1,135 @@
+package ngsi
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestThatRegistryFindsIndexedAndUnindexedSources(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(newIndexedTestSource("WeatherObserved", "temperature"))
+	ctxRegistry.Register(newMockedContextSource("WeatherObserved", "snowHeight"))
+	ctxRegistry.Register(newIndexedTestSource("RoadSegment", "surfaceType"))
+
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")), 2) // expected both WeatherObserved sources
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("RoadSegment")), 1)     // expected one RoadSegment source
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("Device")), 0)          // expected no Device sources
+
+	query, _ := NewQuery().WithAttributes("surfaceType").Build()
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 1) // expected one source for the surfaceType attribute
+}
+
+func TestThatQueriesForSeveralTypesReturnEachSourceOnce(t *testing.T) {
+	is := is.New(t)
+
+	registration := &ctxSrcReg{Information: []ctxSrcRegInfo{{
+		Entities: []entityInfo{{Type: "WeatherObserved"}, {Type: "RoadSegment"}},
+	}}}
+	contextSource, _ := NewRemoteContextSource(registration)
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	query, _ := NewQuery().WithTypes("WeatherObserved", "RoadSegment").Build()
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 1) // a source should only be returned once
+}
+
+func TestThatSourcesAreReturnedInRegistrationOrder(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	first := newIndexedTestSource("WeatherObserved", "")
+	second := newMockedContextSource("WeatherObserved", "")
+	third := newIndexedTestSource("WeatherObserved", "")
+
+	ctxRegistry.Register(first)
+	ctxRegistry.Register(second)
+	ctxRegistry.Register(third)
+
+	sources := ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")
+	is.Equal(len(sources), 3)     // expected three sources
+	is.True(sources[0] == first)  // unexpected first source
+	is.True(sources[1] == second) // unexpected second source
+	is.True(sources[2] == third)  // unexpected third source
+}
+
+func TestThatRegisteredSourcesCanBeListedAndUnregistered(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newIndexedTestSource("WeatherObserved", "temperature")
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+	ctxRegistry.Register(newMockedContextSource("WeatherObserved", ""))
+
+	registered := ctxRegistry.(ManageableContextRegistry).ListContextSources()
+	is.Equal(len(registered), 2)                                          // expected two registered sources
+	is.Equal(registered[0].ID, contextSource.(*remoteContextSource).ID()) // a remote source should be registered with its own ID
+	is.True(registered[1].ID != "")                                       // other sources should be given an ID
+
+	for _, rs := range registered {
+		is.NoErr(ctxRegistry.(ManageableContextRegistry).Unregister(rs.ID)) // failed to unregister source
+	}
+
+	is.Equal(len(ctxRegistry.(ManageableContextRegistry).ListContextSources()), 0)       // expected no registered sources
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")), 0)      // unregistered sources should not be found
+	is.True(ctxRegistry.(ManageableContextRegistry).Unregister(registered[0].ID) != nil) // unregistering twice should fail
+}
+
+func TestThatRegisteringTheSameIDReplacesTheSource(t *testing.T) {
+	is := is.New(t)
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{}, "http://localhost", nil)
+	original := &remoteContextSource{id: "source1", registration: registration}
+
+	registration, _ = NewCsourceRegistration("RoadSegment", []string{}, "http://localhost", nil)
+	replacement := &remoteContextSource{id: "source1", registration: registration}
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(original)
+	ctxRegistry.Register(replacement)
+
+	is.Equal(len(ctxRegistry.(ManageableContextRegistry).ListContextSources()), 1)  // expected one registered source
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")), 0) // the original source should be gone
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("RoadSegment")), 1)     // expected the replacement source
+}
+
+func TestThatTheRegistryCanBeUsedConcurrently(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	query, _ := NewQuery().WithTypes("WeatherObserved").Build()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ctxRegistry.Register(newIndexedTestSource("WeatherObserved", fmt.Sprintf("attr%d", i)))
+			ctxRegistry.Register(newMockedContextSource("WeatherObserved", ""))
+
+			ctxRegistry.GetContextSourcesForQuery(query)
+			ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")
+
+			for _, rs := range ctxRegistry.(ManageableContextRegistry).ListContextSources() {
+				if _, ok := rs.Source.(*ContextSourceMock); ok {
+					ctxRegistry.(ManageableContextRegistry).Unregister(rs.ID)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 10) // expected only the remote sources to remain
+}
+
+func newIndexedTestSource(typeName, attributeName string) ContextSource {
+	registration, _ := NewCsourceRegistration(typeName, []string{attributeName}, "http://localhost", nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+	return contextSource
+}
@@ -1,14 +1,20 @@
 package ngsi
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
@@ -24,10 +30,16 @@ type CsourceRegistration interface {
 	ProvidesType(typeName string) bool
 }
 
-//NewRegisterContextSourceHandler handles POST requests for csource registrations
-func NewRegisterContextSourceHandler(ctxReg ContextRegistry) http.HandlerFunc {
+//NewRegisterContextSourceHandler handles POST requests for csource registrations. The options
+//are applied to every remote context source that is created from a registration.
+func NewRegisterContextSourceHandler(ctxReg ContextRegistry, options ...RemoteContextSourceOption) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, _ := ioutil.ReadAll(r.Body)
+		request, ok := newWriteRequestWrapper(w, r)
+		if !ok {
+			return
+		}
+
+		body, _ := ioutil.ReadAll(request.BodyReader())
 		reg, err := NewCsourceRegistrationFromJSON(body)
 
 		if err != nil {
@@ -38,147 +50,828 @@ func NewRegisterContextSourceHandler(ctxReg ContextRegistry) http.HandlerFunc {
 			return
 		}
 
-		remoteCtxSrc, _ := NewRemoteContextSource(reg)
+		// Keep other registrations from being made between the checks and the registration
+		lock := registrationLock(ctxReg)
+		lock.Lock()
+		defer lock.Unlock()
+
+		csr := reg.(*ctxSrcReg)
+		if csr.RegistrationID == "" {
+			csr.RegistrationID = newRegistrationID()
+		} else if _, ok := findRegisteredContextSource(ctxReg, csr.RegistrationID); ok {
+			errors.ReportNewAlreadyExists(
+				w,
+				"A registration with id "+csr.RegistrationID+" already exists.",
+			)
+			return
+		}
+
+		if conflict, ok := findConflictingRegistration(ctxReg, csr); ok {
+			errors.ReportNewAlreadyExists(
+				w,
+				"The registration conflicts with the exclusive registration "+conflict+".",
+			)
+			return
+		}
+
+		remoteCtxSrc, err := NewRemoteContextSource(reg, options...)
+		if err != nil {
+			errors.ReportNewInternalError(
+				w,
+				"Failed to create context source from registration: "+err.Error(),
+			)
+			return
+		}
 
 		ctxReg.Register(remoteCtxSrc)
 
 		jsonBytes, _ := json.Marshal(remoteCtxSrc)
 
-		w.WriteHeader(http.StatusCreated)
 		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+csr.RegistrationID)
+		w.WriteHeader(http.StatusCreated)
 		w.Write(jsonBytes)
 	})
 }
 
-type remoteResponse struct {
-	responseCode int
-	headers      http.Header
-	bytes        []byte
+//NewQueryContextSourceRegistrationsHandler handles GET requests for csource registrations. The
+//registrations can be filtered by the entity types, attributes and entity ids they provide, using
+//the type, attrs and id parameters, and by the idPattern that they are registered with.
+func NewQueryContextSourceRegistrationsHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		split := func(name string) []string {
+			if value := params.Get(name); value != "" {
+				return strings.Split(value, ",")
+			}
+			return nil
+		}
+
+		types := split("type")
+		attributes := split("attrs")
+		entityIDs := split("id")
+		idPattern := params.Get("idPattern")
+
+		registrations := []*ctxSrcReg{}
+
+		for _, rs := range listContextSources(ctxReg) {
+			rcs, ok := rs.Source.(*remoteContextSource)
+			if !ok {
+				continue
+			}
+
+			csr, ok := rcs.registration.(*ctxSrcReg)
+			if !ok {
+				continue
+			}
+
+			if matchesAny(types, csr.ProvidesType) &&
+				matchesAny(attributes, csr.ProvidesAttribute) &&
+				matchesAny(entityIDs, csr.ProvidesEntitiesWithMatchingID) &&
+				(idPattern == "" || csr.hasIDPattern(idPattern)) {
+				registrations = append(registrations, csr.withID(rcs.ID()))
+			}
+		}
+
+		bytes, err := json.Marshal(registrations)
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bytes)
+	})
+}
+
+//NewRetrieveContextSourceRegistrationHandler handles GET requests for a single csource registration
+func NewRetrieveContextSourceRegistrationHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcs, csr, ok := findRegistrationFromRequest(w, r, ctxReg)
+		if !ok {
+			return
+		}
+
+		bytes, err := json.Marshal(csr.withID(rcs.ID()))
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bytes)
+	})
+}
+
+//NewUpdateContextSourceRegistrationHandler handles PATCH requests for a single csource registration.
+//The members of the payload replace the corresponding members of the registration.
+func NewUpdateContextSourceRegistrationHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, ok := newWriteRequestWrapper(w, r)
+		if !ok {
+			return
+		}
+
+		lock := registrationLock(ctxReg)
+		lock.Lock()
+		defer lock.Unlock()
+
+		rcs, csr, ok := findRegistrationFromRequest(w, r, ctxReg)
+		if !ok {
+			return
+		}
+
+		fragment := map[string]json.RawMessage{}
+		body, _ := ioutil.ReadAll(request.BodyReader())
+		if err := json.Unmarshal(body, &fragment); err != nil {
+			errors.ReportNewBadRequestData(w, "Failed to parse registration fragment: "+err.Error())
+			return
+		}
+
+		if id, ok := fragment["id"]; ok {
+			var fragmentID string
+			if json.Unmarshal(id, &fragmentID) != nil || fragmentID != rcs.ID() {
+				errors.ReportNewBadRequestData(w, "The id of a registration can not be changed.")
+				return
+			}
+		}
+
+		merged := map[string]json.RawMessage{}
+		current, _ := json.Marshal(csr.withID(rcs.ID()))
+		json.Unmarshal(current, &merged)
+
+		for key, value := range fragment {
+			merged[key] = value
+		}
+
+		mergedBytes, _ := json.Marshal(merged)
+		updated, err := NewCsourceRegistrationFromJSON(mergedBytes)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, "Failed to update registration: "+err.Error())
+			return
+		}
+
+		if conflict, ok := findConflictingRegistration(ctxReg, updated.(*ctxSrcReg)); ok {
+			errors.ReportNewAlreadyExists(
+				w,
+				"The registration conflicts with the exclusive registration "+conflict+".",
+			)
+			return
+		}
+
+		// Keep the client and the configuration of the source that is replaced
+		ctxReg.Register(&remoteContextSource{
+			id:                 rcs.ID(),
+			registration:       updated,
+			client:             rcs.client,
+			entityTypesFromIDs: rcs.entityTypesFromIDs,
+		})
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//NewDeleteContextSourceRegistrationHandler handles DELETE requests for a single csource registration
+func NewDeleteContextSourceRegistrationHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep a concurrent update from registering the source again after it has been removed
+		lock := registrationLock(ctxReg)
+		lock.Lock()
+		defer lock.Unlock()
+
+		rcs, _, ok := findRegistrationFromRequest(w, r, ctxReg)
+		if !ok {
+			return
+		}
+
+		manageable, ok := ctxReg.(ManageableContextRegistry)
+		if !ok {
+			errors.ReportNewInternalError(w, "The context registry does not support removing registrations.")
+			return
+		}
+
+		if err := manageable.Unregister(rcs.ID()); err != nil {
+			errors.ReportNewResourceNotFound(w, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
 }
 
-func (rr *remoteResponse) Header() http.Header {
-	if rr.headers == nil {
-		rr.headers = make(http.Header)
+//findRegistrationFromRequest looks up the registration that is identified by the registrationId
+//path parameter. A problem is reported to the response writer if the registration can not be found.
+func findRegistrationFromRequest(w http.ResponseWriter, r *http.Request, ctxReg ContextRegistry) (*remoteContextSource, *ctxSrcReg, bool) {
+	params, found := findPathParams(w, r, "/csourceRegistrations/{registrationId}")
+	if !found {
+		return nil, nil, false
 	}
-	return rr.headers
+	registrationID := params[PathParamRegistrationID]
+
+	if source, ok := findRegisteredContextSource(ctxReg, registrationID); ok {
+		if rcs, ok := source.(*remoteContextSource); ok {
+			if csr, ok := rcs.registration.(*ctxSrcReg); ok {
+				return rcs, csr, true
+			}
+		}
+	}
+
+	errors.ReportNewResourceNotFound(w, "No registration with id "+registrationID+" exists.")
+	return nil, nil, false
 }
 
-func (rr *remoteResponse) MatchesContentType(contentType string) bool {
-	responseType := rr.Header()["Content-Type"][0]
-	return strings.HasPrefix(responseType, contentType)
+//registrationLock returns the lock that serializes the changes that the registration handlers make
+//to a registry, so that the checks for existing and conflicting registrations are not invalidated by
+//concurrent requests. Registries that do not hold such a lock get one that does not serialize anything.
+func registrationLock(ctxReg ContextRegistry) sync.Locker {
+	if lockable, ok := ctxReg.(LockableContextRegistry); ok {
+		return lockable.RegistrationLock()
+	}
+	return &sync.Mutex{}
 }
 
-func (rr *remoteResponse) Write(b []byte) (int, error) {
-	rr.bytes = append(rr.bytes, b...)
-	return len(b), nil
+//findConflictingRegistration returns the ID of a registered exclusive registration that covers
+//some of the same information as the supplied exclusive registration
+func findConflictingRegistration(ctxReg ContextRegistry, csr *ctxSrcReg) (string, bool) {
+	if csr.RegistrationMode() != ModeExclusive {
+		return "", false
+	}
+
+	for _, rs := range listContextSources(ctxReg) {
+		rcs, ok := rs.Source.(*remoteContextSource)
+		if !ok || rs.ID == csr.RegistrationID {
+			continue
+		}
+
+		other, ok := rcs.registration.(*ctxSrcReg)
+		if ok && other.RegistrationMode() == ModeExclusive && csr.overlaps(other) {
+			return rs.ID, true
+		}
+	}
+
+	return "", false
 }
 
-func (rr *remoteResponse) WriteHeader(responseCode int) {
-	rr.responseCode = responseCode
+//listContextSources lists the sources that are registered in a registry and have not expired, or
+//none if the registry is not able to list them
+func listContextSources(ctxReg ContextRegistry) []RegisteredContextSource {
+	registered := []RegisteredContextSource{}
+
+	if manageable, ok := ctxReg.(ManageableContextRegistry); ok {
+		now := time.Now()
+		for _, rs := range manageable.ListContextSources() {
+			if !hasExpired(rs.Source, now) {
+				registered = append(registered, rs)
+			}
+		}
+	}
+
+	return registered
 }
 
-//NewRemoteContextSource creates an instance of a ContextSource by wrapping a CsourceRegistration
-func NewRemoteContextSource(registration CsourceRegistration) (ContextSource, error) {
-	return &remoteContextSource{ID: uuid.New().String(), registration: registration}, nil
+func findRegisteredContextSource(ctxReg ContextRegistry, sourceID string) (ContextSource, bool) {
+	for _, rs := range listContextSources(ctxReg) {
+		if rs.ID == sourceID {
+			return rs.Source, true
+		}
+	}
+	return nil, false
+}
+
+func matchesAny(names []string, matches func(string) bool) bool {
+	if len(names) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+		if matches(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newRegistrationID() string {
+	return "urn:ngsi-ld:ContextSourceRegistration:" + uuid.New().String()
+}
+
+//NewRemoteContextSource creates an instance of a ContextSource by wrapping a CsourceRegistration.
+//The source gets the same ID as the registration, or a generated one if the registration has none.
+//The options may be used to configure how the source communicates with the remote endpoint.
+func NewRemoteContextSource(registration CsourceRegistration, options ...RemoteContextSourceOption) (ContextSource, error) {
+	id := newRegistrationID()
+	if csr, ok := registration.(*ctxSrcReg); ok && csr.RegistrationID != "" {
+		id = csr.RegistrationID
+	}
+
+	rcs := &remoteContextSource{
+		id:           id,
+		registration: registration,
+		client:       newRemoteClient(),
+	}
+
+	for _, option := range options {
+		option(rcs)
+	}
+
+	return rcs, nil
+}
+
+//WithEntityTypesFromIDs makes registrations that list an entity type, but neither an id nor an
+//idPattern, provide the entities whose IDs have the form urn:ngsi-ld:<Type>:<name>. Without it
+//such registrations are only used for requests that name the type of the entities.
+func WithEntityTypesFromIDs() RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.entityTypesFromIDs = true
+	}
 }
 
 type remoteContextSource struct {
-	ID           string `json:"id"`
+	id           string
 	registration CsourceRegistration
+	client       *remoteClient
+
+	entityTypesFromIDs bool
+}
+
+//ID returns the ID that the remote context source is registered with
+func (rcs *remoteContextSource) ID() string {
+	return rcs.id
+}
+
+//CircuitState returns the state of the circuit breaker of the source. Sources that were created
+//without the WithCircuitBreaker option, or without a client, are always reported as CircuitClosed.
+func (rcs *remoteContextSource) CircuitState() CircuitState {
+	if rcs.client == nil {
+		return CircuitClosed
+	}
+	return rcs.client.circuitState()
+}
+
+//Available returns false while the circuit of the source is open
+func (rcs *remoteContextSource) Available() bool {
+	return rcs.CircuitState() != CircuitOpen
+}
+
+//ExpiresAt returns the time when the registration of the source expires, if it does
+func (rcs *remoteContextSource) ExpiresAt() (time.Time, bool) {
+	if ecs, ok := rcs.registration.(ExpiringContextSource); ok {
+		return ecs.ExpiresAt()
+	}
+	return time.Time{}, false
+}
+
+//IntersectsGeoQuery returns false if the registration of the source has a location that
+//does not intersect with the area of the geo-query
+func (rcs *remoteContextSource) IntersectsGeoQuery(gq GeoQuery) bool {
+	if scoped, ok := rcs.registration.(GeoScopedContextSource); ok {
+		return scoped.IntersectsGeoQuery(gq)
+	}
+	return true
+}
+
+//RegistrationMode returns the mode of the registration of the source
+func (rcs *remoteContextSource) RegistrationMode() RegistrationMode {
+	if modal, ok := rcs.registration.(ModalContextSource); ok {
+		return modal.RegistrationMode()
+	}
+	return ModeInclusive
+}
+
+//ProvidedTypes returns the entity types that the registration of the source covers, or the
+//empty name for any type if the registration is not able to list them
+func (rcs *remoteContextSource) ProvidedTypes() []string {
+	if ics, ok := rcs.registration.(IndexableContextSource); ok {
+		return ics.ProvidedTypes()
+	}
+	return []string{""}
+}
+
+//ProvidedAttributes returns the attributes that the registration of the source covers, or the
+//empty name for any attribute if the registration is not able to list them
+func (rcs *remoteContextSource) ProvidedAttributes() []string {
+	if ics, ok := rcs.registration.(IndexableContextSource); ok {
+		return ics.ProvidedAttributes()
+	}
+	return []string{""}
+}
+
+func (rcs *remoteContextSource) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID string `json:"id"`
+	}{ID: rcs.id})
 }
 
 func (rcs *remoteContextSource) CreateEntity(typeName, entityID string, r Request) error {
+	return rcs.CreateEntityWithContext(r.Request().Context(), typeName, entityID, r)
+}
+
+func (rcs *remoteContextSource) CreateEntityWithContext(ctx context.Context, typeName, entityID string, r Request) error {
+	req := rcs.newOutboundRequest(ctx, r)
+
+	_, err := rcs.client.send(req)
+
+	if err != nil {
+		return fmt.Errorf("attempt to create %s entity failed: %w", typeName, err)
+	}
+
+	return nil
+}
+
+func (rcs *remoteContextSource) DeleteEntity(entityID string, r Request) error {
+	return rcs.DeleteEntityWithContext(r.Request().Context(), entityID, r)
+}
+
+func (rcs *remoteContextSource) DeleteEntityWithContext(ctx context.Context, entityID string, r Request) error {
+	req := rcs.newOutboundRequest(ctx, r)
+
+	_, err := rcs.client.send(req)
+
+	if err != nil {
+		return fmt.Errorf("failed to delete entity %s: %w", entityID, err)
+	}
+
+	return nil
+}
+
+func (rcs *remoteContextSource) GetEntities(query Query, callback QueryEntitiesCallback) error {
+	ctx := context.Background()
+	if query.Request() != nil {
+		ctx = query.Request().Context()
+	}
+
+	return rcs.GetEntitiesWithContext(ctx, query, callback)
+}
+
+func (rcs *remoteContextSource) GetEntitiesWithContext(ctx context.Context, query Query, callback QueryEntitiesCallback) error {
+	req := rcs.newQueryRequest(ctx, query, query.PaginationOffset(), query.PaginationLimit(), false)
+
+	response, err := rcs.client.send(req)
+	if err != nil {
+		return err
+	}
+
+	// If the response code is 200 we can just unmarshal the payload
+	// and pass the individual entities to the supplied callback.
+	// We need to check of the payload is GeoJSON or not though.
+	if response.responseCode == http.StatusOK {
+
+		if response.MatchesContentType(geojson.ContentType) {
+			err = geojson.UnpackGeoJSONToCallback(response.bytes, func(f geojson.GeoJSONFeature) error {
+				return callback(f)
+			})
+		} else {
+			var unmarshaledResponse []interface{}
+			err = json.Unmarshal(response.bytes, &unmarshaledResponse)
+			if err == nil {
+				for _, e := range unmarshaledResponse {
+					callback(e)
+				}
+			}
+		}
+	}
+
+	return err
+}
+
+//NeedsQueryFiltering returns true, since a remote context source may ignore parts of a query
+func (rcs *remoteContextSource) NeedsQueryFiltering() bool {
+	return true
+}
+
+//CountEntities asks the remote context source for the number of entities that match the query,
+//without having it return any of the entities themselves
+func (rcs *remoteContextSource) CountEntities(ctx context.Context, query Query) (uint64, error) {
+	req := rcs.newQueryRequest(ctx, query, 0, 0, true)
+
+	response, err := rcs.client.send(req)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.responseCode != http.StatusOK {
+		return 0, fmt.Errorf("remote context source returned status code %d", response.responseCode)
+	}
+
+	count, err := strconv.ParseUint(response.Header().Get(ResultsCountHeader), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("remote context source returned an invalid %s header: %s", ResultsCountHeader, err.Error())
+	}
+
+	return count, nil
+}
+
+//newQueryRequest creates a request for the entities that match a query, to be sent to the remote
+//context source. The pagination parameters are replaced so that the remote source returns the window
+//of entities that we are after, rather than the one requested by our own client.
+func (rcs *remoteContextSource) newQueryRequest(ctx context.Context, query Query, offset, limit uint64, count bool) *http.Request {
+	u, _ := url.Parse(rcs.registration.Endpoint())
+
+	params := queryParameters(query)
+	params.Set("offset", strconv.FormatUint(offset, 10))
+	params.Set("limit", strconv.FormatUint(limit, 10))
+	if count {
+		params.Set("count", "true")
+	} else {
+		params.Del("count")
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ngsiLDBasePath+"/entities", nil)
+
+	if incoming := query.Request(); incoming != nil {
+		// Keep the parameters that the query does not know about, such as options=keyValues,
+		// and the headers that our own client sent
+		for name, values := range unmodelledQueryParameters(incoming) {
+			params[name] = values
+		}
+		req.Header = incoming.Header.Clone()
+	} else {
+		req.Header.Set("Accept", "application/ld+json")
+	}
+
+	req.URL.RawQuery = params.Encode()
+	prepareOutboundRequest(u, query.Request(), req)
+
+	return req
+}
+
+//newOutboundRequest creates a copy of an incoming request, with its own URL, headers and body,
+//that is prepared to be sent to the remote context source. The incoming request itself is never
+//modified, so that it can be forwarded to several context sources.
+func (rcs *remoteContextSource) newOutboundRequest(ctx context.Context, r Request) *http.Request {
 	u, _ := url.Parse(rcs.registration.Endpoint())
-	req := r.Request()
+	incoming := r.Request()
+
+	body, _ := ioutil.ReadAll(r.BodyReader())
+
+	req := incoming.Clone(ctx)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Del("Content-Length")
+
+	prepareOutboundRequest(u, incoming, req)
 
+	return req
+}
+
+//ngsiLDBasePath is the path that remote context sources are expected to serve the NGSI-LD API
+//under, relative to their endpoint
+const ngsiLDBasePath = "/ngsi-ld/v1"
+
+//ngsiLDResources are the first segments of the API paths that are forwarded to remote sources
+var ngsiLDResources = []string{"entities", "entityOperations", "csourceRegistrations"}
+
+//ngsiLDPath replaces whatever base path an incoming request was mounted under with the standard
+//NGSI-LD base path, so that /api/entities/x is forwarded as /ngsi-ld/v1/entities/x. Paths that
+//do not contain any of the API resources are returned as they are.
+func ngsiLDPath(path string) string {
+	resourceIdx := -1
+
+	for _, resource := range ngsiLDResources {
+		idx := strings.Index(path+"/", "/"+resource+"/")
+		if idx != -1 && (resourceIdx == -1 || idx < resourceIdx) {
+			resourceIdx = idx
+		}
+	}
+
+	if resourceIdx == -1 {
+		return path
+	}
+
+	return ngsiLDBasePath + path[resourceIdx:]
+}
+
+//hopByHopHeaders are only meaningful for a single connection and must not be forwarded
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+//prepareOutboundRequest points an outbound request at a remote context source, by prefixing
+//its NGSI-LD path with the path of the endpoint, and sets the headers that should be used when
+//a request is forwarded to it
+func prepareOutboundRequest(u *url.URL, incoming, req *http.Request) {
 	req.URL.Host = u.Host
 	req.URL.Scheme = u.Scheme
+	// Keep the encoding of the path, so that encoded slashes in entity ids are forwarded as they are
+	rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + ngsiLDPath(req.URL.EscapedPath())
+	req.URL.Path = strings.TrimSuffix(u.Path, "/") + ngsiLDPath(req.URL.Path)
+	req.URL.RawPath = rawPath
+	req.Host = u.Host
+	req.RequestURI = ""
 
-	forwardedHost := req.Header.Get("Host")
-	if forwardedHost != "" {
-		req.Header.Set("X-Forwarded-Host", forwardedHost)
+	for _, h := range hopByHopHeaders {
+		req.Header.Del(h)
+	}
+
+	if incoming != nil && incoming.Host != "" {
+		req.Header.Set("X-Forwarded-Host", incoming.Host)
 	}
-	req.Host = u.Host
 
 	// Change the User-Agent header to something more appropriate
-	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
+	req.Header.Set("User-Agent", "ngsi-context-broker/0.1")
+
+	// Plain JSON is created from JSON-LD, so that we learn the @context of the remote entities
+	if contentType, ok := negotiateContentType(req, entityContentTypes); ok && contentType == ContentTypeJSON {
+		req.Header.Set("Accept", ContentTypeJSONLD)
+	}
+
+	// We do not want to propagate the Accept-Encoding header to prevent compression
+	req.Header.Del("Accept-Encoding")
+}
+
+func (rcs *remoteContextSource) AppendEntityAttributes(entityID string, noOverwrite bool, r Request) error {
+	return rcs.AppendEntityAttributesWithContext(r.Request().Context(), entityID, noOverwrite, r)
+}
+
+func (rcs *remoteContextSource) AppendEntityAttributesWithContext(ctx context.Context, entityID string, noOverwrite bool, r Request) error {
+	req := rcs.newOutboundRequest(ctx, r)
+	req.URL.RawQuery = withNoOverwriteOption(req.URL.Query(), noOverwrite).Encode()
+
+	_, err := rcs.client.send(req)
+
+	if err != nil {
+		return fmt.Errorf("failed to append attributes to entity %s: %w", entityID, err)
+	}
+
+	return nil
+}
+
+func (rcs *remoteContextSource) DeleteEntityAttribute(entityID, attributeName string, r Request) error {
+	return rcs.DeleteEntityAttributeWithContext(r.Request().Context(), entityID, attributeName, r)
+}
+
+func (rcs *remoteContextSource) DeleteEntityAttributeWithContext(ctx context.Context, entityID, attributeName string, r Request) error {
+	req := rcs.newOutboundRequest(ctx, r)
+
+	_, err := rcs.client.send(req)
+
+	if err != nil {
+		return fmt.Errorf("failed to delete attribute %s from entity %s: %w", attributeName, entityID, err)
+	}
+
+	return nil
+}
+
+func (rcs *remoteContextSource) UpdateEntityAttributes(entityID string, r Request) error {
+	return rcs.UpdateEntityAttributesWithContext(r.Request().Context(), entityID, r)
+}
+
+func (rcs *remoteContextSource) UpdateEntityAttributesWithContext(ctx context.Context, entityID string, r Request) error {
+	req := rcs.newOutboundRequest(ctx, r)
+
+	response, err := rcs.client.send(req)
+
+	if err != nil {
+		return fmt.Errorf("failed to patch entity %s: %w", entityID, err)
+	}
+
+	if response.responseCode == http.StatusMultiStatus {
+		// Some of the attributes were not updated, and the response tells which
+		result := NewUpdateResult()
+		err = json.Unmarshal(response.bytes, result)
+		if err != nil {
+			return fmt.Errorf("failed to decode update result for entity %s: %s", entityID, err.Error())
+		}
+
+		if len(result.NotUpdated) > 0 {
+			return fmt.Errorf("failed to patch entity %s: %w", entityID, &PartialUpdateError{Result: result})
+		}
+	}
+
+	return nil
+}
+
+func (rcs *remoteContextSource) CreateEntities(ctx context.Context, entities []BatchEntity, r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(ctx, BatchOperationCreate, entities, false, r)
+}
+
+func (rcs *remoteContextSource) UpsertEntities(ctx context.Context, entities []BatchEntity, r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(ctx, BatchOperationUpsert, entities, false, r)
+}
+
+func (rcs *remoteContextSource) UpdateEntities(ctx context.Context, entities []BatchEntity, noOverwrite bool, r Request) (*BatchOperationResult, error) {
+	return rcs.forwardBatchOperation(ctx, BatchOperationUpdate, entities, noOverwrite, r)
+}
+
+func (rcs *remoteContextSource) DeleteEntities(ctx context.Context, entityIDs []string, r Request) (*BatchOperationResult, error) {
+	entities := []BatchEntity{}
+	for _, id := range entityIDs {
+		entities = append(entities, BatchEntity{ID: id})
+	}
+	return rcs.forwardBatchOperation(ctx, BatchOperationDelete, entities, false, r)
+}
 
-	response, err := proxyToRemote(u, req)
+//forwardBatchOperation sends the subset of a batch that this source should handle as a
+//single request to the remote endpoint, instead of proxying the incoming request. The
+//noOverwrite option is only meaningful for batch updates.
+func (rcs *remoteContextSource) forwardBatchOperation(ctx context.Context, operation string, entities []BatchEntity, noOverwrite bool, r Request) (*BatchOperationResult, error) {
+	u, _ := url.Parse(rcs.registration.Endpoint())
+
+	var body []byte
+	var err error
+
+	if operation == BatchOperationDelete {
+		entityIDs := []string{}
+		for _, e := range entities {
+			entityIDs = append(entityIDs, e.ID)
+		}
+		body, err = json.Marshal(entityIDs)
+	} else {
+		payloads := []json.RawMessage{}
+		for _, e := range entities {
+			payloads = append(payloads, e.Body)
+		}
+		body, err = json.Marshal(payloads)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode batch %s payload: %s", operation, err.Error())
+	}
 
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ngsiLDBasePath+"/entityOperations/"+operation, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("attempt to create %s entity failed with status code %d: %s", typeName, response.responseCode, err.Error())
+		return nil, err
 	}
 
-	return err
-}
-
-func (rcs *remoteContextSource) GetEntities(query Query, callback QueryEntitiesCallback) error {
-	u, _ := url.Parse(rcs.registration.Endpoint())
-	req := query.Request()
-
-	req.URL.Host = u.Host
-	req.URL.Scheme = u.Scheme
+	incoming := r.Request()
+	if incoming != nil {
+		req.URL.RawQuery = incoming.URL.RawQuery
+		req.Header = incoming.Header.Clone()
+		req.Header.Del("Content-Length")
+	}
 
-	forwardedHost := req.Header.Get("Host")
-	if forwardedHost != "" {
-		req.Header.Set("X-Forwarded-Host", forwardedHost)
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/ld+json")
 	}
-	req.Host = u.Host
 
-	// Change the User-Agent header to something more appropriate
-	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
+	if operation == BatchOperationUpdate {
+		req.URL.RawQuery = withNoOverwriteOption(req.URL.Query(), noOverwrite).Encode()
+	}
 
-	// We do not want to propagate the Accept-Encoding header to prevent compression
-	req.Header.Del("Accept-Encoding")
+	prepareOutboundRequest(u, incoming, req)
 
-	response, err := proxyToRemote(u, req)
+	response, err := rcs.client.send(req)
+	if err != nil {
+		return nil, fmt.Errorf("batch %s failed: %w", operation, err)
+	}
 
-	// If the response code is 200 we can just unmarshal the payload
-	// and pass the individual entities to the supplied callback.
-	// We need to check of the payload is GeoJSON or not though.
-	if response.responseCode == http.StatusOK {
+	result := NewBatchOperationResult()
 
-		if response.MatchesContentType(geojson.ContentType) {
-			err = geojson.UnpackGeoJSONToCallback(response.bytes, func(f geojson.GeoJSONFeature) error {
-				return callback(f)
-			})
-		} else {
-			var unmarshaledResponse []interface{}
-			err = json.Unmarshal(response.bytes, &unmarshaledResponse)
-			if err == nil {
-				for _, e := range unmarshaledResponse {
-					callback(e)
-				}
+	switch response.responseCode {
+	case http.StatusCreated:
+		if operation == BatchOperationUpsert {
+			// An upsert only lists the entities that it created, but it has replaced the others
+			err = json.Unmarshal(response.bytes, &result.Created)
+			for _, e := range entities {
+				result.Success = append(result.Success, e.ID)
 			}
+		} else {
+			err = json.Unmarshal(response.bytes, &result.Success)
+		}
+	case http.StatusMultiStatus:
+		err = json.Unmarshal(response.bytes, result)
+	case http.StatusNoContent, http.StatusOK:
+		for _, e := range entities {
+			result.Success = append(result.Success, e.ID)
 		}
+	default:
+		err = fmt.Errorf("unexpected response code %d", response.responseCode)
 	}
 
-	return err
-}
-
-func (rcs *remoteContextSource) UpdateEntityAttributes(entityID string, r Request) error {
-	u, _ := url.Parse(rcs.registration.Endpoint())
-	req := r.Request()
+	if err != nil {
+		return nil, fmt.Errorf("failed to handle response to batch %s: %s", operation, err.Error())
+	}
 
-	req.URL.Host = u.Host
-	req.URL.Scheme = u.Scheme
+	return result, nil
+}
 
-	forwardedHost := req.Header.Get("Host")
-	if forwardedHost != "" {
-		req.Header.Set("X-Forwarded-Host", forwardedHost)
+//withNoOverwriteOption sets or removes noOverwrite among the options in a set of query parameters,
+//keeping any other options as they are
+func withNoOverwriteOption(params url.Values, noOverwrite bool) url.Values {
+	options := []string{}
+	for _, option := range strings.Split(params.Get("options"), ",") {
+		if option != "" && option != "noOverwrite" {
+			options = append(options, option)
+		}
 	}
-	req.Host = u.Host
-
-	// Change the User-Agent header to something more appropriate
-	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
 
-	_, err := proxyToRemote(u, req)
+	if noOverwrite {
+		options = append(options, "noOverwrite")
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to patch entity %s: %s", entityID, err.Error())
+	if len(options) > 0 {
+		params.Set("options", strings.Join(options, ","))
+	} else {
+		params.Del("options")
 	}
 
-	return nil
+	return params
 }
 
 func (rcs *remoteContextSource) ProvidesAttribute(attributeName string) bool {
@@ -186,14 +879,39 @@ func (rcs *remoteContextSource) ProvidesAttribute(attributeName string) bool {
 }
 
 func (rcs *remoteContextSource) ProvidesEntitiesWithMatchingID(entityID string) bool {
-	return rcs.registration.ProvidesEntitiesWithMatchingID(entityID)
+	if rcs.registration.ProvidesEntitiesWithMatchingID(entityID) {
+		return true
+	}
+
+	_, ok := rcs.typeFromID(entityID)
+	return ok
 }
 
 func (rcs *remoteContextSource) GetProvidedTypeFromID(entityID string) (string, error) {
-	if !rcs.registration.ProvidesEntitiesWithMatchingID(entityID) {
-		return "", fmt.Errorf("provided id not supported by this context source")
+	if rcs.registration.ProvidesEntitiesWithMatchingID(entityID) {
+		return rcs.registration.GetProvidedTypeFromID(entityID)
+	}
+
+	if typeName, ok := rcs.typeFromID(entityID); ok {
+		return typeName, nil
+	}
+
+	return "", fmt.Errorf("provided id not supported by this context source")
+}
+
+//typeFromID returns the type of an entity, taken from its ID, if the source has been configured
+//WithEntityTypesFromIDs and its registration provides entities of that type without an id or idPattern
+func (rcs *remoteContextSource) typeFromID(entityID string) (string, bool) {
+	if !rcs.entityTypesFromIDs {
+		return "", false
+	}
+
+	csr, ok := rcs.registration.(*ctxSrcReg)
+	if !ok {
+		return "", false
 	}
-	return rcs.registration.GetProvidedTypeFromID(entityID)
+
+	return csr.typeFromID(entityID)
 }
 
 func (rcs *remoteContextSource) ProvidesType(typeName string) bool {
@@ -201,27 +919,16 @@ func (rcs *remoteContextSource) ProvidesType(typeName string) bool {
 }
 
 func (rcs *remoteContextSource) RetrieveEntity(entityID string, r Request) (Entity, error) {
-	u, _ := url.Parse(rcs.registration.Endpoint())
-	req := r.Request()
-
-	req.URL.Host = u.Host
-	req.URL.Scheme = u.Scheme
-
-	forwardedHost := req.Header.Get("Host")
-	if forwardedHost != "" {
-		req.Header.Set("X-Forwarded-Host", forwardedHost)
-	}
-	req.Host = u.Host
+	return rcs.RetrieveEntityWithContext(r.Request().Context(), entityID, r)
+}
 
-	// Change the User-Agent header to something more appropriate
-	req.Header.Add("User-Agent", "ngsi-context-broker/0.1")
-	// We do not want to propagate the Accept-Encoding header to prevent compression
-	req.Header.Del("Accept-Encoding")
+func (rcs *remoteContextSource) RetrieveEntityWithContext(ctx context.Context, entityID string, r Request) (Entity, error) {
+	req := rcs.newOutboundRequest(ctx, r)
 
-	response, err := proxyToRemote(u, req)
+	response, err := rcs.client.send(req)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve entity %s: %s", entityID, err.Error())
+		return nil, fmt.Errorf("failed to retrieve entity %s: %w", entityID, err)
 	}
 
 	if response.responseCode == http.StatusOK {
@@ -251,38 +958,119 @@ func (rcs *remoteContextSource) RetrieveEntity(entityID string, r Request) (Enti
 	return nil, fmt.Errorf("unexpected response code from retrieve entity %s: %d != 200", entityID, response.responseCode)
 }
 
-func proxyToRemote(u *url.URL, req *http.Request) (remoteResponse, error) {
-	response := remoteResponse{}
-	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.ServeHTTP(&response, req)
+type ctxSrcReg struct {
+	Context             interface{}     `json:"@context,omitempty"`
+	RegistrationID      string          `json:"id,omitempty"`
+	Type                string          `json:"type"`
+	RegistrationName    string          `json:"registrationName,omitempty"`
+	Description         string          `json:"description,omitempty"`
+	Information         []ctxSrcRegInfo `json:"information"`
+	ObservationInterval *timeInterval   `json:"observationInterval,omitempty"`
+	ManagementInterval  *timeInterval   `json:"managementInterval,omitempty"`
+	Expires             string          `json:"expiresAt,omitempty"`
+	Location            interface{}     `json:"location,omitempty"`
+	Mode                string          `json:"mode,omitempty"`
+	area                *boundingBox
+	Endpt               string `json:"endpoint"`
+}
 
-	var err error
+func (csr *ctxSrcReg) Endpoint() string {
+	return csr.Endpt
+}
 
-	if response.responseCode >= http.StatusBadRequest {
-		if len(response.bytes) > 0 {
-			err = fmt.Errorf("%s", string(response.bytes))
-		} else {
-			err = fmt.Errorf("received %d response with empty body", response.responseCode)
+//ExpiresAt returns the time when the registration expires, if it has an expiry time
+func (csr *ctxSrcReg) ExpiresAt() (time.Time, bool) {
+	if csr.Expires == "" {
+		return time.Time{}, false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, csr.Expires)
+	return expiresAt, err == nil
+}
+
+//IntersectsGeoQuery returns false if the registration has a location that is known to be outside
+//of the area of the geo-query. The comparison is made against the bounding box of the location.
+func (csr *ctxSrcReg) IntersectsGeoQuery(gq GeoQuery) bool {
+	if csr.area == nil {
+		return true
+	}
+
+	switch gq.GeoRel {
+	case GeoSpatialRelationNearPoint:
+		lon, lat, err := gq.Point()
+		if err != nil {
+			return true
+		}
+		maxDistance, _ := gq.Distance()
+		nearestLon, nearestLat := csr.area.nearestPosition(lon, lat)
+		return haversineDistance(lon, lat, nearestLon, nearestLat) <= float64(maxDistance)
+	case GeoSpatialRelationWithinRect:
+		lon0, lat0, lon1, lat1, err := gq.Rectangle()
+		if err != nil {
+			return true
 		}
+		return csr.area.intersects(newBoundingBox([][2]float64{{lon0, lat0}, {lon1, lat1}}))
 	}
 
-	return response, err
+	return true
 }
 
-type ctxSrcReg struct {
-	Type        string          `json:"type"`
-	Information []ctxSrcRegInfo `json:"information"`
-	Endpt       string          `json:"endpoint"`
+//RegistrationMode returns the mode of the registration, which is ModeInclusive unless another mode is specified
+func (csr *ctxSrcReg) RegistrationMode() RegistrationMode {
+	if csr.Mode == "" {
+		return ModeInclusive
+	}
+	return RegistrationMode(csr.Mode)
 }
 
-func (csr *ctxSrcReg) Endpoint() string {
-	return csr.Endpt
+//overlaps returns true if the registrations may cover the same attributes of the same entities.
+//Entities that are matched by id patterns are assumed to overlap with all entities of the same type.
+func (csr *ctxSrcReg) overlaps(other *ctxSrcReg) bool {
+	for _, info := range csr.Information {
+		for _, otherInfo := range other.Information {
+			if info.entitiesOverlap(&otherInfo) && info.attributesOverlap(&otherInfo) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//withID returns a copy of the registration with the supplied ID
+func (csr *ctxSrcReg) withID(id string) *ctxSrcReg {
+	clone := *csr
+	clone.RegistrationID = id
+	return &clone
+}
+
+func (csr *ctxSrcReg) hasIDPattern(idPattern string) bool {
+	for _, reginfo := range csr.Information {
+		for _, entity := range reginfo.Entities {
+			if entity.IDPattern != nil && *entity.IDPattern == idPattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//typeFromID returns the registered type of entities that are registered without an id or idPattern,
+//if the entity ID has the form urn:ngsi-ld:<Type>:<name> for that type
+func (csr *ctxSrcReg) typeFromID(entityID string) (string, bool) {
+	for _, reginfo := range csr.Information {
+		for _, entity := range reginfo.Entities {
+			if entity.ID == nil && entity.IDPattern == nil && strings.HasPrefix(entityID, "urn:ngsi-ld:"+entity.Type+":") {
+				return entity.Type, true
+			}
+		}
+	}
+	return "", false
 }
 
 func (csr *ctxSrcReg) GetProvidedTypeFromID(entityID string) (string, error) {
 	for _, reginfo := range csr.Information {
 		for _, entity := range reginfo.Entities {
-			if entity.regexpForID != nil && entity.regexpForID.MatchString(entityID) {
+			if entity.matchesID(entityID) {
 				return entity.Type, nil
 			}
 		}
@@ -290,9 +1078,42 @@ func (csr *ctxSrcReg) GetProvidedTypeFromID(entityID string) (string, error) {
 	return "", fmt.Errorf("provided ID %s not handled by this context source registration", entityID)
 }
 
+//ProvidedAttributes returns the names of all the attributes that the registration covers. An
+//empty name is included when some part of the registration covers attributes of any name.
+func (csr *ctxSrcReg) ProvidedAttributes() []string {
+	attributes := []string{}
+	for _, reginfo := range csr.Information {
+		if !reginfo.restrictsAttributes() {
+			attributes = append(attributes, "")
+		}
+		attributes = append(attributes, reginfo.attributeNames()...)
+	}
+	return attributes
+}
+
+//ProvidedTypes returns the names of all the entity types that the registration covers. An
+//empty name is included when some part of the registration covers entities of any type.
+func (csr *ctxSrcReg) ProvidedTypes() []string {
+	types := []string{}
+	for _, reginfo := range csr.Information {
+		if len(reginfo.Entities) == 0 {
+			types = append(types, "")
+		}
+		for _, entity := range reginfo.Entities {
+			types = append(types, entity.Type)
+		}
+	}
+	return types
+}
+
+//ProvidesAttribute returns true if the registration covers the attribute, either by listing it
+//in propertyNames, relationshipNames or the legacy properties, or by not restricting attributes
 func (csr *ctxSrcReg) ProvidesAttribute(attributeName string) bool {
 	for _, reginfo := range csr.Information {
-		for _, attr := range reginfo.Properties {
+		if !reginfo.restrictsAttributes() {
+			return true
+		}
+		for _, attr := range reginfo.attributeNames() {
 			if attr == attributeName {
 				return true
 			}
@@ -301,10 +1122,12 @@ func (csr *ctxSrcReg) ProvidesAttribute(attributeName string) bool {
 	return false
 }
 
+//ProvidesEntitiesWithMatchingID returns true if any of the registered entities matches the
+//entity ID. Information without any entities is not used to route requests for single entities.
 func (csr *ctxSrcReg) ProvidesEntitiesWithMatchingID(entityID string) bool {
 	for _, reginfo := range csr.Information {
 		for _, entity := range reginfo.Entities {
-			if entity.regexpForID != nil && entity.regexpForID.MatchString(entityID) {
+			if entity.matchesID(entityID) {
 				return true
 			}
 		}
@@ -312,8 +1135,13 @@ func (csr *ctxSrcReg) ProvidesEntitiesWithMatchingID(entityID string) bool {
 	return false
 }
 
+//ProvidesType returns true if the registration covers entities of the type, either by listing
+//it among its entities or by having information that is not restricted to any entities
 func (csr *ctxSrcReg) ProvidesType(typeName string) bool {
 	for _, reginfo := range csr.Information {
+		if len(reginfo.Entities) == 0 {
+			return true
+		}
 		for _, entity := range reginfo.Entities {
 			if entity.Type == typeName {
 				return true
@@ -324,6 +1152,7 @@ func (csr *ctxSrcReg) ProvidesType(typeName string) bool {
 }
 
 type entityInfo struct {
+	ID          *string `json:"id,omitempty"`
 	IDPattern   *string `json:"idPattern,omitempty"`
 	regexpForID *regexp.Regexp
 
@@ -331,8 +1160,78 @@ type entityInfo struct {
 }
 
 type ctxSrcRegInfo struct {
-	Entities   []entityInfo `json:"entities"`
-	Properties []string     `json:"properties"`
+	Entities          []entityInfo `json:"entities"`
+	PropertyNames     []string     `json:"propertyNames,omitempty"`
+	RelationshipNames []string     `json:"relationshipNames,omitempty"`
+
+	// Properties is kept for compatibility with registrations made before propertyNames
+	// and relationshipNames were supported
+	Properties []string `json:"properties,omitempty"`
+}
+
+//attributeNames returns the names of all the properties and relationships in the information
+func (info *ctxSrcRegInfo) attributeNames() []string {
+	names := append([]string{}, info.PropertyNames...)
+	names = append(names, info.RelationshipNames...)
+	return append(names, info.Properties...)
+}
+
+func (info *ctxSrcRegInfo) entitiesOverlap(other *ctxSrcRegInfo) bool {
+	if len(info.Entities) == 0 || len(other.Entities) == 0 {
+		return true
+	}
+
+	for _, e := range info.Entities {
+		for _, o := range other.Entities {
+			if e.Type == o.Type && (e.ID == nil || o.ID == nil || *e.ID == *o.ID) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (info *ctxSrcRegInfo) attributesOverlap(other *ctxSrcRegInfo) bool {
+	if !info.restrictsAttributes() || !other.restrictsAttributes() {
+		return true
+	}
+
+	names := map[string]bool{}
+	for _, name := range info.attributeNames() {
+		names[name] = true
+	}
+
+	for _, name := range other.attributeNames() {
+		if names[name] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (info *ctxSrcRegInfo) restrictsAttributes() bool {
+	return len(info.PropertyNames) > 0 || len(info.RelationshipNames) > 0 || len(info.Properties) > 0
+}
+
+//matchesID returns true if the entity ID is the registered id or matches the registered idPattern.
+//Entities that are only registered with a type do not match any IDs.
+func (e *entityInfo) matchesID(entityID string) bool {
+	if e.ID != nil {
+		return *e.ID == entityID
+	}
+
+	if e.regexpForID != nil {
+		return e.regexpForID.MatchString(entityID)
+	}
+
+	return false
+}
+
+type timeInterval struct {
+	StartAt string `json:"startAt"`
+	EndAt   string `json:"endAt,omitempty"`
 }
 
 //NewCsourceRegistration creates and returns a concrete implementation of the CsourceRegistration interface
@@ -354,31 +1253,223 @@ func NewCsourceRegistration(entityTypeName string, attributeNames []string, endp
 	return reg, nil
 }
 
-//NewCsourceRegistrationFromJSON unpacks a byte buffer into a CsourceRegistration and validates its contents
+//NewCsourceRegistrationFromJSON unpacks a byte buffer into a CsourceRegistration and validates the members
+//of the NGSI-LD ContextSourceRegistration data type that are used to route requests. Other members are
+//accepted but ignored.
 func NewCsourceRegistrationFromJSON(jsonBytes []byte) (CsourceRegistration, error) {
 	registration := &ctxSrcReg{}
+
+	// Members that we do not use, such as operations or tenant, are accepted and ignored
 	err := json.Unmarshal(jsonBytes, registration)
+	if err != nil {
+		return nil, fmt.Errorf("malformed registration: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
 
+	err = registration.validate(time.Now())
 	if err != nil {
 		return nil, err
 	}
 
-	for infoIdx := range registration.Information {
-		info := &registration.Information[infoIdx]
+	return registration, nil
+}
+
+//validate checks that the registration is complete and consistent, and compiles the
+//id patterns of its entities
+func (csr *ctxSrcReg) validate(now time.Time) error {
+	if csr.Type != "ContextSourceRegistration" {
+		return fmt.Errorf("type must be \"ContextSourceRegistration\", not \"%s\"", csr.Type)
+	}
+
+	if csr.RegistrationID != "" && !isAbsoluteURI(csr.RegistrationID) {
+		return fmt.Errorf("id %s is not a valid URI", csr.RegistrationID)
+	}
 
-		for entityIdx := range info.Entities {
-			entity := &info.Entities[entityIdx]
+	if csr.Endpt == "" {
+		return fmt.Errorf("endpoint is required")
+	}
 
-			if entity.IDPattern != nil {
-				entity.regexpForID, err = regexp.CompilePOSIX(*entity.IDPattern)
-				if err != nil {
-					return nil, err
-				}
+	endpoint, err := url.Parse(csr.Endpt)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("endpoint %s is not an absolute http or https URL", csr.Endpt)
+	}
+
+	switch RegistrationMode(csr.Mode) {
+	case "", ModeInclusive, ModeExclusive, ModeRedirect, ModeAuxiliary:
+	default:
+		return fmt.Errorf("mode must be one of inclusive, exclusive, redirect or auxiliary, not %s", csr.Mode)
+	}
+
+	if len(csr.Information) == 0 {
+		return fmt.Errorf("information must contain at least one item")
+	}
+
+	for infoIdx := range csr.Information {
+		err = csr.Information[infoIdx].validate()
+		if err != nil {
+			return fmt.Errorf("information[%d]: %s", infoIdx, err.Error())
+		}
+	}
+
+	if csr.ObservationInterval != nil {
+		if err = csr.ObservationInterval.validate(); err != nil {
+			return fmt.Errorf("observationInterval: %s", err.Error())
+		}
+	}
+
+	if csr.ManagementInterval != nil {
+		if err = csr.ManagementInterval.validate(); err != nil {
+			return fmt.Errorf("managementInterval: %s", err.Error())
+		}
+	}
+
+	if csr.Location != nil {
+		csr.area, err = registrationArea(csr.Location)
+		if err != nil {
+			return fmt.Errorf("location: %s", err.Error())
+		}
+	}
+
+	if csr.Expires != "" {
+		expiresAt, err := time.Parse(time.RFC3339, csr.Expires)
+		if err != nil {
+			return fmt.Errorf("expiresAt %s is not a valid RFC3339 timestamp", csr.Expires)
+		}
+		if !expiresAt.After(now) {
+			return fmt.Errorf("expiresAt %s is not in the future", csr.Expires)
+		}
+	}
+
+	return nil
+}
+
+func (info *ctxSrcRegInfo) validate() error {
+	if len(info.Entities) == 0 && len(info.PropertyNames) == 0 &&
+		len(info.RelationshipNames) == 0 && len(info.Properties) == 0 {
+		return fmt.Errorf("at least one of entities, propertyNames or relationshipNames is required")
+	}
+
+	for entityIdx := range info.Entities {
+		entity := &info.Entities[entityIdx]
+
+		if entity.Type == "" {
+			return fmt.Errorf("entities[%d]: type is required", entityIdx)
+		}
+
+		if entity.ID != nil && entity.IDPattern != nil {
+			return fmt.Errorf("entities[%d]: id and idPattern can not both be specified", entityIdx)
+		}
+
+		if entity.ID != nil && !isAbsoluteURI(*entity.ID) {
+			return fmt.Errorf("entities[%d]: id %s is not a valid URI", entityIdx, *entity.ID)
+		}
+
+		if entity.IDPattern != nil {
+			var err error
+			entity.regexpForID, err = regexp.CompilePOSIX(*entity.IDPattern)
+			if err != nil {
+				return fmt.Errorf("entities[%d]: idPattern %s is not a valid regular expression: %s", entityIdx, *entity.IDPattern, err.Error())
 			}
 		}
 	}
 
-	// TODO: More validation ...
+	propertyNames := map[string]bool{}
+	for _, name := range info.PropertyNames {
+		if name == "" {
+			return fmt.Errorf("propertyNames can not contain empty names")
+		}
+		propertyNames[name] = true
+	}
 
-	return registration, nil
+	for _, name := range info.RelationshipNames {
+		if name == "" {
+			return fmt.Errorf("relationshipNames can not contain empty names")
+		}
+		if propertyNames[name] {
+			return fmt.Errorf("%s can not be both a property and a relationship", name)
+		}
+	}
+
+	return nil
+}
+
+func (ti *timeInterval) validate() error {
+	startAt, err := time.Parse(time.RFC3339, ti.StartAt)
+	if err != nil {
+		return fmt.Errorf("startAt %s is not a valid RFC3339 timestamp", ti.StartAt)
+	}
+
+	if ti.EndAt != "" {
+		endAt, err := time.Parse(time.RFC3339, ti.EndAt)
+		if err != nil {
+			return fmt.Errorf("endAt %s is not a valid RFC3339 timestamp", ti.EndAt)
+		}
+		if !endAt.After(startAt) {
+			return fmt.Errorf("endAt %s must be later than startAt %s", ti.EndAt, ti.StartAt)
+		}
+	}
+
+	return nil
+}
+
+//registrationArea returns the bounding box of a registration location, which may be either a
+//GeoJSON geometry or a GeoProperty with a geometry as its value
+func registrationArea(location interface{}) (*boundingBox, error) {
+	geometry, ok := location.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a GeoJSON geometry or a GeoProperty")
+	}
+
+	if geometry["type"] == "GeoProperty" {
+		geometry, ok = geometry["value"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the value of the GeoProperty is not a GeoJSON geometry")
+		}
+	}
+
+	switch geometry["type"] {
+	case "Point", "MultiPoint", "LineString", "MultiLineString", "Polygon", "MultiPolygon":
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %v", geometry["type"])
+	}
+
+	positions := geometryPositions(geometry["coordinates"])
+	if len(positions) == 0 {
+		return nil, fmt.Errorf("the geometry does not contain any positions")
+	}
+
+	return newBoundingBox(positions), nil
+}
+
+type boundingBox struct {
+	minLon, minLat float64
+	maxLon, maxLat float64
+}
+
+func newBoundingBox(positions [][2]float64) *boundingBox {
+	bb := &boundingBox{
+		minLon: positions[0][0], minLat: positions[0][1],
+		maxLon: positions[0][0], maxLat: positions[0][1],
+	}
+
+	for _, pos := range positions[1:] {
+		bb.minLon, bb.maxLon = math.Min(bb.minLon, pos[0]), math.Max(bb.maxLon, pos[0])
+		bb.minLat, bb.maxLat = math.Min(bb.minLat, pos[1]), math.Max(bb.maxLat, pos[1])
+	}
+
+	return bb
+}
+
+func (bb *boundingBox) intersects(other *boundingBox) bool {
+	return bb.minLon <= other.maxLon && other.minLon <= bb.maxLon &&
+		bb.minLat <= other.maxLat && other.minLat <= bb.maxLat
+}
+
+//nearestPosition returns the position within the bounding box that is closest to lon, lat
+func (bb *boundingBox) nearestPosition(lon, lat float64) (float64, float64) {
+	return math.Max(bb.minLon, math.Min(lon, bb.maxLon)), math.Max(bb.minLat, math.Min(lat, bb.maxLat))
+}
+
+func isAbsoluteURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.Scheme != ""
 }
@@ -2,11 +2,17 @@ package ngsi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
@@ -14,10 +20,11 @@ import (
 )
 
 func TestRegisterContextSource(t *testing.T) {
-	registrationBody, _ := NewCsourceRegistration("Point", []string{"x", "y"}, "lolcathost", nil)
+	registrationBody, _ := NewCsourceRegistration("Point", []string{"x", "y"}, "http://lolcathost", nil)
 	jsonBytes, _ := json.Marshal(registrationBody)
 	ctxRegistry := NewContextRegistry()
 	req, _ := http.NewRequest("POST", createURL("/csourceRegistration"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
@@ -36,10 +43,11 @@ func TestRegisterContextSource(t *testing.T) {
 
 func TestRegisterContextSourceWithIDPatternMatch(t *testing.T) {
 	regex := fmt.Sprintf("^%s.+", fiware.DeviceIDPrefix)
-	registrationBody, _ := NewCsourceRegistration("A", []string{"a"}, "lolcathost", &regex)
+	registrationBody, _ := NewCsourceRegistration("A", []string{"a"}, "http://lolcathost", &regex)
 	jsonBytes, _ := json.Marshal(registrationBody)
 	ctxRegistry := NewContextRegistry()
 	req, _ := http.NewRequest("POST", createURL("/csourceRegistration"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
@@ -69,6 +77,7 @@ func TestThatRequestsWithIDPatternMatchAreForwardedToRemoteContext(t *testing.T)
 
 	// Send a POST request to register a remote context source
 	req, _ := http.NewRequest("POST", createURL("/csourceRegistration"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
 
@@ -97,6 +106,7 @@ func TestThatRequestsAreForwardedToRemoteContext(t *testing.T) {
 
 	// Send a POST request to register a remote context source
 	req, _ := http.NewRequest("POST", createURL("/csourceRegistration"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
 
@@ -130,6 +140,7 @@ func TestThatGeoJSONResponsesAreProperlyPropagated(t *testing.T) {
 
 	// Send a POST request to register a remote context source
 	req, _ := http.NewRequest("POST", createURL("/csourceRegistration"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
 
@@ -156,6 +167,7 @@ func TestThatSingleGeoJSONResponsesAreProperlyPropagated(t *testing.T) {
 
 	// Send a POST request to register a remote context source
 	req, _ := http.NewRequest("POST", createURL("/csourceRegistration"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 	NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
 
@@ -168,6 +180,245 @@ func TestThatSingleGeoJSONResponsesAreProperlyPropagated(t *testing.T) {
 	is.Equal(w.Code, http.StatusOK) // failed to get entities from remote endpoint
 }
 
+func TestThatDeleteRequestsAreForwardedToRemoteContext(t *testing.T) {
+	is := is.New(t)
+
+	mockService := setupMockServiceThatReturns(204, "application/ld+json", "")
+	defer mockService.Close()
+
+	regex := "^urn:ngsi-ld:TypeA:.+"
+	registration, _ := NewCsourceRegistration("TypeA", []string{"a"}, mockService.URL, &regex)
+	contextSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	entityID := "urn:ngsi-ld:TypeA:myentity"
+	req, _ := http.NewRequest("DELETE", createURL("/entities/"+entityID), nil)
+	w := httptest.NewRecorder()
+	NewDeleteEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent) // unexpected response code
+}
+
+func TestThatAppendAttributeRequestsAreForwardedToRemoteContext(t *testing.T) {
+	is := is.New(t)
+
+	var forwardedPath, forwardedOptions string
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedPath = r.URL.Path
+		forwardedOptions = r.URL.Query().Get("options")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockService.Close()
+
+	regex := "^urn:ngsi-ld:TypeA:.+"
+	registration, _ := NewCsourceRegistration("TypeA", []string{"a"}, mockService.URL, &regex)
+	contextSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	entityID := "urn:ngsi-ld:TypeA:myentity"
+	req, _ := http.NewRequest("POST", createURL("/entities/"+entityID+"/attrs", "options=noOverwrite"), bytes.NewBufferString(`{"a":{"type":"Property","value":1}}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewAppendEntityAttributesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                             // unexpected response code
+	is.Equal(forwardedPath, "/ngsi-ld/v1/entities/"+entityID+"/attrs") // unexpected path in forwarded request
+	is.Equal(forwardedOptions, "noOverwrite")                          // options were not forwarded
+}
+
+func TestThatRemoteContextSourcesSendTheNoOverwriteOption(t *testing.T) {
+	is := is.New(t)
+
+	var forwardedOptions string
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedOptions = r.URL.Query().Get("options")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL)
+	entityID := "urn:ngsi-ld:WeatherObserved:1"
+
+	req, _ := http.NewRequest("POST", createURL("/entities/"+entityID+"/attrs"), bytes.NewBufferString(`{"snowHeight":{"type":"Property","value":1}}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	err := contextSource.AppendEntityAttributes(entityID, true, newRequestWrapper(req))
+	is.NoErr(err)                             // the append should succeed
+	is.Equal(forwardedOptions, "noOverwrite") // noOverwrite should be sent
+
+	req, _ = http.NewRequest("POST", createURL("/entities/"+entityID+"/attrs", "options=noOverwrite,keyValues"), bytes.NewBufferString(`{"snowHeight":1}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	err = contextSource.AppendEntityAttributes(entityID, false, newRequestWrapper(req))
+	is.NoErr(err)                           // the append should succeed
+	is.Equal(forwardedOptions, "keyValues") // noOverwrite should only be sent when it is asked for
+}
+
+func TestThatRemoteContextSourceCanCountEntities(t *testing.T) {
+	is := is.New(t)
+
+	var forwardedQuery url.Values
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedQuery = r.URL.Query()
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Header().Add(ResultsCountHeader, "17")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	}))
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "limit=5", "offset=10"), nil)
+	query, _ := newQueryFromParameters(req, []string{"WeatherObserved"}, []string{}, "")
+
+	count, err := contextSource.(EntityCounter).CountEntities(context.Background(), query)
+
+	is.NoErr(err)                                 // failed to count entities
+	is.Equal(count, uint64(17))                   // unexpected number of entities
+	is.Equal(forwardedQuery.Get("count"), "true") // count was not requested from the remote source
+	is.Equal(forwardedQuery.Get("limit"), "0")    // entities should not be requested from the remote source
+	is.Equal(req.URL.Query().Get("limit"), "5")   // the incoming request must not be modified
+}
+
+func TestThatQueryParametersAreForwardedToRemoteSources(t *testing.T) {
+	is := is.New(t)
+
+	var forwardedQuery url.Values
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedQuery = r.URL.Query()
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte("[]"))
+	}))
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+
+	req, _ := http.NewRequest("GET", createURL("/entities",
+		"type=WeatherObserved", "georel=near%3BmaxDistance%3D%3D2000", "geometry=Point",
+		"coordinates=%5B17.3,62.4%5D", "geoproperty=observationSpace", "idPattern=.*snow.*", "options=keyValues",
+	), nil)
+	query, err := newQueryFromParameters(req, []string{"WeatherObserved"}, []string{}, "")
+	is.NoErr(err) // failed to create query
+
+	err = contextSource.GetEntities(query, func(Entity) error { return nil })
+
+	is.NoErr(err)                                                   // failed to query the remote source
+	is.Equal(*query.Geo().GeoProperty, "observationSpace")          // the geoproperty should be part of the query
+	is.Equal(forwardedQuery.Get("geoproperty"), "observationSpace") // the geoproperty was not forwarded
+	is.Equal(forwardedQuery.Get("idPattern"), ".*snow.*")           // unknown parameters should be passed on
+	is.Equal(forwardedQuery.Get("options"), "keyValues")            // options were not forwarded
+}
+
+func TestThatRemoteRequestsAreCancelledWithTheContext(t *testing.T) {
+	is := is.New(t)
+
+	release := make(chan struct{})
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockService.Close()
+	defer close(release)
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved"), nil)
+	query, _ := newQueryFromParameters(req, []string{"WeatherObserved"}, []string{}, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := NewContextAwareSource(contextSource).GetEntitiesWithContext(ctx, query, func(e Entity) error {
+		return nil
+	})
+
+	is.True(err != nil)                        // expected an error when the context is done
+	is.True(time.Since(start) < 5*time.Second) // the outbound request should have been cancelled
+}
+
+func TestThatEachRemoteContextSourceGetsItsOwnRequest(t *testing.T) {
+	is := is.New(t)
+
+	serviceA := newRecordingMockService(http.StatusCreated)
+	defer serviceA.Close()
+	serviceB := newRecordingMockService(http.StatusCreated)
+	defer serviceB.Close()
+
+	ctxRegistry := NewContextRegistry()
+	for _, service := range []*recordingMockService{serviceA, serviceB} {
+		registration, _ := NewCsourceRegistration("Device", []string{"value"}, service.URL, nil)
+		contextSource, _ := NewRemoteContextSource(registration)
+		ctxRegistry.Register(contextSource)
+	}
+
+	body, _ := newEntityAsByteBuffer("urn:ngsi-ld:Device:mydevice")
+	req, _ := http.NewRequest("POST", createURL("/entities"), body)
+	req.Header.Add("Content-Type", "application/ld+json")
+	req.Header.Add("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	NewCreateEntityHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated) // unexpected response code
+
+	for _, service := range []*recordingMockService{serviceA, serviceB} {
+		is.Equal(len(service.requests), 1) // each source should receive one request
+		received := service.requests[0]
+		is.Equal(received.host, strings.TrimPrefix(service.URL, "http://"))     // request should be addressed to the source itself
+		is.Equal(received.userAgents, []string{"ngsi-context-broker/0.1"})      // user agent should be set exactly once
+		is.Equal(received.forwardedHost, "localhost:8080")                      // unexpected forwarded host
+		is.True(strings.Contains(received.body, "urn:ngsi-ld:Device:mydevice")) // request body should be forwarded to every source
+	}
+
+	is.Equal(req.URL.Host, "localhost:8080")            // the incoming request URL must not be modified
+	is.Equal(req.Host, "localhost:8080")                // the incoming request host must not be modified
+	is.Equal(req.Header.Get("User-Agent"), "")          // the incoming request headers must not be modified
+	is.Equal(req.Header.Get("Accept-Encoding"), "gzip") // the incoming request headers must not be modified
+}
+
+func TestThatQueriesAreSentToSeveralRemoteContextSources(t *testing.T) {
+	is := is.New(t)
+
+	serviceA := newRecordingMockService(http.StatusOK)
+	defer serviceA.Close()
+	serviceB := newRecordingMockService(http.StatusOK)
+	defer serviceB.Close()
+
+	ctxRegistry := NewContextRegistry()
+	for _, service := range []*recordingMockService{serviceA, serviceB} {
+		registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight"}, service.URL, nil)
+		contextSource, _ := NewRemoteContextSource(registration)
+		ctxRegistry.Register(contextSource)
+	}
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved"), nil)
+	w := httptest.NewRecorder()
+
+	NewQueryEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	is.Equal(len(entities), 2) // expected one entity from each source
+
+	for _, service := range []*recordingMockService{serviceA, serviceB} {
+		is.Equal(len(service.requests), 1)                                             // each source should receive one request
+		is.Equal(service.requests[0].host, strings.TrimPrefix(service.URL, "http://")) // request should be addressed to the source itself
+		is.Equal(service.requests[0].userAgents, []string{"ngsi-context-broker/0.1"})  // user agent should be set exactly once
+	}
+
+	is.Equal(req.URL.Host, "localhost:8080")   // the incoming request URL must not be modified
+	is.Equal(req.Header.Get("User-Agent"), "") // the incoming request headers must not be modified
+}
+
 func TestThatProvidedTypeCanBeExtractedFromMatchingID(t *testing.T) {
 	is := is.New(t)
 
@@ -220,3 +471,474 @@ func setupMockServiceThatReturns(responseCode int, contentType, body string) *ht
 		}
 	}))
 }
+
+type recordedRequest struct {
+	host          string
+	forwardedHost string
+	userAgents    []string
+	body          string
+}
+
+//recordingMockService is a mocked remote context source that records the requests it receives
+type recordingMockService struct {
+	*httptest.Server
+	requests []recordedRequest
+	mu       sync.Mutex
+}
+
+func newRecordingMockService(responseCode int) *recordingMockService {
+	service := &recordingMockService{}
+	service.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		service.mu.Lock()
+		service.requests = append(service.requests, recordedRequest{
+			host:          r.Host,
+			forwardedHost: r.Header.Get("X-Forwarded-Host"),
+			userAgents:    r.Header.Values("User-Agent"),
+			body:          string(body),
+		})
+		service.mu.Unlock()
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(responseCode)
+		if responseCode == http.StatusOK {
+			w.Write([]byte(snowHeightResponseJSON))
+		}
+	}))
+	return service
+}
+
+func TestThatRegistrationsGetALocationAndCanBeRetrieved(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	w := registerTestContextSource(ctxRegistry, "WeatherObserved", "temperature", nil)
+
+	is.Equal(w.Code, http.StatusCreated) // registration should succeed
+
+	location := w.Header().Get("Location")
+	is.True(strings.HasPrefix(location, "/ngsi-ld/v1/csourceRegistrations/urn:ngsi-ld:ContextSourceRegistration:")) // unexpected location
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080"+location, nil)
+	w = httptest.NewRecorder()
+	NewRetrieveContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK) // failed to retrieve the registration
+
+	registration := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &registration)
+	is.Equal("/ngsi-ld/v1/csourceRegistrations/"+registration["id"].(string), location) // unexpected registration id
+	is.Equal(registration["endpoint"], "http://localhost:1234")                         // unexpected registration endpoint
+}
+
+func TestThatRegisteringAnExistingIDFails(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	body := `{"id":"urn:ngsi-ld:ContextSourceRegistration:1","type":"ContextSourceRegistration","information":[{"entities":[{"type":"A"}]}],"endpoint":"http://localhost:1234"}`
+
+	for _, expectedCode := range []int{http.StatusCreated, http.StatusConflict} {
+		req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/ld+json")
+		w := httptest.NewRecorder()
+		NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
+		is.Equal(w.Code, expectedCode) // unexpected response code
+	}
+}
+
+func TestQueryContextSourceRegistrations(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	pattern := "^urn:ngsi-ld:RoadSegment:.+"
+	registerTestContextSource(ctxRegistry, "WeatherObserved", "temperature", nil)
+	registerTestContextSource(ctxRegistry, "WeatherObserved", "snowHeight", nil)
+	registerTestContextSource(ctxRegistry, "RoadSegment", "surfaceType", &pattern)
+
+	testData := []struct {
+		params   string
+		expected int
+	}{
+		{"", 3},
+		{"?type=WeatherObserved", 2},
+		{"?type=WeatherObserved&attrs=snowHeight", 1},
+		{"?attrs=surfaceType,temperature", 2},
+		{"?id=urn:ngsi-ld:RoadSegment:road1", 1},
+		{"?idPattern=" + url.QueryEscape(pattern), 1},
+		{"?type=Device", 0},
+	}
+
+	for _, td := range testData {
+		req, _ := http.NewRequest("GET", createURL("/csourceRegistrations"+td.params), nil)
+		w := httptest.NewRecorder()
+		NewQueryContextSourceRegistrationsHandler(ctxRegistry).ServeHTTP(w, req)
+
+		registrations := []interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &registrations)
+
+		is.Equal(w.Code, http.StatusOK)           // query should succeed
+		is.Equal(len(registrations), td.expected) // unexpected number of registrations
+	}
+}
+
+func TestUpdateContextSourceRegistration(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "WeatherObserved", "temperature", nil).Header().Get("Location")
+
+	fragment := `{"information":[{"entities":[{"type":"RoadSegment"}],"properties":["surfaceType"]}]}`
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080"+location, strings.NewReader(fragment))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                                          // update should succeed
+	is.Equal(len(ctxRegistry.(ManageableContextRegistry).ListContextSources()), 1)  // the registration should be replaced
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("WeatherObserved")), 0) // the old information should be gone
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntityType("RoadSegment")), 1)     // the new information should be used
+
+	sources := ctxRegistry.GetContextSourcesForEntityType("RoadSegment")
+	is.Equal(sources[0].(*remoteContextSource).registration.(*ctxSrcReg).Endpt, "http://localhost:1234") // the endpoint should be kept
+}
+
+func TestThatTheIDOfARegistrationCanNotBeChanged(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "WeatherObserved", "temperature", nil).Header().Get("Location")
+
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080"+location, strings.NewReader(`{"id":"urn:ngsi-ld:ContextSourceRegistration:other"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // changing the id should not be allowed
+}
+
+func TestDeleteContextSourceRegistration(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+	location := registerTestContextSource(ctxRegistry, "WeatherObserved", "temperature", nil).Header().Get("Location")
+
+	for _, expectedCode := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080"+location, nil)
+		w := httptest.NewRecorder()
+		NewDeleteContextSourceRegistrationHandler(ctxRegistry).ServeHTTP(w, req)
+		is.Equal(w.Code, expectedCode) // unexpected response code
+	}
+
+	is.Equal(len(ctxRegistry.(ManageableContextRegistry).ListContextSources()), 0) // the registration should have been removed
+}
+
+func TestThatUnknownRegistrationsAreNotFound(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/csourceRegistrations/urn:ngsi-ld:ContextSourceRegistration:nope"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveContextSourceRegistrationHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)                          // expected 404
+	is.True(strings.Contains(w.Body.String(), "ResourceNotFound")) // expected a ResourceNotFound problem
+}
+
+func registerTestContextSource(ctxReg ContextRegistry, typeName, attributeName string, idPattern *string) *httptest.ResponseRecorder {
+	registration, _ := NewCsourceRegistration(typeName, []string{attributeName}, "http://localhost:1234", idPattern)
+	jsonBytes, _ := json.Marshal(registration)
+
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewRegisterContextSourceHandler(ctxReg).ServeHTTP(w, req)
+
+	return w
+}
+
+func TestThatValidRegistrationsAreAccepted(t *testing.T) {
+	is := is.New(t)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	registration := `{
+		"@context": "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+		"id": "urn:ngsi-ld:ContextSourceRegistration:weather",
+		"type": "ContextSourceRegistration",
+		"registrationName": "weather",
+		"information": [
+			{"entities": [{"id": "urn:ngsi-ld:WeatherObserved:1", "type": "WeatherObserved"}]},
+			{"entities": [{"idPattern": "^urn:ngsi-ld:Device:.+", "type": "Device"}], "propertyNames": ["value"], "relationshipNames": ["refDevice"]},
+			{"propertyNames": ["temperature"]}
+		],
+		"observationInterval": {"startAt": "2021-01-01T00:00:00Z", "endAt": "2021-12-31T00:00:00Z"},
+		"managementInterval": {"startAt": "2021-01-01T00:00:00Z"},
+		"expiresAt": "` + expiresAt + `",
+		"endpoint": "https://weather.example.com/api"
+	}`
+
+	_, err := NewCsourceRegistrationFromJSON([]byte(registration))
+	is.NoErr(err) // registration should be valid
+}
+
+func TestThatRegistrationsWithMembersWeDoNotUseAreAccepted(t *testing.T) {
+	is := is.New(t)
+
+	registration, err := NewCsourceRegistrationFromJSON([]byte(`{
+		"type": "ContextSourceRegistration",
+		"information": [{"entities": [{"type": "A"}], "propertyNames": ["a"]}],
+		"operations": ["retrieveEntity", "queryEntity"],
+		"contextSourceInfo": [{"key": "apiKey", "value": "secret"}],
+		"scope": "/Madrid",
+		"tenant": "tenant1",
+		"management": {"timeout": 1000},
+		"refreshRate": "PT1M",
+		"endpoint": "http://localhost:1234"
+	}`))
+	is.NoErr(err) // members that are not used should be ignored
+
+	bytes, _ := json.Marshal(registration)
+	is.True(!strings.Contains(string(bytes), `"properties"`)) // empty legacy properties should be left out
+}
+
+func TestThatInvalidRegistrationsAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	const entities = `"information":[{"entities":[{"type":"A"}]}]`
+	const endpoint = `"endpoint":"http://localhost:1234"`
+
+	testData := []struct {
+		registration string
+		detail       string
+	}{
+		{`{"type":"Registration",` + entities + `,` + endpoint + `}`, `type must be "ContextSourceRegistration"`},
+		{`{"id":"registration1","type":"ContextSourceRegistration",` + entities + `,` + endpoint + `}`, "id registration1 is not a valid URI"},
+		{`{"type":"ContextSourceRegistration",` + entities + `}`, "endpoint is required"},
+		{`{"type":"ContextSourceRegistration",` + entities + `,"endpoint":"lolcathost"}`, "endpoint lolcathost is not an absolute http or https URL"},
+		{`{"type":"ContextSourceRegistration",` + entities + `,"endpoint":"ftp://localhost"}`, "endpoint ftp://localhost is not an absolute http or https URL"},
+		{`{"type":"ContextSourceRegistration","information":[],` + endpoint + `}`, "information must contain at least one item"},
+		{`{"type":"ContextSourceRegistration","information":[{}],` + endpoint + `}`, "information[0]: at least one of entities, propertyNames or relationshipNames is required"},
+		{`{"type":"ContextSourceRegistration","information":[{"entities":[{"id":"urn:ngsi-ld:A:1"}]}],` + endpoint + `}`, "information[0]: entities[0]: type is required"},
+		{`{"type":"ContextSourceRegistration","information":[{"entities":[{"type":"A","id":"urn:ngsi-ld:A:1","idPattern":".*"}]}],` + endpoint + `}`, "id and idPattern can not both be specified"},
+		{`{"type":"ContextSourceRegistration","information":[{"entities":[{"type":"A","idPattern":"(.*"}]}],` + endpoint + `}`, "idPattern (.* is not a valid regular expression"},
+		{`{"type":"ContextSourceRegistration","information":[{"propertyNames":["a"],"relationshipNames":["a"]}],` + endpoint + `}`, "a can not be both a property and a relationship"},
+		{`{"type":"ContextSourceRegistration",` + entities + `,"observationInterval":{"startAt":"yesterday"},` + endpoint + `}`, "observationInterval: startAt yesterday is not a valid RFC3339 timestamp"},
+		{`{"type":"ContextSourceRegistration",` + entities + `,"managementInterval":{"startAt":"2021-02-01T00:00:00Z","endAt":"2021-01-01T00:00:00Z"},` + endpoint + `}`, "managementInterval: endAt 2021-01-01T00:00:00Z must be later than startAt"},
+		{`{"type":"ContextSourceRegistration",` + entities + `,"expiresAt":"2021-01-01T00:00:00Z",` + endpoint + `}`, "expiresAt 2021-01-01T00:00:00Z is not in the future"},
+		{`{"type":"ContextSourceRegistration","information":"everything",` + endpoint + `}`, "malformed registration"},
+	}
+
+	for _, td := range testData {
+		req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(td.registration))
+		req.Header.Set("Content-Type", "application/ld+json")
+		w := httptest.NewRecorder()
+		NewRegisterContextSourceHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+		problem := struct {
+			Type   string `json:"type"`
+			Detail string `json:"detail"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &problem)
+
+		is.Equal(w.Code, http.StatusBadRequest)                    // registration should be rejected
+		is.True(strings.HasSuffix(problem.Type, "BadRequestData")) // expected a BadRequestData problem
+		if !strings.Contains(problem.Detail, td.detail) {
+			t.Errorf("expected the problem detail to contain %q, but got %q", td.detail, problem.Detail)
+		}
+	}
+}
+
+func TestThatRegistrationsRouteOnStandardRegistrationInfo(t *testing.T) {
+	is := is.New(t)
+
+	registration, err := NewCsourceRegistrationFromJSON([]byte(`{
+		"type": "ContextSourceRegistration",
+		"information": [
+			{"entities": [{"id": "urn:ngsi-ld:Device:exact", "type": "Device"}], "propertyNames": ["value"]},
+			{"entities": [{"type": "RoadSegment"}], "relationshipNames": ["refRoad"]},
+			{"entities": [{"type": "Beach"}], "properties": ["waterTemperature"]}
+		],
+		"endpoint": "http://localhost:1234"
+	}`))
+	is.NoErr(err) // failed to create registration
+
+	contextSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntity("urn:ngsi-ld:Device:exact")), 1)   // an exact id should match
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntity("urn:ngsi-ld:Device:other")), 0)   // other ids of the same type should not match
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntity("urn:ngsi-ld:RoadSegment:r1")), 0) // type only information should not match any ids by default
+
+	entityType, _ := contextSource.GetProvidedTypeFromID("urn:ngsi-ld:Device:exact")
+	is.Equal(entityType, "Device") // unexpected type for entity id
+
+	for _, attribute := range []string{"value", "refRoad", "waterTemperature"} {
+		query, _ := NewQuery().WithAttributes(attribute).Build()
+		is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 1) // the attribute should be routed to the source
+	}
+
+	query, _ := NewQuery().WithAttributes("temperature").Build()
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 0) // unregistered attributes should not be routed to the source
+}
+
+func TestThatEntityTypesCanBeTakenFromIDs(t *testing.T) {
+	is := is.New(t)
+
+	registration, err := NewCsourceRegistrationFromJSON([]byte(`{
+		"type": "ContextSourceRegistration",
+		"information": [{"entities": [{"type": "RoadSegment"}]}],
+		"endpoint": "http://localhost:1234"
+	}`))
+	is.NoErr(err) // failed to create registration
+
+	contextSource, _ := NewRemoteContextSource(registration, WithEntityTypesFromIDs())
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntity("urn:ngsi-ld:RoadSegment:r1")), 1) // type only information should match ids of that type
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntity("urn:ngsi-ld:RoadSurface:s1")), 0) // ids of other types should not match
+	is.Equal(len(ctxRegistry.GetContextSourcesForEntity("RoadSegment:r1")), 0)             // ids of another form should not match
+
+	entityType, _ := contextSource.GetProvidedTypeFromID("urn:ngsi-ld:RoadSegment:r1")
+	is.Equal(entityType, "RoadSegment") // unexpected type for entity id
+}
+
+func TestThatInformationWithoutEntitiesCoversAllTypes(t *testing.T) {
+	is := is.New(t)
+
+	registration, err := NewCsourceRegistrationFromJSON([]byte(`{
+		"type": "ContextSourceRegistration",
+		"information": [{"propertyNames": ["temperature"]}],
+		"endpoint": "http://localhost:1234"
+	}`))
+	is.NoErr(err) // failed to create registration
+
+	contextSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	query, _ := NewQuery().WithTypes("WeatherObserved").WithAttributes("temperature").Build()
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 1) // the source should be found for any type
+
+	query, _ = NewQuery().WithTypes("WeatherObserved").WithAttributes("snowHeight").Build()
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 0) // but only for the registered attributes
+}
+
+func TestThatGeoQueriesAreOnlyRoutedToSourcesInTheQueriedArea(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+
+	registrations := []string{
+		`{"id":"urn:ngsi-ld:ContextSourceRegistration:south","type":"ContextSourceRegistration",
+		  "information":[{"entities":[{"type":"WeatherObserved"}]}],"endpoint":"http://south.localhost",
+		  "location":{"type":"Polygon","coordinates":[[[17.0,62.2],[17.5,62.2],[17.5,62.4],[17.0,62.4],[17.0,62.2]]]}}`,
+		`{"id":"urn:ngsi-ld:ContextSourceRegistration:north","type":"ContextSourceRegistration",
+		  "information":[{"entities":[{"type":"WeatherObserved"}]}],"endpoint":"http://north.localhost",
+		  "location":{"type":"GeoProperty","value":{"type":"Polygon","coordinates":[[[17.0,62.5],[17.5,62.5],[17.5,62.7],[17.0,62.7],[17.0,62.5]]]}}}`,
+	}
+
+	for _, registration := range registrations {
+		req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(registration))
+		req.Header.Set("Content-Type", "application/ld+json")
+		w := httptest.NewRecorder()
+		NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
+		is.Equal(w.Code, http.StatusCreated) // registration should succeed
+	}
+
+	testData := []struct {
+		geoQuery *GeoQuery
+		expected []string
+	}{
+		{nil, []string{"south", "north"}},
+		{&GeoQuery{Geometry: "Point", Coordinates: []float64{17.3, 62.3}, GeoRel: GeoSpatialRelationNearPoint, distance: 1000}, []string{"south"}},
+		{&GeoQuery{Geometry: "Point", Coordinates: []float64{17.3, 62.45}, GeoRel: GeoSpatialRelationNearPoint, distance: 1000}, []string{}},
+		{&GeoQuery{Geometry: "Point", Coordinates: []float64{17.3, 62.45}, GeoRel: GeoSpatialRelationNearPoint, distance: 20000}, []string{"south", "north"}},
+		{&GeoQuery{Geometry: "Polygon", Coordinates: []float64{17.1, 62.55, 17.2, 62.55, 17.2, 62.6}, GeoRel: GeoSpatialRelationWithinRect}, []string{"north"}},
+		{&GeoQuery{Geometry: "Polygon", Coordinates: []float64{18.1, 62.55, 18.2, 62.55, 18.2, 62.6}, GeoRel: GeoSpatialRelationWithinRect}, []string{}},
+	}
+
+	for _, td := range testData {
+		builder := NewQuery().WithTypes("WeatherObserved")
+		if td.geoQuery != nil {
+			builder = builder.WithGeo(*td.geoQuery)
+		}
+		query, _ := builder.Build()
+
+		sources := ctxRegistry.GetContextSourcesForQuery(query)
+		is.Equal(len(sources), len(td.expected)) // unexpected number of sources for geo-query
+
+		for idx, source := range sources {
+			is.Equal(source.(*remoteContextSource).ID(), "urn:ngsi-ld:ContextSourceRegistration:"+td.expected[idx]) // unexpected source for geo-query
+		}
+	}
+}
+
+func TestThatRegistrationsWithInvalidLocationsAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	registration := `{"type":"ContextSourceRegistration","information":[{"entities":[{"type":"A"}]}],
+		"endpoint":"http://localhost:1234","location":{"type":"Circle","coordinates":[17.3,62.3]}}`
+
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(registration))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewRegisterContextSourceHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)                                        // registration should be rejected
+	is.True(strings.Contains(w.Body.String(), "unsupported geometry type Circle")) // unexpected problem detail
+}
+
+func TestThatConflictingExclusiveRegistrationsAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	ctxRegistry := NewContextRegistry()
+
+	registration := func(mode, entityID, attribute string) string {
+		return `{"type":"ContextSourceRegistration","mode":"` + mode + `",
+			"information":[{"entities":[{"id":"` + entityID + `","type":"Device"}],"propertyNames":["` + attribute + `"]}],
+			"endpoint":"http://localhost:1234"}`
+	}
+
+	testData := []struct {
+		registration string
+		expectedCode int
+	}{
+		{registration("exclusive", "urn:ngsi-ld:Device:1", "value"), http.StatusCreated},
+		{registration("exclusive", "urn:ngsi-ld:Device:1", "value"), http.StatusConflict},
+		{registration("exclusive", "urn:ngsi-ld:Device:1", "battery"), http.StatusCreated},
+		{registration("exclusive", "urn:ngsi-ld:Device:2", "value"), http.StatusCreated},
+		{registration("inclusive", "urn:ngsi-ld:Device:1", "value"), http.StatusCreated},
+		{registration("auxiliary", "urn:ngsi-ld:Device:1", "value"), http.StatusCreated},
+		{registration("sometimes", "urn:ngsi-ld:Device:1", "value"), http.StatusBadRequest},
+	}
+
+	for _, td := range testData {
+		req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(td.registration))
+		req.Header.Set("Content-Type", "application/ld+json")
+		w := httptest.NewRecorder()
+		NewRegisterContextSourceHandler(ctxRegistry).ServeHTTP(w, req)
+		is.Equal(w.Code, td.expectedCode) // unexpected response code
+	}
+}
+
+func TestThatEachRegistryHasItsOwnRegistrationLock(t *testing.T) {
+	is := is.New(t)
+
+	first, second := NewContextRegistry(), NewContextRegistry()
+
+	is.True(registrationLock(first) == registrationLock(first))  // a registry should always get the same lock
+	is.True(registrationLock(first) != registrationLock(second)) // registries should not share a lock
+
+	lock := registrationLock(first)
+	lock.Lock()
+	defer lock.Unlock()
+
+	body := `{"type":"ContextSourceRegistration","information":[{"entities":[{"type":"A"}]}],"endpoint":"http://localhost:1234"}`
+	req, _ := http.NewRequest("POST", createURL("/csourceRegistrations"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewRegisterContextSourceHandler(second).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated) // registering with another registry should not be held up
+}
@@ -3,11 +3,13 @@ package ngsi
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
-	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -21,31 +23,19 @@ type Entity interface {
 //entities matching the query that has been passed in
 type QueryEntitiesCallback func(entity Entity) error
 
-func getEntityConverterFromRequest(r *http.Request) (string, func(interface{}) interface{}, *geojson.GeoJSONFeatureCollection) {
-	// Default entity converter doesn't actually convert anything
-	entityConverter := func(e interface{}) interface{} { return e }
+//NewQueryEntitiesHandler handles GET requests for NGSI entities. The context sources that
+//match a query are queried concurrently, and the behaviour when some of them are slow or
+//fail can be changed with WithSourceTimeout and WithPartialResults.
+func NewQueryEntitiesHandler(ctxReg ContextRegistry, options ...HandlerOption) http.HandlerFunc {
+	opts := newHandlerOptions(options)
 
-	responseContentType := "application/ld+json;charset=utf-8"
-	var geoJSONFeatureCollection *geojson.GeoJSONFeatureCollection
-
-	// Check Accept to find out what kind of data the client wants
-	for _, acceptableType := range r.Header["Accept"] {
-		if strings.HasPrefix(acceptableType, geojson.ContentType) {
-			options := r.URL.Query().Get("options")
-			geoJSONFeatureCollection = geojson.NewGeoJSONFeatureCollection([]geojson.GeoJSONFeature{}, true)
-			entityConverter = geojson.NewEntityConverter("location", options == "keyValues", geoJSONFeatureCollection)
-			responseContentType = acceptableType
-		}
-	}
-
-	return responseContentType, entityConverter, geoJSONFeatureCollection
-}
-
-//NewQueryEntitiesHandler handles GET requests for NGSI entities
-func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		responseContentType, entityConverter, geoJSONFeatureCollection := getEntityConverterFromRequest(r)
+		representation, ok := newEntityRepresentation(r)
+		if !ok {
+			reportNotAcceptable(w)
+			return
+		}
 
 		entityTypeNames := r.URL.Query().Get("type")
 		attributeNames := r.URL.Query().Get("attrs")
@@ -70,41 +60,67 @@ func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 			return
 		}
 
-		contextSources := ctxReg.GetContextSourcesForQuery(query)
-
-		var entities = []Entity{}
-		var entityCount = uint64(0)
-		var entityMaxCount = uint64(18446744073709551615) // uint64 max
+		// Save the original parameters before the request is passed on to any context sources
+		requestParameters := r.URL.Query()
 
-		if query.PaginationLimit() > 0 {
-			entityMaxCount = query.PaginationLimit()
+		// Auxiliary sources are only queried when there are no other sources to ask
+		contextSources, auxiliarySources := sourcesForReading(ctxReg.GetContextSourcesForQuery(query))
+		if len(contextSources) == 0 {
+			contextSources = auxiliarySources
 		}
 
-		for _, source := range contextSources {
-			err = source.GetEntities(query, func(entity Entity) error {
-				if entityCount < entityMaxCount {
-					entities = append(entities, entityConverter(entity))
-					entityCount++
-				}
-				return nil
-			})
+		federated := newFederatedQuery(r.Context(), contextSources, query, opts)
+
+		if query.CountRequested() {
+			var totalCount uint64
+			totalCount, err = federated.Count()
 			if err != nil {
-				break
+				errors.ReportNewInternalError(
+					w,
+					"An internal error was encountered when trying to count entities in the context source: "+err.Error(),
+				)
+				return
 			}
+
+			w.Header().Add(ResultsCountHeader, strconv.FormatUint(totalCount, 10))
 		}
 
-		if err != nil {
-			errors.ReportNewInternalError(
-				w,
-				"An internal error was encountered when trying to get entities from the context source: "+err.Error(),
-			)
-			return
+		var entities = []Entity{}
+		var hasNextPage = false
+
+		limit := query.PaginationLimit()
+		offset := query.PaginationOffset()
+
+		if limit > 0 {
+			// Ask for one more entity than we need, so that we can tell if there is a next page
+			windowSize := limit
+			if windowSize < math.MaxUint64 {
+				windowSize++
+			}
+
+			var found []Entity
+			found, err = federated.Entities(offset, windowSize)
+			if err != nil {
+				errors.ReportNewInternalError(
+					w,
+					"An internal error was encountered when trying to get entities from the context source: "+err.Error(),
+				)
+				return
+			}
+
+			for _, entity := range found {
+				if uint64(len(entities)) == limit {
+					hasNextPage = true
+					break
+				}
+				entities = append(entities, representation.convert(entity))
+			}
 		}
 
 		var bytes []byte
 
-		if geoJSONFeatureCollection != nil {
-			bytes, err = json.MarshalIndent(geoJSONFeatureCollection, "", "  ")
+		if representation.collection != nil {
+			bytes, err = json.MarshalIndent(representation.collection, "", "  ")
 		} else {
 			bytes, err = json.MarshalIndent(entities, "", "  ")
 		}
@@ -114,12 +130,48 @@ func NewQueryEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 			return
 		}
 
-		w.Header().Add("Content-Type", responseContentType)
-		// TODO: Add a RFC 8288 Link header with information about previous and/or next page if they exist
+		representation.writeHeaders(w)
+
+		for _, warning := range federated.Warnings() {
+			w.Header().Add(WarningHeader, warning)
+		}
+
+		if limit > 0 {
+			if offset > 0 {
+				prevOffset := uint64(0)
+				if offset > limit {
+					prevOffset = offset - limit
+				}
+				w.Header().Add("Link", paginationLink(r.URL.Path, requestParameters, prevOffset, limit, "prev"))
+			}
+
+			if hasNextPage {
+				w.Header().Add("Link", paginationLink(r.URL.Path, requestParameters, offset+limit, limit, "next"))
+			}
+		}
+
 		w.Write(bytes)
 	})
 }
 
+//ResultsCountHeader is the response header that holds the total number of matching
+//entities when a client queries for entities with count=true
+const ResultsCountHeader string = "NGSILD-Results-Count"
+
+//paginationLink creates a RFC 8288 Link header value that refers to another page
+//of the same query
+func paginationLink(path string, parameters url.Values, offset, limit uint64, rel string) string {
+	params := url.Values{}
+	for k, v := range parameters {
+		params[k] = v
+	}
+
+	params.Set("offset", strconv.FormatUint(offset, 10))
+	params.Set("limit", strconv.FormatUint(limit, 10))
+
+	return fmt.Sprintf("<%s?%s>; rel=\"%s\"", path, params.Encode(), rel)
+}
+
 type UpdateEntityAttributesCompletionCallback func(entityType, entityID string, request Request, logger zerolog.Logger)
 
 //NewUpdateEntityAttributesHandler handles PATCH requests for NGSI entitity attributes
@@ -131,7 +183,9 @@ func NewUpdateEntityAttributesHandler(ctxReg ContextRegistry) http.HandlerFunc {
 }
 
 //NewUpdateEntityAttributesHandlerWithCallback handles PATCH requests for NGSI entitity
-//attributes and calls a callback on successful completion
+//attributes and calls a callback on successful completion. The attributes are split among
+//the context sources that provide them, and if only some of them could be updated the
+//response is a 207 with an UpdateResult.
 func NewUpdateEntityAttributesHandlerWithCallback(
 	ctxReg ContextRegistry,
 	logger zerolog.Logger,
@@ -141,38 +195,136 @@ func NewUpdateEntityAttributesHandlerWithCallback(
 
 		sublogger := decorateLogger(r, logger)
 
-		// TODO: Replace this string manipulation with a callback that can use the http router's
-		//		 functionality to extract URL params ...
-		entitiesIdx := strings.Index(r.URL.Path, "/entities/")
-		attrsIdx := strings.LastIndex(r.URL.Path, "/attrs/")
-
-		if entitiesIdx == -1 || attrsIdx == -1 || attrsIdx < entitiesIdx {
-			errors.ReportNewBadRequestData(
-				w,
-				"The supplied URL is invalid.",
-			)
+		params, found := findPathParams(w, r, "/entities/{entityId}/attrs")
+		if !found {
 			return
 		}
+		entityID := params[PathParamEntityID]
 
-		entityID := r.URL.Path[entitiesIdx+10 : attrsIdx]
-
-		request := newRequestWrapper(r)
-		contextSources := ctxReg.GetContextSourcesForEntity(entityID)
+		request, ok := newWriteRequestWrapper(w, r)
+		if !ok {
+			return
+		}
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID))
 
 		if len(contextSources) == 0 {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		err := contextSources[0].UpdateEntityAttributes(entityID, request)
+		members, attributeNames, err := decodeAttributeUpdate(request)
 		if err != nil {
-			errors.ReportNewInvalidRequest(w, "Unable to update entity attributes: "+err.Error())
+			errors.ReportNewBadRequestData(w, err.Error())
 			return
 		}
 
+		if len(attributeNames) == 0 {
+			errors.ReportNewBadRequestData(w, "The request payload contains no attributes.")
+			return
+		}
+
+		// Each source is only sent the attributes that it provides
+		updates := splitAttributeUpdate(contextSources, attributeNames)
+		result := executeAttributeUpdates(r.Context(), r, entityID, members, updates)
+
+		if len(result.Updated) > 0 && len(result.NotUpdated) > 0 {
+			// Only tell the callback about the attributes that were actually updated
+			body, _ := attributeSubset(members, result.Updated)
+			request = newRequestWrapperWithBody(r, body)
+		}
+
+		for _, update := range updates {
+			if len(result.Updated) == 0 {
+				break
+			}
+
+			entityType, err := update.source.GetProvidedTypeFromID(entityID)
+			if err == nil {
+				// Call the success callback with the type and ID of the updated entity and the request instance
+				onsuccess(entityType, entityID, request, sublogger)
+				break
+			}
+		}
+
+		if len(result.NotUpdated) > 0 {
+			bytes, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				errors.ReportNewInternalError(w, "Failed to encode response.")
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMultiStatus)
+			w.Write(bytes)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type AppendEntityAttributesCompletionCallback func(entityType, entityID string, request Request, logger zerolog.Logger)
+
+//NewAppendEntityAttributesHandler handles POST requests for NGSI entity attributes
+func NewAppendEntityAttributesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	noop := func(string, string, Request, zerolog.Logger) {}
+	return NewAppendEntityAttributesHandlerWithCallback(
+		ctxReg, log.With().Logger(), noop,
+	)
+}
+
+//NewAppendEntityAttributesHandlerWithCallback handles POST requests for NGSI entity
+//attributes and calls a callback on successful completion
+func NewAppendEntityAttributesHandlerWithCallback(
+	ctxReg ContextRegistry,
+	logger zerolog.Logger,
+	onsuccess AppendEntityAttributesCompletionCallback) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		sublogger := decorateLogger(r, logger)
+
+		params, found := findPathParams(w, r, "/entities/{entityId}/attrs")
+		if !found {
+			return
+		}
+		entityID := params[PathParamEntityID]
+
+		noOverwrite := false
+		for _, option := range strings.Split(r.URL.Query().Get("options"), ",") {
+			if option == "noOverwrite" {
+				noOverwrite = true
+			}
+		}
+
+		request, ok := newWriteRequestWrapper(w, r)
+		if !ok {
+			return
+		}
+
+		_, attributeNames, err := decodeAttributeUpdate(request)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID), attributeNames...)
+
+		if len(contextSources) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for _, source := range contextSources {
+			err := NewContextAwareSource(source).AppendEntityAttributesWithContext(r.Context(), entityID, noOverwrite, request)
+			if err != nil {
+				errors.ReportNewInvalidRequest(w, "Unable to append entity attributes: "+err.Error())
+				return
+			}
+		}
+
 		entityType, err := contextSources[0].GetProvidedTypeFromID(entityID)
 		if err == nil {
-			// Call the success callback with the type and ID of the updated entity and the request instance
 			onsuccess(entityType, entityID, request, sublogger)
 		}
 
@@ -180,6 +332,58 @@ func NewUpdateEntityAttributesHandlerWithCallback(
 	})
 }
 
+type DeleteEntityAttributeCompletionCallback func(entityType, entityID, attributeName string, request Request, logger zerolog.Logger)
+
+//NewDeleteEntityAttributeHandler handles DELETE requests for a single NGSI entity attribute
+func NewDeleteEntityAttributeHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	noop := func(string, string, string, Request, zerolog.Logger) {}
+	return NewDeleteEntityAttributeHandlerWithCallback(
+		ctxReg, log.With().Logger(), noop,
+	)
+}
+
+//NewDeleteEntityAttributeHandlerWithCallback handles DELETE requests for a single NGSI
+//entity attribute and calls a callback on successful completion
+func NewDeleteEntityAttributeHandlerWithCallback(
+	ctxReg ContextRegistry,
+	logger zerolog.Logger,
+	onsuccess DeleteEntityAttributeCompletionCallback) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		sublogger := decorateLogger(r, logger)
+
+		params, found := findPathParams(w, r, "/entities/{entityId}/attrs/{attrId}")
+		if !found {
+			return
+		}
+		entityID, attributeName := params[PathParamEntityID], params[PathParamAttributeName]
+
+		request := newRequestWrapper(r)
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID), attributeName)
+
+		if len(contextSources) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		for _, source := range contextSources {
+			err := NewContextAwareSource(source).DeleteEntityAttributeWithContext(r.Context(), entityID, attributeName, request)
+			if err != nil {
+				errors.ReportNewInvalidRequest(w, "Unable to delete entity attribute: "+err.Error())
+				return
+			}
+		}
+
+		entityType, err := contextSources[0].GetProvidedTypeFromID(entityID)
+		if err == nil {
+			onsuccess(entityType, entityID, attributeName, request, sublogger)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 type CreateEntityCompletionCallback func(entityType, entityID string, request Request, logger zerolog.Logger)
 
 //NewCreateEntityHandler handles incoming POST requests for NGSI entities
@@ -188,16 +392,36 @@ func NewCreateEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	return NewCreateEntityHandlerWithCallback(ctxReg, log.With().Logger(), noop)
 }
 
+//NewCreateEntityHandlerWithCallback handles incoming POST requests for NGSI entities and calls
+//a callback on successful completion. Entities are created in the best effort mode.
 func NewCreateEntityHandlerWithCallback(
 	ctxReg ContextRegistry,
 	logger zerolog.Logger,
 	onsuccess CreateEntityCompletionCallback) http.HandlerFunc {
 
+	return NewCreateEntityHandlerWithMode(ctxReg, CreateModeBestEffort, logger, onsuccess)
+}
+
+//NewCreateEntityHandlerWithMode handles incoming POST requests for NGSI entities, using the
+//supplied mode when the entity should be created in more than one context source, and calls
+//a callback on successful completion
+func NewCreateEntityHandlerWithMode(
+	ctxReg ContextRegistry,
+	mode CreateMode,
+	logger zerolog.Logger,
+	onsuccess CreateEntityCompletionCallback,
+	options ...HandlerOption) http.HandlerFunc {
+
+	opts := newHandlerOptions(options)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		sublogger := decorateLogger(r, logger)
 
-		request := newRequestWrapper(r)
+		request, ok := newWriteRequestWrapper(w, r)
+		if !ok {
+			return
+		}
 
 		entity := &types.BaseEntity{}
 		err := request.DecodeBodyInto(entity)
@@ -209,7 +433,7 @@ func NewCreateEntityHandlerWithCallback(
 			return
 		}
 
-		contextSources := ctxReg.GetContextSourcesForEntityType(entity.Type)
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntityType(entity.Type))
 
 		if len(contextSources) == 0 {
 			errors.ReportNewInvalidRequest(
@@ -219,12 +443,15 @@ func NewCreateEntityHandlerWithCallback(
 			return
 		}
 
-		for _, source := range contextSources {
-			err := source.CreateEntity(entity.Type, entity.ID, request)
-			if err != nil {
-				errors.ReportNewInvalidRequest(w, "Failed to create entity: "+err.Error())
-				return
+		outcomes, err := createEntityInSources(r.Context(), mode, opts.compensationTimeout, contextSources, entity.Type, entity.ID, request)
+		if err != nil {
+			problem := &errors.NewInvalidRequest("Failed to create entity: " + err.Error()).ProblemDetailsImpl
+			if compensationFailed(outcomes) {
+				problem = &errors.NewInternalError("Failed to create entity and to undo it: " + err.Error()).ProblemDetailsImpl
 			}
+			problem.AddExtensionMember("contextSources", outcomes)
+			problem.WriteResponse(w)
+			return
 		}
 
 		onsuccess(entity.Type, entity.ID, request, sublogger)
@@ -233,57 +460,125 @@ func NewCreateEntityHandlerWithCallback(
 	})
 }
 
-//NewRetrieveEntityHandler retrieves entity by ID.
+//NewRetrieveEntityHandler retrieves entity by ID. All the matching context sources are asked
+//for the entity, and the fragments that they return are merged into one entity.
 func NewRetrieveEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: A more elegant way to select the response content type ...
-		responseContentType, entityConverter, _ := getEntityConverterFromRequest(r)
-
-		entitiesIdx := strings.Index(r.URL.Path, "/entities/")
-
-		if entitiesIdx == -1 {
-			errors.ReportNewBadRequestData(
-				w,
-				"The supplied URL is invalid.",
-			)
+		representation, ok := newEntityRepresentation(r)
+		if !ok {
+			reportNotAcceptable(w)
 			return
 		}
 
-		entityID := r.URL.Path[entitiesIdx+10 : len(r.URL.Path)]
+		params, found := findPathParams(w, r, "/entities/{entityId}")
+		if !found {
+			return
+		}
+		entityID := params[PathParamEntityID]
 
-		contextSources := ctxReg.GetContextSourcesForEntity(entityID)
+		contextSources, auxiliarySources := sourcesForReading(ctxReg.GetContextSourcesForEntity(entityID))
 
-		if len(contextSources) == 0 {
+		if len(contextSources) == 0 && len(auxiliarySources) == 0 {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
 		request := newRequestWrapper(r)
 
-		var entity Entity
-		var err error
+		// Auxiliary sources are only asked when none of the other sources return the entity
+		fragments, warnings, err := retrieveEntityFragments(r.Context(), contextSources, entityID, request)
+		if len(fragments) == 0 {
+			var auxWarnings []string
+			var auxErr error
+			fragments, auxWarnings, auxErr = retrieveEntityFragments(r.Context(), auxiliarySources, entityID, request)
+			warnings = append(warnings, auxWarnings...)
+			if err == nil {
+				err = auxErr
+			}
+		}
 
-		for _, source := range contextSources {
-			entity, err = source.RetrieveEntity(entityID, request)
+		if len(fragments) == 0 {
 			if err != nil {
 				errors.ReportNewInvalidRequest(w, "Failed to find entity: "+err.Error())
 				return
 			}
-			break
-		}
 
-		if entity == nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		bytes, _ := json.Marshal(entityConverter(entity))
+		entity, err := mergeEntityFragments(fragments)
+		if err != nil {
+			errors.ReportNewInternalError(w, "Failed to merge entity fragments: "+err.Error())
+			return
+		}
+
+		// Let the client know about the sources that could not be asked for their part of the entity
+		for _, warning := range warnings {
+			w.Header().Add(WarningHeader, warning)
+		}
 
-		w.Header().Add("Content-Type", responseContentType)
+		bytes, _ := json.Marshal(representation.convert(entity))
+
+		representation.writeHeaders(w)
 		w.Write(bytes)
 	})
 }
 
+type DeleteEntityCompletionCallback func(entityType, entityID string, request Request, logger zerolog.Logger)
+
+//NewDeleteEntityHandler handles incoming DELETE requests for NGSI entities
+func NewDeleteEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	noop := func(string, string, Request, zerolog.Logger) {}
+	return NewDeleteEntityHandlerWithCallback(ctxReg, log.With().Logger(), noop)
+}
+
+//NewDeleteEntityHandlerWithCallback handles incoming DELETE requests for NGSI entities
+//and calls a callback on successful completion
+func NewDeleteEntityHandlerWithCallback(
+	ctxReg ContextRegistry,
+	logger zerolog.Logger,
+	onsuccess DeleteEntityCompletionCallback) http.HandlerFunc {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		sublogger := decorateLogger(r, logger)
+
+		params, found := findPathParams(w, r, "/entities/{entityId}")
+		if !found {
+			return
+		}
+		entityID := params[PathParamEntityID]
+
+		contextSources := sourcesForWriting(ctxReg.GetContextSourcesForEntity(entityID))
+
+		if len(contextSources) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		request := newRequestWrapper(r)
+
+		// Grab the entity type before the entity is deleted, as the source
+		// may not be able to tell us afterwards
+		entityType, typeErr := contextSources[0].GetProvidedTypeFromID(entityID)
+
+		for _, source := range contextSources {
+			err := NewContextAwareSource(source).DeleteEntityWithContext(r.Context(), entityID, request)
+			if err != nil {
+				errors.ReportNewInvalidRequest(w, "Failed to delete entity: "+err.Error())
+				return
+			}
+		}
+
+		if typeErr == nil {
+			onsuccess(entityType, entityID, request, sublogger)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
 //decorateLogger looks for b3 trace headers and adds them to the logger if found
 func decorateLogger(r *http.Request, logger zerolog.Logger) zerolog.Logger {
 	traceHeaders := []string{
@@ -2,6 +2,7 @@ package ngsi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,11 +12,13 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
 	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
 	"github.com/matryer/is"
+	"github.com/rs/zerolog"
 )
 
 func createURL(path string, params ...string) string {
@@ -123,6 +126,7 @@ func TestCreateEntityWorksForTrafficFlowObserved(t *testing.T) {
 	typeName := tfo.Type
 
 	req, _ := http.NewRequest("POST", createURL("/entities"), byteReader)
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	ctxReg, ctxSrc := newContextRegistryWithSourceForType(typeName)
@@ -142,6 +146,7 @@ func TestCreateEntityUsesCorrectTypeAndID(t *testing.T) {
 	entityID := fiware.DeviceIDPrefix + "livboj"
 	byteReader, typeName := newEntityAsByteBuffer(entityID)
 	req, _ := http.NewRequest("POST", createURL("/entities"), byteReader)
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	ctxReg, ctxSrc := newContextRegistryWithSourceForType(typeName)
@@ -160,6 +165,7 @@ func TestThatProblemsAreReportedWithCorrectContentType(t *testing.T) {
 	is := is.New(t)
 	byteBuffer, _ := newEntityAsByteBuffer("id")
 	req, _ := http.NewRequest("POST", createURL("/entities"), byteBuffer)
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	NewCreateEntityHandler(NewContextRegistry()).ServeHTTP(w, req)
@@ -179,6 +185,7 @@ func TestCreateEntityFailsWithNoContextSources(t *testing.T) {
 	is := is.New(t)
 	byteBuffer, _ := newEntityAsByteBuffer("id")
 	req, _ := http.NewRequest("POST", createURL("/entities"), byteBuffer)
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	NewCreateEntityHandler(NewContextRegistry()).ServeHTTP(w, req)
@@ -190,6 +197,7 @@ func TestCreateEntityHandlesFailureFromContextSource(t *testing.T) {
 	is := is.New(t)
 	byteBuffer, typeName := newEntityAsByteBuffer("id")
 	req, _ := http.NewRequest("POST", createURL("/entities"), byteBuffer)
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 
 	ctxReg, ctxSrc := newContextRegistryWithSourceForType(typeName)
@@ -200,6 +208,108 @@ func TestCreateEntityHandlesFailureFromContextSource(t *testing.T) {
 	is.Equal(w.Code, http.StatusBadRequest) // wrong response code when create entity fails.
 }
 
+func TestThatCreatedEntitiesAreRemovedWhenALaterSourceFails(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 3)
+	sources[2].CreateEntityFunc = func(string, string, Request) error { return errors.New("failure") }
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	newCoordinatedCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	problem := createProblem{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	is.Equal(w.Code, http.StatusBadRequest)                                      // unexpected response code
+	is.Equal(problem.Type, "https://uri.etsi.org/ngsi-ld/errors/InvalidRequest") // unexpected problem type
+	is.Equal(problem.Detail, "Failed to create entity: failure")                 // unexpected problem detail
+	is.Equal(len(problem.ContextSources), 3)                                     // the outcome in every source should be reported
+	is.Equal(problem.ContextSources[0].ContextSource, "context source 0")        // unexpected context source name
+	is.Equal(problem.ContextSources[0].Status, "removed")                        // the entity should have been removed again
+	is.Equal(problem.ContextSources[1].Status, "removed")                        // the entity should have been removed again
+	is.Equal(problem.ContextSources[2].Status, "failed")                         // the failing source should be reported
+	is.Equal(problem.ContextSources[2].Reason, "failure")                        // unexpected reason
+
+	for _, source := range sources[:2] {
+		is.Equal(len(source.DeleteEntityCalls()), 1) // the created entity should have been removed again
+
+		deleteRequest := source.DeleteEntityCalls()[0].Request.Request()
+		is.Equal(deleteRequest.Method, http.MethodDelete)                                    // the compensation should be a delete request
+		is.Equal(deleteRequest.URL.Path, "/ngsi-ld/v1/entities/urn:ngsi-ld:Device:mydevice") // unexpected compensation path
+
+		_, hasDeadline := deleteRequest.Context().Deadline()
+		is.True(hasDeadline) // the compensation should not be allowed to run forever
+	}
+	is.Equal(len(sources[2].DeleteEntityCalls()), 0) // the failing source should not be asked to delete the entity
+}
+
+func TestThatFailedCompensationsAreReported(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 2)
+	sources[0].DeleteEntityFunc = func(string, Request) error { return errors.New("gone") }
+	sources[1].CreateEntityFunc = func(string, string, Request) error { return errors.New("failure") }
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	newCoordinatedCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	problem := createProblem{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	is.Equal(problem.Type, "https://uri.etsi.org/ngsi-ld/errors/InternalError") // unexpected problem type
+	is.Equal(problem.Detail, "Failed to create entity and to undo it: failure") // unexpected problem detail
+	is.Equal(len(problem.ContextSources), 2)                                    // the outcome in every source should be reported
+	is.Equal(problem.ContextSources[0].Status, "notRemoved")                    // the failed compensation should be reported
+	is.Equal(problem.ContextSources[0].Reason, "gone")                          // unexpected reason
+	is.Equal(problem.ContextSources[1].Status, "failed")                        // the failing source should be reported
+}
+
+func TestThatTheCompensationTimeoutCanBeChanged(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 2)
+	sources[1].CreateEntityFunc = func(string, string, Request) error { return errors.New("failure") }
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	noop := func(string, string, Request, zerolog.Logger) {}
+	NewCreateEntityHandlerWithMode(ctxReg, CreateModeCoordinated, zerolog.Nop(), noop, WithCompensationTimeout(time.Hour)).ServeHTTP(w, req)
+
+	is.Equal(len(sources[0].DeleteEntityCalls()), 1) // the created entity should have been removed again
+
+	deadline, hasDeadline := sources[0].DeleteEntityCalls()[0].Request.Request().Context().Deadline()
+	is.True(hasDeadline)                                       // the compensation should have a deadline
+	is.True(time.Until(deadline) > defaultCompensationTimeout) // the compensation timeout option should be used
+}
+
+func TestThatCreatesAreBestEffortByDefault(t *testing.T) {
+	is := is.New(t)
+
+	ctxReg, sources := newContextRegistryWithCreatingSources("Device", 3)
+	sources[1].CreateEntityFunc = func(string, string, Request) error { return errors.New("failure") }
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:Device:mydevice","type":"Device"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	problem := createProblem{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	is.Equal(w.Code, http.StatusBadRequest)                      // unexpected response code
+	is.Equal(problem.Detail, "Failed to create entity: failure") // unexpected problem detail
+	is.Equal(len(problem.ContextSources), 3)                     // the outcome in every source should be reported
+	is.Equal(problem.ContextSources[0].Status, "created")        // best effort creates should not be compensated
+	is.Equal(problem.ContextSources[2].Status, "notAttempted")   // no more sources should be tried after a failure
+	is.Equal(len(sources[0].DeleteEntityCalls()), 0)             // best effort creates should not be compensated
+	is.Equal(len(sources[2].CreateEntityCalls()), 0)             // no more sources should be tried after a failure
+}
+
 func TestGetEntitiesWithoutAttributesOrTypesFails(t *testing.T) {
 	is := is.New(t)
 	req, _ := http.NewRequest("GET", createURL("/entities"), nil)
@@ -246,6 +356,18 @@ func TestGetEntitiesForDevice(t *testing.T) {
 	is.Equal(w.Code, http.StatusOK) // unexpected response code
 }
 
+func TestGetEntitiesWithInvalidQueryReturnsBadRequest(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=Device", "q=temperature%3E%3E5"), nil)
+	w := httptest.NewRecorder()
+
+	NewQueryEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)                      // unexpected response code
+	is.True(strings.Contains(w.Body.String(), "at position 12")) // problem detail should contain the error position
+}
+
 func TestGetEntitiesWithGeoQueryNearPoint(t *testing.T) {
 	is := is.New(t)
 
@@ -305,6 +427,197 @@ func TestGetEntitiesWithGeoQueryWithinRect(t *testing.T) {
 	is.Equal(w.Code, http.StatusOK) // unexpected response code
 }
 
+func TestQueryEntitiesAddsPaginationLinks(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "limit=2", "offset=2"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 5))
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	is.Equal(len(entities), 2)                                                                              // unexpected number of entities returned
+	is.Equal(entities[0]["id"], "urn:ngsi-ld:RoadSegment:2")                                                // unexpected first entity in page
+	is.Equal(w.Header().Get(ResultsCountHeader), "")                                                        // count should not be reported unless requested
+	is.Equal(len(w.Header()["Link"]), 2)                                                                    // expected both a prev and a next link
+	is.Equal(w.Header()["Link"][0], `</ngsi-ld/v1/entities?limit=2&offset=0&type=RoadSegment>; rel="prev"`) // bad prev link
+	is.Equal(w.Header()["Link"][1], `</ngsi-ld/v1/entities?limit=2&offset=4&type=RoadSegment>; rel="next"`) // bad next link
+}
+
+func TestQueryEntitiesOmitsNextLinkOnLastPage(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "limit=2", "offset=4"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 5))
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                                                                         // unexpected response code
+	is.Equal(len(w.Header()["Link"]), 1)                                                                    // expected only a prev link
+	is.Equal(w.Header()["Link"][0], `</ngsi-ld/v1/entities?limit=2&offset=2&type=RoadSegment>; rel="prev"`) // bad prev link
+}
+
+func TestQueryEntitiesPaginatesAcrossContextSources(t *testing.T) {
+	is := is.New(t)
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 3))
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 3, 0))
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 3, 4))
+
+	entityIDs := []string{}
+
+	for offset := 0; offset < 9; offset += 2 {
+		req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "limit=2", fmt.Sprintf("offset=%d", offset)), nil)
+		w := httptest.NewRecorder()
+
+		NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+		is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+		entities := []map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &entities)
+		for _, entity := range entities {
+			entityIDs = append(entityIDs, entity["id"].(string))
+		}
+	}
+
+	is.Equal(len(entityIDs), 7) // every entity should be returned exactly once
+	for idx, id := range entityIDs {
+		is.Equal(id, fmt.Sprintf("urn:ngsi-ld:RoadSegment:%d", idx)) // entities returned out of order
+	}
+}
+
+func TestQueryEntitiesReportsResultsCount(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "limit=2", "count=true"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 5))
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                   // unexpected response code
+	is.Equal(w.Header().Get(ResultsCountHeader), "5") // unexpected results count
+}
+
+func TestQueryEntitiesWithZeroLimitOnlyReturnsCount(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "limit=0", "count=true"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 5))
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                   // unexpected response code
+	is.Equal(w.Header().Get(ResultsCountHeader), "5") // unexpected results count
+	is.Equal(w.Body.String(), "[]")                   // no entities should be returned when limit is 0
+	is.Equal(len(w.Header()["Link"]), 0)              // no links should be returned when limit is 0
+}
+
+func TestQueryEntitiesWithZeroLimitAndNoCountReturnsBadRequest(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "limit=0"), nil)
+	w := httptest.NewRecorder()
+
+	NewQueryEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // limit=0 without count=true should be rejected
+}
+
+func TestQueryEntitiesFailsWhenAContextSourceFails(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 2))
+	contextRegistry.Register(newFailingContextSource("RoadSegment"))
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.True(w.Code != http.StatusOK)                            // the request should fail
+	is.True(strings.Contains(w.Body.String(), "InternalError")) // expected an internal error
+}
+
+func TestQueryEntitiesWithPartialResultsReportsFailingSources(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment", "count=true"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newFailingContextSource("RoadSegment"))
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 2))
+
+	NewQueryEntitiesHandler(contextRegistry, WithPartialResults()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	is.Equal(len(entities), 2)                                           // entities from the working source should be returned
+	is.Equal(w.Header().Get(ResultsCountHeader), "2")                    // unexpected results count
+	is.Equal(len(w.Header().Values(WarningHeader)), 1)                   // expected a warning about the failing source
+	is.True(strings.Contains(w.Header().Get(WarningHeader), "source 0")) // warning should identify the failing source
+}
+
+func TestQueryEntitiesWithPartialResultsSkipsSlowSources(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=RoadSegment"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	slowSource := newPaginatingContextSource("RoadSegment", 10, 2)
+	slowSource.GetEntitiesFunc = func(query Query, callback QueryEntitiesCallback) error {
+		<-release
+		return nil
+	}
+
+	contextRegistry.Register(newPaginatingContextSource("RoadSegment", 0, 2))
+	contextRegistry.Register(slowSource)
+
+	handler := NewQueryEntitiesHandler(contextRegistry, WithSourceTimeout(20*time.Millisecond), WithPartialResults())
+	handler.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	is.Equal(len(entities), 2)                                          // entities from the fast source should be returned
+	is.True(strings.Contains(w.Header().Get(WarningHeader), "in time")) // expected a warning about the slow source
+}
+
+func TestContextAwareAdapterChecksTheContext(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newPaginatingContextSource("RoadSegment", 0, 5)
+	source := NewContextAwareSource(contextSource)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := source.GetEntitiesWithContext(ctx, newTestQuery(is, "RoadSegment", "", ""), func(e Entity) error {
+		return nil
+	})
+
+	is.Equal(err, context.Canceled)                    // expected the context error to be returned
+	is.Equal(len(contextSource.GetEntitiesCalls()), 0) // the source should not be called with a cancelled context
+}
+
 func TestRetrieveEntity(t *testing.T) {
 	is := is.New(t)
 	deviceID := fiware.DeviceIDPrefix + "mydevice"
@@ -351,6 +664,7 @@ func TestUpdateEntitityAttributes(t *testing.T) {
 	jsonBytes, _ := json.Marshal(e("testvalue"))
 
 	req, _ := http.NewRequest("PATCH", createURL("/entities/"+deviceID+"/attrs/"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
 	w := httptest.NewRecorder()
 	contextRegistry := NewContextRegistry()
 	contextSource := newMockedContextSource("", "value")
@@ -362,6 +676,234 @@ func TestUpdateEntitityAttributes(t *testing.T) {
 	contextRegistry.Register(contextSource)
 
 	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent) // unexpected response code
+}
+
+func TestThatAttributeUpdatesAreSplitAcrossSources(t *testing.T) {
+	is := is.New(t)
+
+	bodies := map[string]string{}
+	newSource := func(attributeName string) *ContextSourceMock {
+		source := newMockedContextSource("Device", attributeName)
+		source.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+		source.UpdateEntityAttributesFunc = func(entityID string, req Request) error {
+			body, _ := io.ReadAll(req.BodyReader())
+			bodies[attributeName] = string(body)
+			return nil
+		}
+		return source
+	}
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newSource("value"))
+	contextRegistry.Register(newSource("batteryLevel"))
+
+	body := `{"@context":"https://schema.lab.fiware.org/ld/context","value":{"type":"Property","value":"on"},"batteryLevel":{"type":"Property","value":0.5}}`
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent) // unexpected response code
+	is.Equal(bodies["value"], `{"@context":"https://schema.lab.fiware.org/ld/context","value":{"type":"Property","value":"on"}}`)
+	is.Equal(bodies["batteryLevel"], `{"@context":"https://schema.lab.fiware.org/ld/context","batteryLevel":{"type":"Property","value":0.5}}`)
+}
+
+func TestThatPartiallyFailedAttributeUpdatesReturnAnUpdateResult(t *testing.T) {
+	is := is.New(t)
+
+	working := newMockedContextSource("Device", "value")
+	working.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	working.UpdateEntityAttributesFunc = func(string, Request) error { return nil }
+
+	failing := newMockedContextSource("Device", "batteryLevel")
+	failing.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	failing.UpdateEntityAttributesFunc = func(string, Request) error { return errors.New("this source is out of order") }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(working)
+	contextRegistry.Register(failing)
+
+	body := `{"value":{"type":"Property","value":"on"},"batteryLevel":{"type":"Property","value":0.5},"unknown":{"type":"Property","value":1}}`
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	result := UpdateResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	is.Equal(w.Code, http.StatusMultiStatus)                     // unexpected response code
+	is.Equal(result.Updated, []string{"unknown", "value"})       // an attribute that no source claims is updated if any source accepts it
+	is.Equal(len(result.NotUpdated), 1)                          // expected one attribute that was not updated
+	is.Equal(result.NotUpdated[0].AttributeName, "batteryLevel") // the attribute of the failing source should not be updated
+	is.Equal(result.NotUpdated[0].Reason, "this source is out of order")
+}
+
+func TestThatPartialUpdatesOfRemoteSourcesAreReported(t *testing.T) {
+	is := is.New(t)
+
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`{"updated":["snowHeight"],"notUpdated":[{"attributeName":"temperature","reason":"read only"}]}`))
+	}))
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight", "temperature"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration, WithEntityTypesFromIDs())
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	body := `{"snowHeight":{"type":"Property","value":1},"temperature":{"type":"Property","value":2}}`
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:WeatherObserved:1/attrs/"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	result := UpdateResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	is.Equal(w.Code, http.StatusMultiStatus)                    // unexpected response code
+	is.Equal(result.Updated, []string{"snowHeight"})            // the attribute that the remote source updated should be reported
+	is.Equal(result.NotUpdated[0].AttributeName, "temperature") // the attribute that the remote source did not update should be reported
+	is.Equal(result.NotUpdated[0].Reason, "read only")          // the reason should be passed on
+}
+
+func TestThatAttributeUpdatesThatAllFailReturnAnUpdateResult(t *testing.T) {
+	is := is.New(t)
+
+	called := false
+	failing := newMockedContextSource("Device", "value")
+	failing.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	failing.UpdateEntityAttributesFunc = func(string, Request) error { return errors.New("this source is out of order") }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(failing)
+
+	body := `{"value":{"type":"Property","value":"on"}}`
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandlerWithCallback(contextRegistry, zerolog.Nop(), func(string, string, Request, zerolog.Logger) {
+		called = true
+	}).ServeHTTP(w, req)
+
+	result := UpdateResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	is.Equal(w.Code, http.StatusMultiStatus)              // unexpected response code
+	is.Equal(len(result.Updated), 0)                      // nothing should have been updated
+	is.Equal(result.NotUpdated[0].AttributeName, "value") // the attribute should be reported as not updated
+	is.True(!called)                                      // the callback should not be called when nothing was updated
+}
+
+func TestAppendEntityAttributes(t *testing.T) {
+	is := is.New(t)
+
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	jsonBytes, _ := json.Marshal(e("testvalue"))
+
+	req, _ := http.NewRequest("POST", createURL("/entities/"+deviceID+"/attrs", "options=noOverwrite"), bytes.NewBuffer(jsonBytes))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("Device", "value")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.AppendEntityAttributesFunc = func(entityID string, noOverwrite bool, req Request) error {
+		is.Equal(entityID, deviceID) // appended entity did not match expectations
+		is.True(noOverwrite)         // noOverwrite option was not passed on to the context source
+		return nil
+	}
+	contextRegistry.Register(contextSource)
+
+	NewAppendEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(len(contextSource.AppendEntityAttributesCalls()), 1) // append should have been called once
+	is.Equal(w.Code, http.StatusNoContent)                        // unexpected response code
+}
+
+func TestDeleteEntityAttribute(t *testing.T) {
+	is := is.New(t)
+
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	req, _ := http.NewRequest("DELETE", createURL("/entities/"+deviceID+"/attrs/snowHeight"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("Device", "snowHeight")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.DeleteEntityAttributeFunc = func(entityID, attributeName string, req Request) error {
+		is.Equal(entityID, deviceID)          // entity id did not match expectations
+		is.Equal(attributeName, "snowHeight") // attribute name did not match expectations
+		return nil
+	}
+	contextRegistry.Register(contextSource)
+
+	NewDeleteEntityAttributeHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(len(contextSource.DeleteEntityAttributeCalls()), 1) // delete attribute should have been called once
+	is.Equal(w.Code, http.StatusNoContent)                       // unexpected response code
+}
+
+func TestDeleteEntityAttributeReturnsNotFoundWhenNoSourceMatches(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("DELETE", createURL("/entities/urn:ngsi-ld:Device:unknown/attrs/snowHeight"), nil)
+	w := httptest.NewRecorder()
+
+	NewDeleteEntityAttributeHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound) // unexpected response code
+}
+
+func TestDeleteEntity(t *testing.T) {
+	is := is.New(t)
+
+	deviceID := fiware.DeviceIDPrefix + "mydevice"
+	req, _ := http.NewRequest("DELETE", createURL("/entities/"+deviceID), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("Device", "")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.DeleteEntityFunc = func(entityID string, req Request) error {
+		is.Equal(entityID, deviceID) // deleted entity did not match expectations
+		return nil
+	}
+	contextRegistry.Register(contextSource)
+
+	NewDeleteEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(len(contextSource.DeleteEntityCalls()), 1) // delete entity should have been called once
+	is.Equal(w.Code, http.StatusNoContent)              // unexpected response code
+}
+
+func TestDeleteEntityReturnsNotFoundWhenNoSourceMatches(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("DELETE", createURL("/entities/urn:ngsi-ld:Device:unknown"), nil)
+	w := httptest.NewRecorder()
+
+	NewDeleteEntityHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound) // unexpected response code
+}
+
+func TestDeleteEntityHandlesFailureFromContextSource(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("DELETE", createURL("/entities/urn:ngsi-ld:Device:mydevice"), nil)
+	w := httptest.NewRecorder()
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("Device", "")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.DeleteEntityFunc = func(string, Request) error { return errors.New("failure") }
+	contextRegistry.Register(contextSource)
+
+	NewDeleteEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // wrong response code when delete entity fails
 }
 
 type mockEntity struct {
@@ -392,6 +934,36 @@ func newEntityAsByteBuffer(entityID string) (io.Reader, string) {
 	return bytes.NewBuffer(jsonBytes), device.Type
 }
 
+type createProblem struct {
+	Type           string `json:"type"`
+	Detail         string `json:"detail"`
+	ContextSources []struct {
+		ContextSource string `json:"contextSource"`
+		Status        string `json:"status"`
+		Reason        string `json:"reason"`
+	} `json:"contextSources"`
+}
+
+func newCoordinatedCreateEntityHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	noop := func(string, string, Request, zerolog.Logger) {}
+	return NewCreateEntityHandlerWithMode(ctxReg, CreateModeCoordinated, zerolog.Nop(), noop)
+}
+
+func newContextRegistryWithCreatingSources(typeName string, count int) (ContextRegistry, []*ContextSourceMock) {
+	contextRegistry := NewContextRegistry()
+	sources := []*ContextSourceMock{}
+
+	for i := 0; i < count; i++ {
+		source := newMockedContextSource(typeName, "")
+		source.CreateEntityFunc = func(string, string, Request) error { return nil }
+		source.DeleteEntityFunc = func(string, Request) error { return nil }
+		contextRegistry.Register(source)
+		sources = append(sources, source)
+	}
+
+	return contextRegistry, sources
+}
+
 func newMockedContextSource(typeName string, attributeName string, e ...mockEntity) *ContextSourceMock {
 
 	source := &ContextSourceMock{
@@ -412,3 +984,189 @@ func newMockedContextSource(typeName string, attributeName string, e ...mockEnti
 
 	return source
 }
+
+//newPaginatingContextSource creates a mocked context source that holds the entities with
+//the numbers firstEntity up to firstEntity+numEntities and honours the pagination offset
+//and limit of the queries that it receives
+func newPaginatingContextSource(typeName string, firstEntity, numEntities int) *ContextSourceMock {
+	source := newMockedContextSource(typeName, "")
+	source.GetEntitiesFunc = func(query Query, callback QueryEntitiesCallback) error {
+		for i := query.PaginationOffset(); i < uint64(numEntities) && i < query.PaginationOffset()+query.PaginationLimit(); i++ {
+			callback(map[string]interface{}{
+				"id":   fmt.Sprintf("urn:ngsi-ld:%s:%d", typeName, firstEntity+int(i)),
+				"type": typeName,
+			})
+		}
+		return nil
+	}
+	return source
+}
+
+func newFailingContextSource(typeName string) *ContextSourceMock {
+	source := newMockedContextSource(typeName, "")
+	source.GetEntitiesFunc = func(query Query, callback QueryEntitiesCallback) error {
+		return errors.New("this source is out of order")
+	}
+	return source
+}
+
+func TestThatExclusiveSourcesOwnTheirEntities(t *testing.T) {
+	is := is.New(t)
+
+	inclusive := newModalContextSource(ModeInclusive)
+	exclusive := newModalContextSource(ModeExclusive)
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(inclusive)
+	contextRegistry.Register(exclusive)
+
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/"), strings.NewReader(`{"value":"on"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                    // unexpected response code
+	is.Equal(len(exclusive.UpdateEntityAttributesCalls()), 1) // the exclusive source should be updated
+	is.Equal(len(inclusive.UpdateEntityAttributesCalls()), 0) // no other source should be updated
+}
+
+func TestThatExclusiveSourcesOnlyOwnTheAttributesTheyRegister(t *testing.T) {
+	is := is.New(t)
+
+	inclusive := newModalContextSource(ModeInclusive)
+	inclusive.DeleteEntityAttributeFunc = func(string, string, Request) error { return nil }
+	inclusive.RetrieveEntityFunc = func(string, Request) (Entity, error) {
+		return map[string]interface{}{
+			"id":          "urn:ngsi-ld:Device:mydevice",
+			"type":        "Device",
+			"value":       map[string]interface{}{"type": "Property", "value": "on"},
+			"temperature": map[string]interface{}{"type": "Property", "value": 1.0},
+		}, nil
+	}
+
+	exclusive := &attributeRegisteringSource{modalContextSource: newModalContextSource(ModeExclusive), attributes: []string{"temperature"}}
+	exclusive.ProvidesAttributeFunc = func(name string) bool { return name == "temperature" }
+	exclusive.DeleteEntityAttributeFunc = func(string, string, Request) error { return nil }
+	exclusive.RetrieveEntityFunc = func(string, Request) (Entity, error) {
+		return map[string]interface{}{
+			"id":          "urn:ngsi-ld:Device:mydevice",
+			"type":        "Device",
+			"temperature": map[string]interface{}{"type": "Property", "value": 2.0},
+		}, nil
+	}
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(inclusive)
+	contextRegistry.Register(exclusive)
+
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:mydevice"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	entity := map[string]map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	is.Equal(w.Code, http.StatusOK)                      // unexpected response code
+	is.Equal(entity["value"]["value"], "on")             // the attributes of the inclusive source should be kept
+	is.Equal(entity["temperature"]["value"], float64(2)) // the exclusive source should own its attribute
+
+	req, _ = http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/"), strings.NewReader(`{"value":"off","temperature":3}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w = httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent) // unexpected response code
+
+	inclusiveBody, _ := io.ReadAll(inclusive.UpdateEntityAttributesCalls()[0].Request.BodyReader())
+	exclusiveBody, _ := io.ReadAll(exclusive.UpdateEntityAttributesCalls()[0].Request.BodyReader())
+	is.Equal(string(inclusiveBody), `{"value":"off"}`)   // the inclusive source should not be sent the claimed attribute
+	is.Equal(string(exclusiveBody), `{"temperature":3}`) // the exclusive source should only be sent its own attribute
+
+	req, _ = http.NewRequest("DELETE", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/value"), nil)
+	w = httptest.NewRecorder()
+	NewDeleteEntityAttributeHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                   // unexpected response code
+	is.Equal(len(inclusive.DeleteEntityAttributeCalls()), 1) // attributes that are not claimed should be deleted from the inclusive source
+	is.Equal(len(exclusive.DeleteEntityAttributeCalls()), 0) // the exclusive source should not be asked to delete attributes it does not own
+}
+
+type attributeRegisteringSource struct {
+	*modalContextSource
+	attributes []string
+}
+
+func (ars *attributeRegisteringSource) ProvidedTypes() []string {
+	return []string{"Device"}
+}
+
+func (ars *attributeRegisteringSource) ProvidedAttributes() []string {
+	return ars.attributes
+}
+
+func TestThatAuxiliarySourcesAreNotWrittenTo(t *testing.T) {
+	is := is.New(t)
+
+	inclusive := newModalContextSource(ModeInclusive)
+	redirect := newModalContextSource(ModeRedirect)
+	auxiliary := newModalContextSource(ModeAuxiliary)
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(auxiliary)
+	contextRegistry.Register(inclusive)
+	contextRegistry.Register(redirect)
+
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs/"), strings.NewReader(`{"value":"on"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewUpdateEntityAttributesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                    // unexpected response code
+	is.Equal(len(inclusive.UpdateEntityAttributesCalls()), 1) // inclusive sources should be updated
+	is.Equal(len(redirect.UpdateEntityAttributesCalls()), 1)  // redirect sources should be updated
+	is.Equal(len(auxiliary.UpdateEntityAttributesCalls()), 0) // auxiliary sources should never be updated
+}
+
+func TestThatAuxiliarySourcesAreReadWhenNoOtherSourceAnswers(t *testing.T) {
+	is := is.New(t)
+
+	inclusive := newModalContextSource(ModeInclusive)
+	inclusive.RetrieveEntityFunc = func(string, Request) (Entity, error) { return nil, nil }
+	auxiliary := newModalContextSource(ModeAuxiliary)
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(auxiliary)
+	contextRegistry.Register(inclusive)
+
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:mydevice"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                   // the entity should be found in the auxiliary source
+	is.Equal(len(inclusive.RetrieveEntityCalls()), 1) // the inclusive source should be asked first
+	is.Equal(len(auxiliary.RetrieveEntityCalls()), 1) // the auxiliary source should be asked when the entity was not found
+
+	inclusive.RetrieveEntityFunc = func(string, Request) (Entity, error) { return &mockEntity{}, nil }
+
+	w = httptest.NewRecorder()
+	NewRetrieveEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                   // the entity should be found in the inclusive source
+	is.Equal(len(auxiliary.RetrieveEntityCalls()), 1) // the auxiliary source should not be asked again
+}
+
+type modalContextSource struct {
+	*ContextSourceMock
+	mode RegistrationMode
+}
+
+func (mcs *modalContextSource) RegistrationMode() RegistrationMode {
+	return mcs.mode
+}
+
+func newModalContextSource(mode RegistrationMode) *modalContextSource {
+	source := newMockedContextSource("Device", "value")
+	source.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	source.UpdateEntityAttributesFunc = func(string, Request) error { return nil }
+	return &modalContextSource{ContextSourceMock: source, mode: mode}
+}
@@ -0,0 +1,135 @@
+package ngsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//CreateMode decides how an entity is created when more than one context source should store it
+type CreateMode string
+
+const (
+	//CreateModeCoordinated creates the entity in one source at a time. If a source fails, the
+	//entity is deleted again from the sources that had already created it.
+	CreateModeCoordinated CreateMode = "coordinated"
+	//CreateModeBestEffort creates the entity in one source at a time and stops at the first
+	//source that fails, leaving the entity in the sources that had already created it
+	CreateModeBestEffort CreateMode = "best-effort"
+)
+
+//createOutcome records what happened to a new entity in a certain context source
+type createOutcome struct {
+	name            string
+	attempted       bool
+	err             error
+	compensated     bool
+	compensationErr error
+}
+
+//MarshalJSON reports the outcome to the client as a member of the problem details
+func (o createOutcome) MarshalJSON() ([]byte, error) {
+	outcome := struct {
+		ContextSource string `json:"contextSource"`
+		Status        string `json:"status"`
+		Reason        string `json:"reason,omitempty"`
+	}{ContextSource: o.name}
+
+	switch {
+	case !o.attempted:
+		outcome.Status = "notAttempted"
+	case o.err != nil:
+		outcome.Status, outcome.Reason = "failed", o.err.Error()
+	case o.compensationErr != nil:
+		outcome.Status, outcome.Reason = "notRemoved", o.compensationErr.Error()
+	case o.compensated:
+		outcome.Status = "removed"
+	default:
+		outcome.Status = "created"
+	}
+
+	return json.Marshal(outcome)
+}
+
+//createEntityInSources creates an entity in each of the sources in turn and stops at the first
+//source that fails. In the coordinated mode the entity is then deleted from the sources that
+//had already created it, spending at most the compensation timeout on it unless the timeout
+//is zero. The returned error is nil when all the sources created the entity.
+func createEntityInSources(ctx context.Context, mode CreateMode, compensationTimeout time.Duration, sources []ContextSource, typeName, entityID string, request Request) ([]createOutcome, error) {
+	outcomes := make([]createOutcome, len(sources))
+	var createErr error
+
+	for idx, source := range sources {
+		outcomes[idx].name = contextSourceName(idx, source)
+
+		if createErr != nil {
+			continue
+		}
+
+		outcomes[idx].attempted = true
+		outcomes[idx].err = NewContextAwareSource(source).CreateEntityWithContext(ctx, typeName, entityID, request)
+		createErr = outcomes[idx].err
+	}
+
+	if createErr == nil || mode == CreateModeBestEffort {
+		return outcomes, createErr
+	}
+
+	// The compensation should run even if the client has gone away, or the entity would be
+	// left behind in the sources that created it, but it must not be allowed to hang forever
+	compensationCtx := context.Background()
+	if compensationTimeout > 0 {
+		var cancel context.CancelFunc
+		compensationCtx, cancel = context.WithTimeout(compensationCtx, compensationTimeout)
+		defer cancel()
+	}
+
+	deleteRequest := newCompensatingDeleteRequest(compensationCtx, request.Request(), entityID)
+
+	for idx, source := range sources {
+		if outcomes[idx].attempted && outcomes[idx].err == nil {
+			err := NewContextAwareSource(source).DeleteEntityWithContext(compensationCtx, entityID, deleteRequest)
+			outcomes[idx].compensated = err == nil
+			outcomes[idx].compensationErr = err
+		}
+	}
+
+	return outcomes, createErr
+}
+
+//newCompensatingDeleteRequest creates a request to delete an entity that was created by an
+//incoming create request, so that it can be forwarded to the context sources
+func newCompensatingDeleteRequest(ctx context.Context, create *http.Request, entityID string) Request {
+	req := create.Clone(ctx)
+	req.Method = http.MethodDelete
+	req.URL.Path = strings.TrimSuffix(create.URL.Path, "/") + "/" + entityID
+	req.URL.RawPath = strings.TrimSuffix(create.URL.EscapedPath(), "/") + "/" + url.PathEscape(entityID)
+	req.Body = nil
+	req.ContentLength = 0
+	req.Header.Del("Content-Type")
+	req.Header.Del("Content-Length")
+
+	return newRequestWrapperWithBody(req, nil)
+}
+
+//compensationFailed returns true if the entity could not be removed from a source that created it
+func compensationFailed(outcomes []createOutcome) bool {
+	for _, o := range outcomes {
+		if o.compensationErr != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//contextSourceName names a context source in messages to the client, using its ID when it has one
+func contextSourceName(idx int, source ContextSource) string {
+	if ics, ok := source.(IdentifiableContextSource); ok && ics.ID() != "" {
+		return "context source " + ics.ID()
+	}
+	return fmt.Sprintf("context source %d", idx)
+}
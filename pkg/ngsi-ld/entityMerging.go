@@ -0,0 +1,283 @@
+package ngsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+)
+
+//retrieveEntityFragments asks all the sources concurrently for the entity. The fragments that are
+//found are returned in the same order as the sources, together with warnings for the sources that
+//failed and the error of the first source that failed.
+func retrieveEntityFragments(ctx context.Context, sources []ContextSource, entityID string, request Request) ([]Entity, []string, error) {
+	results := make([]Entity, len(sources))
+	errs := make([]error, len(sources))
+
+	wg := sync.WaitGroup{}
+	for idx, source := range sources {
+		wg.Add(1)
+		go func(idx int, source ContextSource) {
+			defer wg.Done()
+			results[idx], errs[idx] = NewContextAwareSource(source).RetrieveEntityWithContext(ctx, entityID, request)
+		}(idx, source)
+	}
+	wg.Wait()
+
+	fragments := []Entity{}
+	warnings := []string{}
+	var firstErr error
+
+	claims := exclusiveClaimsOf(sources)
+
+	for idx := range sources {
+		if errs[idx] != nil {
+			warnings = append(warnings, sourceFailedWarning(idx, sources[idx], errs[idx]))
+			if firstErr == nil {
+				firstErr = errs[idx]
+			}
+		} else if results[idx] != nil {
+			fragment := results[idx]
+			if len(claims.attributes) > 0 {
+				// Leave out the attributes that belong to other sources
+				fragment, errs[idx] = filterFragmentAttributes(fragment, func(name string) bool {
+					return claims.allows(sources[idx], name)
+				})
+			}
+			if errs[idx] != nil {
+				warnings = append(warnings, sourceFailedWarning(idx, sources[idx], errs[idx]))
+				if firstErr == nil {
+					firstErr = errs[idx]
+				}
+				continue
+			}
+			fragments = append(fragments, fragment)
+		}
+	}
+
+	return fragments, warnings, firstErr
+}
+
+//filterFragmentAttributes returns a copy of an entity fragment with only the attributes that
+//keep returns true for. Members that are not attributes, such as id and type, are always kept.
+func filterFragmentAttributes(fragment Entity, keep func(name string) bool) (Entity, error) {
+	m, err := fragmentAsMap(fragment)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := func(attributes map[string]interface{}) map[string]interface{} {
+		filtered := map[string]interface{}{}
+		for name, value := range attributes {
+			if _, isAttribute := attributeInstances(value); !isAttribute || keep(name) {
+				filtered[name] = value
+			}
+		}
+		return filtered
+	}
+
+	if _, isFeature := fragment.(geojson.GeoJSONFeature); !isFeature {
+		return filter(m), nil
+	}
+
+	// GeoJSON features keep their attributes among their properties
+	properties, _ := m["properties"].(map[string]interface{})
+	m["properties"] = filter(properties)
+
+	bytes, _ := json.Marshal(m)
+
+	var feature geojson.GeoJSONFeature
+	err = geojson.UnpackGeoJSONToCallback(bytes, func(f geojson.GeoJSONFeature) error {
+		feature = f
+		return nil
+	})
+
+	return feature, err
+}
+
+//mergeEntityFragments merges the fragments of an entity that were retrieved from different context
+//sources into a single entity. A single fragment is returned as it is. Otherwise the attributes of
+//all the fragments are combined, and when more than one fragment has an instance of the same
+//attribute with the same datasetId, the instance with the latest observedAt, or else the latest
+//modifiedAt, is kept. If neither can tell the instances apart, the one from the fragment that
+//comes first is kept. Instances with different datasetIds are all kept.
+func mergeEntityFragments(fragments []Entity) (Entity, error) {
+	if len(fragments) == 1 {
+		return fragments[0], nil
+	}
+
+	merged := map[string]interface{}{}
+	features := 0
+
+	for _, fragment := range fragments {
+		m, err := fragmentAsMap(fragment)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, isFeature := fragment.(geojson.GeoJSONFeature); !isFeature {
+			mergeAttributes(merged, m)
+			continue
+		}
+
+		// GeoJSON features keep their attributes among their properties
+		features++
+
+		for _, name := range []string{"id", "type", "geometry"} {
+			if _, ok := merged[name]; !ok && m[name] != nil {
+				merged[name] = m[name]
+			}
+		}
+
+		if merged["properties"] == nil {
+			merged["properties"] = map[string]interface{}{}
+		}
+
+		properties, _ := m["properties"].(map[string]interface{})
+		mergeAttributes(merged["properties"].(map[string]interface{}), properties)
+	}
+
+	if features == 0 {
+		return merged, nil
+	}
+
+	if features != len(fragments) {
+		return nil, fmt.Errorf("unable to merge GeoJSON features with other entity representations")
+	}
+
+	// Turn the merged map back into a feature, so that it is not converted once more
+	bytes, _ := json.Marshal(merged)
+
+	var feature geojson.GeoJSONFeature
+	err := geojson.UnpackGeoJSONToCallback(bytes, func(f geojson.GeoJSONFeature) error {
+		feature = f
+		return nil
+	})
+
+	return feature, err
+}
+
+//fragmentAsMap converts an entity fragment into a generic map. Unlike entityAsMap, it keeps the
+//structure of GeoJSON features intact.
+func fragmentAsMap(entity Entity) (map[string]interface{}, error) {
+	if m, ok := entity.(map[string]interface{}); ok {
+		return m, nil
+	}
+
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode entity fragment: %s", err.Error())
+	}
+
+	m := map[string]interface{}{}
+	err = json.Unmarshal(bytes, &m)
+	if err != nil {
+		return nil, fmt.Errorf("entity fragment is not a JSON object: %s", err.Error())
+	}
+
+	return m, nil
+}
+
+func mergeAttributes(target, source map[string]interface{}) {
+	for name, value := range source {
+		existing, ok := target[name]
+		if !ok {
+			target[name] = value
+			continue
+		}
+
+		existingInstances, ok1 := attributeInstances(existing)
+		newInstances, ok2 := attributeInstances(value)
+
+		// Members that are not attributes, such as id, type and @context, are taken from the first fragment
+		if !ok1 || !ok2 {
+			continue
+		}
+
+		for _, instance := range newInstances {
+			datasetID := instance["datasetId"]
+			replaced := false
+
+			for idx, e := range existingInstances {
+				if e["datasetId"] == datasetID {
+					if isNewerInstance(instance, e) {
+						existingInstances[idx] = instance
+					}
+					replaced = true
+					break
+				}
+			}
+
+			if !replaced {
+				existingInstances = append(existingInstances, instance)
+			}
+		}
+
+		if len(existingInstances) == 1 {
+			target[name] = existingInstances[0]
+		} else {
+			instances := []interface{}{}
+			for _, instance := range existingInstances {
+				instances = append(instances, instance)
+			}
+			target[name] = instances
+		}
+	}
+}
+
+//attributeInstances returns the instances of an attribute, which may be a single attribute object
+//or an array of attribute objects with different datasetIds
+func attributeInstances(attribute interface{}) ([]map[string]interface{}, bool) {
+	isAttribute := func(m map[string]interface{}) bool {
+		switch m["type"] {
+		case "Property", "GeoProperty", "Relationship":
+			return true
+		}
+		return false
+	}
+
+	switch a := attribute.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{a}, isAttribute(a)
+	case []interface{}:
+		instances := []map[string]interface{}{}
+		for _, i := range a {
+			m, ok := i.(map[string]interface{})
+			if !ok || !isAttribute(m) {
+				return nil, false
+			}
+			instances = append(instances, m)
+		}
+		return instances, len(instances) > 0
+	}
+
+	return nil, false
+}
+
+func isNewerInstance(instance, existing map[string]interface{}) bool {
+	for _, timestamp := range []string{"observedAt", "modifiedAt"} {
+		t1, ok1 := instanceTime(instance, timestamp)
+		t0, ok0 := instanceTime(existing, timestamp)
+
+		if ok1 && ok0 && !t1.Equal(t0) {
+			return t1.After(t0)
+		} else if ok1 != ok0 {
+			return ok1
+		}
+	}
+
+	return false
+}
+
+func instanceTime(instance map[string]interface{}, name string) (time.Time, bool) {
+	value, ok := instance[name].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
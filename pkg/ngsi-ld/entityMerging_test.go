@@ -0,0 +1,138 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/matryer/is"
+)
+
+func TestThatAttributesFromAllFragmentsAreMerged(t *testing.T) {
+	is := is.New(t)
+
+	entity, err := mergeEntityFragments([]Entity{
+		fragmentFromJSON(`{"id":"urn:ngsi-ld:Device:1","type":"Device","category":{"type":"Property","value":"sensor"}}`),
+		fragmentFromJSON(`{"id":"urn:ngsi-ld:Device:1","type":"Device","value":{"type":"Property","value":"on"}}`),
+	})
+	is.NoErr(err) // failed to merge fragments
+
+	merged := entity.(map[string]interface{})
+	is.Equal(merged["id"], "urn:ngsi-ld:Device:1")         // unexpected entity id
+	is.Equal(attributeValue(merged["category"]), "sensor") // the static attribute should be kept
+	is.Equal(attributeValue(merged["value"]), "on")        // the live attribute should be added
+}
+
+func TestThatTheLatestAttributeInstanceWins(t *testing.T) {
+	is := is.New(t)
+
+	entity, err := mergeEntityFragments([]Entity{
+		fragmentFromJSON(`{"id":"urn:ngsi-ld:Device:1","type":"Device",
+			"value":{"type":"Property","value":"off","observedAt":"2021-05-01T10:00:00Z"},
+			"name":{"type":"Property","value":"old","modifiedAt":"2021-05-01T10:00:00Z"},
+			"description":{"type":"Property","value":"first"}}`),
+		fragmentFromJSON(`{"id":"urn:ngsi-ld:Device:1","type":"Device",
+			"value":{"type":"Property","value":"on","observedAt":"2021-05-01T11:00:00Z"},
+			"name":{"type":"Property","value":"new","modifiedAt":"2021-05-02T10:00:00Z"},
+			"description":{"type":"Property","value":"second"}}`),
+	})
+	is.NoErr(err) // failed to merge fragments
+
+	merged := entity.(map[string]interface{})
+	is.Equal(attributeValue(merged["value"]), "on")          // the latest observedAt should win
+	is.Equal(attributeValue(merged["name"]), "new")          // the latest modifiedAt should win
+	is.Equal(attributeValue(merged["description"]), "first") // the first fragment should win a tie
+}
+
+func TestThatInstancesWithDifferentDatasetIDsAreKept(t *testing.T) {
+	is := is.New(t)
+
+	entity, err := mergeEntityFragments([]Entity{
+		fragmentFromJSON(`{"id":"urn:ngsi-ld:Device:1","type":"Device","temperature":{"type":"Property","value":10,"datasetId":"urn:ngsi-ld:Dataset:a"}}`),
+		fragmentFromJSON(`{"id":"urn:ngsi-ld:Device:1","type":"Device","temperature":[
+			{"type":"Property","value":12,"datasetId":"urn:ngsi-ld:Dataset:b"},
+			{"type":"Property","value":11,"datasetId":"urn:ngsi-ld:Dataset:a","observedAt":"2021-05-01T11:00:00Z"}]}`),
+	})
+	is.NoErr(err) // failed to merge fragments
+
+	instances := entity.(map[string]interface{})["temperature"].([]interface{})
+	is.Equal(len(instances), 2)                                           // expected one instance per datasetId
+	is.Equal(instances[0].(map[string]interface{})["value"], float64(11)) // the dataset a instance with observedAt should win
+	is.Equal(instances[1].(map[string]interface{})["value"], float64(12)) // the dataset b instance should be added
+}
+
+func TestThatRetrievedEntitiesAreMergedFromAllSources(t *testing.T) {
+	is := is.New(t)
+
+	staticSource := newFragmentSource(`{"id":"urn:ngsi-ld:Device:1","type":"Device",
+		"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.3,62.4]}}}`)
+	liveSource := newFragmentSource(`{"id":"urn:ngsi-ld:Device:1","type":"Device","value":{"type":"Property","value":"on"}}`)
+	failingSource := newFragmentSource(`{}`)
+	failingSource.RetrieveEntityFunc = func(string, Request) (Entity, error) {
+		return nil, errors.New("this source is out of order")
+	}
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(staticSource)
+	contextRegistry.Register(liveSource)
+	contextRegistry.Register(failingSource)
+
+	req, _ := http.NewRequest("GET", createURL("/entities/urn:ngsi-ld:Device:1"), nil)
+	w := httptest.NewRecorder()
+	NewRetrieveEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	entity := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	is.Equal(w.Code, http.StatusOK)                    // unexpected response code
+	is.True(entity["location"] != nil)                 // the static attributes should be included
+	is.Equal(attributeValue(entity["value"]), "on")    // the live attributes should be included
+	is.Equal(len(w.Header().Values(WarningHeader)), 1) // the failing source should be reported
+
+	req.Header.Set("Accept", geojson.ContentType)
+	w = httptest.NewRecorder()
+	NewRetrieveEntityHandler(contextRegistry).ServeHTTP(w, req)
+
+	feature := struct {
+		ID         string                 `json:"id"`
+		Geometry   map[string]interface{} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &feature)
+
+	is.Equal(w.Code, http.StatusOK)                             // unexpected response code
+	is.Equal(feature.ID, "urn:ngsi-ld:Device:1")                // unexpected feature id
+	is.Equal(feature.Geometry["type"], "Point")                 // the geometry should come from the location
+	is.Equal(attributeValue(feature.Properties["value"]), "on") // the merged attributes should be feature properties
+}
+
+func fragmentFromJSON(fragment string) Entity {
+	entity := map[string]interface{}{}
+	json.Unmarshal([]byte(fragment), &entity)
+	return entity
+}
+
+func newFragmentSource(fragment string) *ContextSourceMock {
+	return &ContextSourceMock{
+		ProvidesEntitiesWithMatchingIDFunc: func(string) bool { return true },
+		RetrieveEntityFunc: func(string, Request) (Entity, error) {
+			return fragmentFromJSON(fragment), nil
+		},
+	}
+}
+
+func TestThatWarningsNameSourcesByTheirRegistrationID(t *testing.T) {
+	is := is.New(t)
+
+	registration, _ := NewCsourceRegistration("Device", []string{}, "http://localhost", nil)
+	remoteSource := &remoteContextSource{id: "urn:ngsi-ld:ContextSourceRegistration:1", registration: registration}
+
+	warning := sourceFailedWarning(3, remoteSource, errors.New("gone"))
+	is.Equal(warning, `199 - "context source urn:ngsi-ld:ContextSourceRegistration:1 failed: gone"`) // the registration id should be used
+
+	warning = sourceFailedWarning(3, newMockedContextSource("Device", ""), errors.New("gone"))
+	is.Equal(warning, `199 - "context source 3 failed: gone"`) // sources without an id should be named by their index
+}
@@ -0,0 +1,376 @@
+package ngsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	//BatchOperationCreate creates a batch of entities
+	BatchOperationCreate = "create"
+	//BatchOperationUpsert creates a batch of entities, or replaces them if they already exist
+	BatchOperationUpsert = "upsert"
+	//BatchOperationUpdate updates the attributes of a batch of existing entities
+	BatchOperationUpdate = "update"
+	//BatchOperationDelete deletes a batch of entities
+	BatchOperationDelete = "delete"
+)
+
+//BatchEntity is a single entity in a batch operation. Body holds the complete entity
+//payload as it was received from the client.
+type BatchEntity struct {
+	ID   string
+	Type string
+	Body json.RawMessage
+}
+
+//BatchEntityError describes why a batch operation failed for a certain entity
+type BatchEntityError struct {
+	EntityID string                `json:"entityId"`
+	Error    errors.ProblemDetails `json:"error"`
+}
+
+//UnmarshalJSON is called when a BatchEntityError is received from a remote party
+func (bee *BatchEntityError) UnmarshalJSON(data []byte) error {
+	tmp := struct {
+		EntityID string `json:"entityId"`
+		Error    struct {
+			Type   string `json:"type"`
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		} `json:"error"`
+	}{}
+
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+
+	bee.EntityID = tmp.EntityID
+	bee.Error = errors.NewProblemDetails(tmp.Error.Type, tmp.Error.Title, tmp.Error.Detail)
+
+	return nil
+}
+
+//BatchOperationResult holds the ID:s of the entities that were successfully handled by a
+//batch operation, together with a problem description for each entity that failed. Created
+//tells which of the successful entities that an upsert created rather than replaced, and is
+//not part of the response to the client.
+type BatchOperationResult struct {
+	Success []string           `json:"success"`
+	Errors  []BatchEntityError `json:"errors"`
+	Created []string           `json:"-"`
+}
+
+//NewBatchOperationResult returns an empty BatchOperationResult
+func NewBatchOperationResult() *BatchOperationResult {
+	return &BatchOperationResult{
+		Success: []string{},
+		Errors:  []BatchEntityError{},
+	}
+}
+
+//BatchContextSource may be implemented by context sources that are able to handle several
+//entities in a single operation. Sources that do not implement it are sent one request
+//per entity instead.
+type BatchContextSource interface {
+	CreateEntities(ctx context.Context, entities []BatchEntity, request Request) (*BatchOperationResult, error)
+	UpsertEntities(ctx context.Context, entities []BatchEntity, request Request) (*BatchOperationResult, error)
+	UpdateEntities(ctx context.Context, entities []BatchEntity, noOverwrite bool, request Request) (*BatchOperationResult, error)
+	DeleteEntities(ctx context.Context, entityIDs []string, request Request) (*BatchOperationResult, error)
+}
+
+//NewBatchCreateEntitiesHandler handles POST requests to /entityOperations/create
+func NewBatchCreateEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchEntityOperationHandler(ctxReg, BatchOperationCreate)
+}
+
+//NewBatchUpsertEntitiesHandler handles POST requests to /entityOperations/upsert
+func NewBatchUpsertEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchEntityOperationHandler(ctxReg, BatchOperationUpsert)
+}
+
+//NewBatchUpdateEntitiesHandler handles POST requests to /entityOperations/update
+func NewBatchUpdateEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchEntityOperationHandler(ctxReg, BatchOperationUpdate)
+}
+
+//NewBatchDeleteEntitiesHandler handles POST requests to /entityOperations/delete
+func NewBatchDeleteEntitiesHandler(ctxReg ContextRegistry) http.HandlerFunc {
+	return newBatchEntityOperationHandler(ctxReg, BatchOperationDelete)
+}
+
+//batchSourceGroup holds the entities that should be sent to a certain context source
+type batchSourceGroup struct {
+	source   ContextSource
+	entities []BatchEntity
+}
+
+func newBatchEntityOperationHandler(ctxReg ContextRegistry, operation string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		request, ok := newWriteRequestWrapper(w, r)
+		if !ok {
+			return
+		}
+
+		entities, err := decodeBatchEntities(operation, request)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		noOverwrite := false
+		for _, option := range strings.Split(r.URL.Query().Get("options"), ",") {
+			if option == "noOverwrite" {
+				noOverwrite = true
+			}
+		}
+
+		// Keep track of the problems for each entity. An entity is only successful if all of
+		// the context sources that it was routed to could handle it.
+		problems := map[string]errors.ProblemDetails{}
+		created := map[string]bool{}
+		groups := []*batchSourceGroup{}
+		groupIndex := map[ContextSource]int{}
+
+		for _, entity := range entities {
+			var contextSources []ContextSource
+
+			if operation == BatchOperationCreate || operation == BatchOperationUpsert {
+				contextSources = ctxReg.GetContextSourcesForEntityType(entity.Type)
+			} else {
+				contextSources = ctxReg.GetContextSourcesForEntity(entity.ID)
+			}
+
+			contextSources = sourcesForWriting(contextSources)
+
+			if len(contextSources) == 0 {
+				problems[entity.ID] = errors.NewBadRequestData(
+					fmt.Sprintf("No context sources found matching the entity %s", entity.ID),
+				)
+				continue
+			}
+
+			for _, source := range contextSources {
+				idx, ok := groupIndex[source]
+				if !ok {
+					idx = len(groups)
+					groupIndex[source] = idx
+					groups = append(groups, &batchSourceGroup{source: source})
+				}
+				groups[idx].entities = append(groups[idx].entities, entity)
+			}
+		}
+
+		for _, group := range groups {
+			result := executeBatchOperation(r.Context(), group, operation, noOverwrite, request)
+			for _, e := range result.Errors {
+				if _, alreadyFailed := problems[e.EntityID]; !alreadyFailed {
+					problems[e.EntityID] = e.Error
+				}
+			}
+			for _, entityID := range result.Created {
+				created[entityID] = true
+			}
+		}
+
+		result := NewBatchOperationResult()
+		for _, entity := range entities {
+			if problem, failed := problems[entity.ID]; failed {
+				result.Errors = append(result.Errors, BatchEntityError{EntityID: entity.ID, Error: problem})
+			} else {
+				result.Success = append(result.Success, entity.ID)
+			}
+		}
+
+		if len(result.Errors) > 0 {
+			bytes, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				errors.ReportNewInternalError(w, "Failed to encode response.")
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMultiStatus)
+			w.Write(bytes)
+			return
+		}
+
+		createdIDs := result.Success
+		if operation == BatchOperationUpsert {
+			// Upserts only answer with the entities that did not exist before
+			createdIDs = []string{}
+			for _, entityID := range result.Success {
+				if created[entityID] {
+					createdIDs = append(createdIDs, entityID)
+				}
+			}
+		}
+
+		if operation == BatchOperationCreate || (operation == BatchOperationUpsert && len(createdIDs) > 0) {
+			bytes, _ := json.Marshal(createdIDs)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(bytes)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func decodeBatchEntities(operation string, request Request) ([]BatchEntity, error) {
+	entities := []BatchEntity{}
+
+	if operation == BatchOperationDelete {
+		entityIDs := []string{}
+		err := request.DecodeBodyInto(&entityIDs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode request payload into an array of entity ids: %s", err.Error())
+		}
+
+		for _, id := range entityIDs {
+			if id == "" {
+				return nil, fmt.Errorf("entity ids must not be empty")
+			}
+			entities = append(entities, BatchEntity{ID: id})
+		}
+
+		return entities, nil
+	}
+
+	payloads := []json.RawMessage{}
+	err := request.DecodeBodyInto(&payloads)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode request payload into an array of entities: %s", err.Error())
+	}
+
+	for idx, payload := range payloads {
+		entity := types.BaseEntity{}
+		err = json.Unmarshal(payload, &entity)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode entity at index %d: %s", idx, err.Error())
+		}
+
+		if entity.ID == "" || entity.Type == "" {
+			return nil, fmt.Errorf("entity at index %d is missing the mandatory id or type", idx)
+		}
+
+		entities = append(entities, BatchEntity{ID: entity.ID, Type: entity.Type, Body: payload})
+	}
+
+	return entities, nil
+}
+
+//replaceEntity replaces an existing entity by deleting it and creating it again. The entity is
+//retrieved first, so that it can be restored if the new version can not be created.
+func replaceEntity(ctx context.Context, source ContextAwareSource, e BatchEntity, request Request) error {
+	previous, err := source.RetrieveEntityWithContext(ctx, e.ID, request)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve the existing entity before replacing it: %w", err)
+	}
+
+	previousBody, err := json.Marshal(previous)
+	if err != nil {
+		return fmt.Errorf("unable to encode the existing entity before replacing it: %s", err.Error())
+	}
+
+	err = source.DeleteEntityWithContext(ctx, e.ID, request)
+	if err != nil {
+		return err
+	}
+
+	err = source.CreateEntityWithContext(ctx, e.Type, e.ID, request)
+	if err == nil {
+		return nil
+	}
+
+	restoreRequest := newRequestWrapperWithBody(request.Request(), previousBody)
+	if restoreErr := source.CreateEntityWithContext(ctx, e.Type, e.ID, restoreRequest); restoreErr != nil {
+		return fmt.Errorf("the entity was deleted and could not be restored (%s) after the replacement failed: %w", restoreErr.Error(), err)
+	}
+
+	return fmt.Errorf("the existing entity was kept since the replacement failed: %w", err)
+}
+
+func executeBatchOperation(ctx context.Context, group *batchSourceGroup, operation string, noOverwrite bool, request Request) *BatchOperationResult {
+
+	if batchSource, ok := group.source.(BatchContextSource); ok {
+		var result *BatchOperationResult
+		var err error
+
+		switch operation {
+		case BatchOperationCreate:
+			result, err = batchSource.CreateEntities(ctx, group.entities, request)
+		case BatchOperationUpsert:
+			result, err = batchSource.UpsertEntities(ctx, group.entities, request)
+		case BatchOperationUpdate:
+			result, err = batchSource.UpdateEntities(ctx, group.entities, noOverwrite, request)
+		case BatchOperationDelete:
+			entityIDs := []string{}
+			for _, e := range group.entities {
+				entityIDs = append(entityIDs, e.ID)
+			}
+			result, err = batchSource.DeleteEntities(ctx, entityIDs, request)
+		}
+
+		if err != nil {
+			// The whole batch failed, so report the failure for every entity in it
+			result = NewBatchOperationResult()
+			for _, e := range group.entities {
+				result.Errors = append(result.Errors, BatchEntityError{
+					EntityID: e.ID,
+					Error:    errors.NewInvalidRequest(fmt.Sprintf("batch %s failed: %s", operation, err.Error())),
+				})
+			}
+		}
+
+		return result
+	}
+
+	// Fall back to handling one entity at a time for context sources without batch support
+	result := NewBatchOperationResult()
+	source := NewContextAwareSource(group.source)
+
+	for _, e := range group.entities {
+		entityRequest := newRequestWrapperWithBody(request.Request(), e.Body)
+
+		var err error
+
+		switch operation {
+		case BatchOperationCreate:
+			err = source.CreateEntityWithContext(ctx, e.Type, e.ID, entityRequest)
+		case BatchOperationUpsert:
+			// Without batch support we can not tell if the entity exists or not, so we
+			// attempt to create it first and replace it if it turns out that it exists
+			err = source.CreateEntityWithContext(ctx, e.Type, e.ID, entityRequest)
+			if err == nil {
+				result.Created = append(result.Created, e.ID)
+			} else if isAlreadyExistsError(err) {
+				err = replaceEntity(ctx, source, e, entityRequest)
+			}
+		case BatchOperationUpdate:
+			err = source.AppendEntityAttributesWithContext(ctx, e.ID, noOverwrite, entityRequest)
+		case BatchOperationDelete:
+			err = source.DeleteEntityWithContext(ctx, e.ID, entityRequest)
+		}
+
+		if err != nil {
+			result.Errors = append(result.Errors, BatchEntityError{
+				EntityID: e.ID,
+				Error:    errors.NewInvalidRequest(fmt.Sprintf("failed to %s entity: %s", operation, err.Error())),
+			})
+		} else {
+			result.Success = append(result.Success, e.ID)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,280 @@
+package ngsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+const roadSegmentBatchJSON string = `[
+	{"id": "urn:ngsi-ld:RoadSegment:1", "type": "RoadSegment", "name": {"type": "Property", "value": "one"}},
+	{"id": "urn:ngsi-ld:RoadSegment:2", "type": "RoadSegment", "name": {"type": "Property", "value": "two"}}
+]`
+
+func TestBatchCreateEntities(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+
+	ctxReg, ctxSrc := newContextRegistryWithSourceForType("RoadSegment")
+	ctxSrc.CreateEntityFunc = func(typeName, entityID string, request Request) error {
+		entity := map[string]interface{}{}
+		err := request.DecodeBodyInto(&entity)
+		is.NoErr(err)                     // failed to decode the entity body passed to the context source
+		is.Equal(entity["id"], entityID)  // context source received the wrong entity body
+		is.Equal(typeName, "RoadSegment") // create entity called with wrong type name
+		return nil
+	}
+
+	NewBatchCreateEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)         // unexpected response code
+	is.Equal(len(ctxSrc.CreateEntityCalls()), 2) // create entity should have been called once per entity
+
+	createdIDs := []string{}
+	json.Unmarshal(w.Body.Bytes(), &createdIDs)
+	is.Equal(createdIDs, []string{"urn:ngsi-ld:RoadSegment:1", "urn:ngsi-ld:RoadSegment:2"})
+}
+
+func TestBatchCreateEntitiesReportsPartialFailure(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+
+	ctxReg, ctxSrc := newContextRegistryWithSourceForType("RoadSegment")
+	ctxSrc.CreateEntityFunc = func(typeName, entityID string, request Request) error {
+		if strings.HasSuffix(entityID, ":2") {
+			return errors.New("already exists")
+		}
+		return nil
+	}
+
+	NewBatchCreateEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusMultiStatus) // unexpected response code
+
+	result := NewBatchOperationResult()
+	err := json.Unmarshal(w.Body.Bytes(), result)
+	is.NoErr(err) // failed to unmarshal batch operation result
+
+	is.Equal(result.Success, []string{"urn:ngsi-ld:RoadSegment:1"})  // unexpected success list
+	is.Equal(len(result.Errors), 1)                                  // expected a single error
+	is.Equal(result.Errors[0].EntityID, "urn:ngsi-ld:RoadSegment:2") // unexpected entity id in error
+	is.True(result.Errors[0].Error.Detail() != "")                   // error should have a detail
+}
+
+func TestBatchCreateEntitiesReportsEntitiesWithoutContextSource(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+
+	NewBatchCreateEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusMultiStatus) // unexpected response code
+}
+
+func TestBatchCreateEntitiesFailsOnInvalidPayload(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/create"), bytes.NewBufferString(`{"id": "notanarray"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+
+	NewBatchCreateEntitiesHandler(NewContextRegistry()).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // unexpected response code
+}
+
+func TestBatchDeleteEntities(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/delete"), bytes.NewBufferString(`["urn:ngsi-ld:RoadSegment:1"]`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("RoadSegment", "")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.DeleteEntityFunc = func(string, Request) error { return nil }
+	contextRegistry.Register(contextSource)
+
+	NewBatchDeleteEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                                               // unexpected response code
+	is.Equal(contextSource.DeleteEntityCalls()[0].EntityID, "urn:ngsi-ld:RoadSegment:1") // unexpected entity deleted
+}
+
+func TestThatBatchOperationsAreSentAsOneRequestToRemoteContext(t *testing.T) {
+	is := is.New(t)
+
+	requestCount := 0
+	var receivedPath string
+	var receivedEntities []json.RawMessage
+
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		receivedPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&receivedEntities)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write([]byte(`{"success":["urn:ngsi-ld:RoadSegment:1"],"errors":[{"entityId":"urn:ngsi-ld:RoadSegment:2","error":{"type":"https://uri.etsi.org/ngsi-ld/errors/AlreadyExists","title":"Already Exists","detail":"entity already exists"}}]}`))
+	}))
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("RoadSegment", []string{"name"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/upsert"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewBatchUpsertEntitiesHandler(ctxRegistry).ServeHTTP(w, req)
+
+	is.Equal(requestCount, 1)                                     // expected a single batched request to the remote source
+	is.Equal(receivedPath, "/ngsi-ld/v1/entityOperations/upsert") // unexpected path in forwarded request
+	is.Equal(len(receivedEntities), 2)                            // both entities should be in the forwarded batch
+	is.Equal(w.Code, http.StatusMultiStatus)                      // unexpected response code
+
+	result := NewBatchOperationResult()
+	json.Unmarshal(w.Body.Bytes(), result)
+	is.Equal(result.Errors[0].Error.Type(), "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists") // remote problem type was not propagated
+}
+
+func TestThatNoOverwriteIsForwardedInBatchUpdates(t *testing.T) {
+	is := is.New(t)
+
+	var receivedOptions string
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedOptions = r.URL.Query().Get("options")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("RoadSegment", []string{"name"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/update"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	entities := []BatchEntity{{ID: "urn:ngsi-ld:RoadSegment:1", Type: "RoadSegment", Body: json.RawMessage(`{}`)}}
+
+	_, err := contextSource.(BatchContextSource).UpdateEntities(context.Background(), entities, true, newRequestWrapper(req))
+	is.NoErr(err)                            // the batch update should succeed
+	is.Equal(receivedOptions, "noOverwrite") // noOverwrite should be forwarded
+
+	_, err = contextSource.(BatchContextSource).UpdateEntities(context.Background(), entities, false, newRequestWrapper(req))
+	is.NoErr(err)                 // the batch update should succeed
+	is.Equal(receivedOptions, "") // no options should be forwarded
+}
+
+func TestThatUpsertsReplaceExistingEntities(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("RoadSegment", "")
+	contextSource.CreateEntityFunc = func(typeName, entityID string, request Request) error {
+		if entityID == "urn:ngsi-ld:RoadSegment:1" && len(contextSource.DeleteEntityCalls()) == 0 {
+			return fmt.Errorf("failed to create entity: %w", &EntityAlreadyExistsError{EntityID: entityID})
+		}
+		if entityID == "urn:ngsi-ld:RoadSegment:2" {
+			return errors.New("invalid entity")
+		}
+		return nil
+	}
+	contextSource.DeleteEntityFunc = func(string, Request) error { return nil }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/upsert"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewBatchUpsertEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	result := NewBatchOperationResult()
+	json.Unmarshal(w.Body.Bytes(), result)
+
+	is.Equal(w.Code, http.StatusMultiStatus)                                     // unexpected response code
+	is.Equal(result.Success, []string{"urn:ngsi-ld:RoadSegment:1"})              // the existing entity should be replaced
+	is.Equal(len(contextSource.DeleteEntityCalls()), 1)                          // only the existing entity should be deleted
+	is.Equal(len(contextSource.AppendEntityAttributesCalls()), 0)                // attributes should never be appended
+	is.True(strings.Contains(result.Errors[0].Error.Detail(), "invalid entity")) // the original error should be reported
+}
+
+func TestThatUpsertsThatCreateEntitiesAnswerWithTheirIDs(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("RoadSegment", "")
+	contextSource.CreateEntityFunc = func(typeName, entityID string, request Request) error {
+		if entityID == "urn:ngsi-ld:RoadSegment:1" && len(contextSource.DeleteEntityCalls()) == 0 {
+			return &EntityAlreadyExistsError{EntityID: entityID}
+		}
+		return nil
+	}
+	contextSource.DeleteEntityFunc = func(string, Request) error { return nil }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/upsert"), bytes.NewBufferString(roadSegmentBatchJSON))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewBatchUpsertEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	createdIDs := []string{}
+	json.Unmarshal(w.Body.Bytes(), &createdIDs)
+
+	is.Equal(w.Code, http.StatusCreated)                        // unexpected response code
+	is.Equal(createdIDs, []string{"urn:ngsi-ld:RoadSegment:2"}) // only the created entity should be listed
+}
+
+func TestThatFailedReplacementsRestoreTheExistingEntity(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("RoadSegment", "")
+	contextSource.CreateEntityFunc = func(typeName, entityID string, request Request) error {
+		switch len(contextSource.CreateEntityCalls()) {
+		case 1:
+			return &EntityAlreadyExistsError{EntityID: entityID}
+		case 2:
+			return errors.New("invalid entity")
+		}
+		return nil
+	}
+	contextSource.RetrieveEntityFunc = func(string, Request) (Entity, error) {
+		return map[string]interface{}{"id": "urn:ngsi-ld:RoadSegment:1", "type": "RoadSegment"}, nil
+	}
+	contextSource.DeleteEntityFunc = func(string, Request) error { return nil }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	body := `[{"id": "urn:ngsi-ld:RoadSegment:1", "type": "RoadSegment", "name": {"type": "Property", "value": "one"}}]`
+	req, _ := http.NewRequest("POST", createURL("/entityOperations/upsert"), bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	NewBatchUpsertEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	result := NewBatchOperationResult()
+	json.Unmarshal(w.Body.Bytes(), result)
+
+	restored, _ := io.ReadAll(contextSource.CreateEntityCalls()[2].Request.BodyReader())
+
+	is.Equal(w.Code, http.StatusMultiStatus)                                               // unexpected response code
+	is.Equal(string(restored), `{"id":"urn:ngsi-ld:RoadSegment:1","type":"RoadSegment"}`)  // the existing entity should be restored
+	is.True(strings.Contains(result.Errors[0].Error.Detail(), "existing entity was kept")) // the client should be told that the entity was kept
+}
@@ -18,9 +18,10 @@ type ProblemDetails interface {
 
 //ProblemDetailsImpl is an implementation of the ProblemDetails interface
 type ProblemDetailsImpl struct {
-	typ    string
-	title  string
-	detail string
+	typ        string
+	title      string
+	detail     string
+	extensions map[string]interface{}
 }
 
 const (
@@ -95,6 +96,116 @@ func ReportNewInternalError(w http.ResponseWriter, detail string) {
 	ie.WriteResponse(w)
 }
 
+//ResourceNotFound reports that the referred entity or resource does not exist
+type ResourceNotFound struct {
+	ProblemDetailsImpl
+}
+
+//NewResourceNotFound creates and returns a new instance of a ResourceNotFound with the supplied problem detail
+func NewResourceNotFound(detail string) *ResourceNotFound {
+	return &ResourceNotFound{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound",
+			title:  "Resource Not Found",
+			detail: detail,
+		},
+	}
+}
+
+//ReportNewResourceNotFound creates a ResourceNotFound instance and sends it to the supplied http.ResponseWriter
+func ReportNewResourceNotFound(w http.ResponseWriter, detail string) {
+	rnf := NewResourceNotFound(detail)
+	rnf.WriteResponse(w)
+}
+
+//AlreadyExists reports that the referred element already exists
+type AlreadyExists struct {
+	ProblemDetailsImpl
+}
+
+//NewAlreadyExists creates and returns a new instance of an AlreadyExists with the supplied problem detail
+func NewAlreadyExists(detail string) *AlreadyExists {
+	return &AlreadyExists{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists",
+			title:  "Already Exists",
+			detail: detail,
+		},
+	}
+}
+
+//ReportNewAlreadyExists creates an AlreadyExists instance and sends it to the supplied http.ResponseWriter
+func ReportNewAlreadyExists(w http.ResponseWriter, detail string) {
+	ae := NewAlreadyExists(detail)
+	ae.WriteResponse(w)
+}
+
+//NotAcceptable reports that none of the representations that the client accepts can be provided
+type NotAcceptable struct {
+	ProblemDetailsImpl
+}
+
+//NewNotAcceptable creates and returns a new instance of a NotAcceptable with the supplied problem detail
+func NewNotAcceptable(detail string) *NotAcceptable {
+	return &NotAcceptable{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://tools.ietf.org/html/rfc7231#section-6.5.6",
+			title:  "Not Acceptable",
+			detail: detail,
+		},
+	}
+}
+
+//ReportNewNotAcceptable creates a NotAcceptable instance and sends it to the supplied http.ResponseWriter
+func ReportNewNotAcceptable(w http.ResponseWriter, detail string) {
+	na := NewNotAcceptable(detail)
+	na.WriteResponse(w)
+}
+
+//UnsupportedMediaType reports that the payload of the request is in a format that is not supported
+type UnsupportedMediaType struct {
+	ProblemDetailsImpl
+}
+
+//NewUnsupportedMediaType creates and returns a new instance of an UnsupportedMediaType with the supplied problem detail
+func NewUnsupportedMediaType(detail string) *UnsupportedMediaType {
+	return &UnsupportedMediaType{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://tools.ietf.org/html/rfc7231#section-6.5.13",
+			title:  "Unsupported Media Type",
+			detail: detail,
+		},
+	}
+}
+
+//ReportNewUnsupportedMediaType creates an UnsupportedMediaType instance and sends it to the supplied http.ResponseWriter
+func ReportNewUnsupportedMediaType(w http.ResponseWriter, detail string) {
+	umt := NewUnsupportedMediaType(detail)
+	umt.WriteResponse(w)
+}
+
+//MethodNotAllowed reports that the resource does not support the method of the request
+type MethodNotAllowed struct {
+	ProblemDetailsImpl
+}
+
+//NewMethodNotAllowed creates and returns a new instance of a MethodNotAllowed with the supplied problem detail
+func NewMethodNotAllowed(detail string) *MethodNotAllowed {
+	return &MethodNotAllowed{
+		ProblemDetailsImpl: ProblemDetailsImpl{
+			typ:    "https://tools.ietf.org/html/rfc7231#section-6.5.5",
+			title:  "Method Not Allowed",
+			detail: detail,
+		},
+	}
+}
+
+//ReportNewMethodNotAllowed creates a MethodNotAllowed instance and sends it to the supplied http.ResponseWriter
+func ReportNewMethodNotAllowed(w http.ResponseWriter, detail string) {
+	mna := NewMethodNotAllowed(detail)
+	mna.WriteResponse(w)
+}
+
 type UnauthorizedRequest struct {
 	ProblemDetailsImpl
 }
@@ -114,6 +225,45 @@ func ReportUnauthorizedRequest(w http.ResponseWriter, detail string) {
 	ur.WriteResponse(w)
 }
 
+//NewProblemDetails creates a ProblemDetails instance from its parts. It is mostly useful when
+//problems reported by a remote party need to be passed on
+func NewProblemDetails(typ, title, detail string) *ProblemDetailsImpl {
+	return &ProblemDetailsImpl{
+		typ:    typ,
+		title:  title,
+		detail: detail,
+	}
+}
+
+//Type returns the URI that identifies the problem type
+func (p *ProblemDetailsImpl) Type() string {
+	return p.typ
+}
+
+//Title returns the short, human readable summary of the problem type
+func (p *ProblemDetailsImpl) Title() string {
+	return p.title
+}
+
+//Detail returns the human readable explanation specific to this occurrence of the problem
+func (p *ProblemDetailsImpl) Detail() string {
+	return p.detail
+}
+
+//AddExtensionMember adds a member with additional information about the problem, that is
+//serialized next to the type, title and detail as described in section 3.2 of RFC7807
+func (p *ProblemDetailsImpl) AddExtensionMember(name string, value interface{}) {
+	if p.extensions == nil {
+		p.extensions = map[string]interface{}{}
+	}
+	p.extensions[name] = value
+}
+
+//ExtensionMember returns the value of an extension member, or nil if there is no such member
+func (p *ProblemDetailsImpl) ExtensionMember(name string) interface{} {
+	return p.extensions[name]
+}
+
 //ContentType returns the ContentType to be used when returning this problem
 func (p *ProblemDetailsImpl) ContentType() string {
 	return ProblemReportContentType
@@ -121,6 +271,17 @@ func (p *ProblemDetailsImpl) ContentType() string {
 
 //MarshalJSON is called when a ProblemDetailsImpl instance should be serialized to JSON
 func (p *ProblemDetailsImpl) MarshalJSON() ([]byte, error) {
+	if len(p.extensions) > 0 {
+		members := map[string]interface{}{}
+		for name, value := range p.extensions {
+			members[name] = value
+		}
+		members["type"] = p.typ
+		members["title"] = p.title
+		members["detail"] = p.detail
+		return json.Marshal(members)
+	}
+
 	j, err := json.Marshal(struct {
 		Type   string `json:"type"`
 		Title  string `json:"title"`
@@ -139,8 +300,19 @@ func (p *ProblemDetailsImpl) MarshalJSON() ([]byte, error) {
 //ResponseCode returns the HTTP response code to be used when returning a specific problem
 func (p *ProblemDetailsImpl) ResponseCode() int {
 
-	if p.typ == "https://uri.etsi.org/ngsi-ld/errors/UnauthorizedRequest" {
+	switch p.typ {
+	case "https://uri.etsi.org/ngsi-ld/errors/UnauthorizedRequest":
 		return http.StatusUnauthorized
+	case "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound":
+		return http.StatusNotFound
+	case "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists":
+		return http.StatusConflict
+	case "https://tools.ietf.org/html/rfc7231#section-6.5.5":
+		return http.StatusMethodNotAllowed
+	case "https://tools.ietf.org/html/rfc7231#section-6.5.6":
+		return http.StatusNotAcceptable
+	case "https://tools.ietf.org/html/rfc7231#section-6.5.13":
+		return http.StatusUnsupportedMediaType
 	}
 
 	return http.StatusBadRequest
@@ -0,0 +1,359 @@
+package ngsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//WarningHeader is the response header that is used to report context sources that failed
+//or timed out, when a handler has been configured to respond with partial results
+const WarningHeader string = "NGSILD-Warning"
+
+var errSourceTimeout = errors.New("context source did not respond in time")
+
+//federatedQuery queries a number of context sources concurrently and treats them as one
+//ordered list of entities, where the entities of each source follow after those of the
+//sources before it. This way the offset and limit of a query refer to the combined result,
+//rather than to the result from each individual source.
+type federatedQuery struct {
+	ctx     context.Context
+	sources []ContextSource
+	query   Query
+	options *handlerOptions
+
+	counts []uint64
+	failed map[int]error
+}
+
+func newFederatedQuery(ctx context.Context, sources []ContextSource, query Query, options *handlerOptions) *federatedQuery {
+	return &federatedQuery{
+		ctx:     ctx,
+		sources: sources,
+		query:   query,
+		options: options,
+		failed:  map[int]error{},
+	}
+}
+
+//sourceResult holds what was received from a single context source
+type sourceResult struct {
+	count    uint64
+	entities []Entity
+	err      error
+}
+
+//sourceWindow is the part of a single context source that is covered by a query window
+type sourceWindow struct {
+	offset uint64
+	limit  uint64
+}
+
+//Count returns the total number of entities that match the query in all of the sources
+func (fq *federatedQuery) Count() (uint64, error) {
+	counts, err := fq.sourceCounts()
+	if err != nil {
+		return 0, err
+	}
+
+	total := uint64(0)
+	for _, count := range counts {
+		total = addWithoutOverflow(total, count)
+	}
+
+	return total, nil
+}
+
+//Entities returns the entities that are within the window of the combined result that
+//starts at offset and holds at most limit entities
+func (fq *federatedQuery) Entities(offset, limit uint64) ([]Entity, error) {
+	windows := make([]*sourceWindow, len(fq.sources))
+
+	if offset > 0 {
+		// We need to know how many entities each source holds to be able
+		// to tell where in the sources the requested window starts
+		counts, err := fq.sourceCounts()
+		if err != nil {
+			return nil, err
+		}
+
+		windowEnd := addWithoutOverflow(offset, limit)
+		sourceStart := uint64(0)
+
+		for idx, count := range counts {
+			sourceEnd := addWithoutOverflow(sourceStart, count)
+			start, end := offset, windowEnd
+			if sourceStart > start {
+				start = sourceStart
+			}
+			if sourceEnd < end {
+				end = sourceEnd
+			}
+			if start < end {
+				windows[idx] = &sourceWindow{offset: start - sourceStart, limit: end - start}
+			}
+			sourceStart = sourceEnd
+		}
+	} else {
+		// Without an offset the window starts with the first entity of the first source, so
+		// every source is asked for a full window and the surplus is cut off when merging
+		for idx := range windows {
+			windows[idx] = &sourceWindow{offset: 0, limit: limit}
+		}
+	}
+
+	results, err := fq.forEachSource(func(ctx context.Context, idx int, source ContextSource) sourceResult {
+		window := windows[idx]
+		if window == nil {
+			return sourceResult{}
+		}
+
+		result := sourceResult{entities: []Entity{}}
+
+		if needsQueryFiltering(source) {
+			result.entities, result.err = getFilteredEntities(ctx, source, fq.query, window)
+			return result
+		}
+
+		received := uint64(0)
+
+		result.err = NewContextAwareSource(source).GetEntitiesWithContext(ctx, withPagination(fq.query, window.offset, window.limit), func(entity Entity) error {
+			if received == window.limit {
+				// Ignore any excess entities from sources that return more than they were asked for
+				return nil
+			}
+			received++
+			result.entities = append(result.entities, entity)
+			return nil
+		})
+
+		return result
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge the results in the order of the sources, so that the response is deterministic
+	entities := []Entity{}
+	for _, result := range results {
+		for _, entity := range result.entities {
+			if uint64(len(entities)) == limit {
+				return entities, nil
+			}
+			entities = append(entities, entity)
+		}
+	}
+
+	return entities, nil
+}
+
+//Warnings returns a warning for each of the sources that failed or timed out, formatted to
+//be used as the value of a warning header
+func (fq *federatedQuery) Warnings() []string {
+	warnings := []string{}
+
+	for idx := range fq.sources {
+		if err, failed := fq.failed[idx]; failed {
+			warnings = append(warnings, sourceFailedWarning(idx, fq.sources[idx], err))
+		}
+	}
+
+	return warnings
+}
+
+//sourceFailedWarning formats a warning about a context source that failed, to be used as the
+//value of a warning header
+func sourceFailedWarning(idx int, source ContextSource, err error) string {
+	text := fmt.Sprintf("%s failed: %s", contextSourceName(idx, source), err.Error())
+	return "199 - " + strconv.Quote(text)
+}
+
+func (fq *federatedQuery) sourceCounts() ([]uint64, error) {
+	if fq.counts != nil {
+		return fq.counts, nil
+	}
+
+	results, err := fq.forEachSource(func(ctx context.Context, idx int, source ContextSource) sourceResult {
+		count, err := countEntities(ctx, source, fq.query)
+		return sourceResult{count: count, err: err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fq.counts = make([]uint64, len(results))
+	for idx, result := range results {
+		fq.counts[idx] = result.count
+	}
+
+	return fq.counts, nil
+}
+
+//forEachSource concurrently calls fn for each source that has not already failed, and returns
+//the results in the same order as the sources. Sources that fail or time out are either reported
+//as an error or, if partial results are allowed, remembered so that they can be skipped from then on.
+func (fq *federatedQuery) forEachSource(fn func(ctx context.Context, idx int, source ContextSource) sourceResult) ([]sourceResult, error) {
+	results := make([]sourceResult, len(fq.sources))
+
+	var wg sync.WaitGroup
+
+	for idx, source := range fq.sources {
+		if _, failed := fq.failed[idx]; failed {
+			continue
+		}
+
+		wg.Add(1)
+		go func(idx int, source ContextSource) {
+			defer wg.Done()
+			results[idx] = callWithTimeout(fq.ctx, fq.options.sourceTimeout, func(ctx context.Context) sourceResult {
+				return fn(ctx, idx, source)
+			})
+		}(idx, source)
+	}
+
+	wg.Wait()
+
+	for idx, result := range results {
+		if result.err != nil {
+			if !fq.options.partialResults {
+				return nil, result.err
+			}
+			fq.failed[idx] = result.err
+			// Do not use anything that a failing source managed to return
+			results[idx] = sourceResult{}
+		}
+	}
+
+	if len(fq.sources) > 0 && len(fq.failed) == len(fq.sources) {
+		return nil, fmt.Errorf("all context sources failed, the first one with: %s", fq.failed[0].Error())
+	}
+
+	return results, nil
+}
+
+//callWithTimeout calls fn with a context that is cancelled after the given amount of time, or
+//when the parent context is done, and returns as soon as that happens. A source that ignores the
+//cancellation is left to finish in the background, but its result is thrown away.
+func callWithTimeout(parent context.Context, timeout time.Duration, fn func(ctx context.Context) sourceResult) sourceResult {
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+
+	done := make(chan sourceResult, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return sourceResult{err: errSourceTimeout}
+		}
+		return sourceResult{err: ctx.Err()}
+	}
+}
+
+//countEntities returns the number of entities in a context source that match a query,
+//either by asking the source to count them or by counting them one by one
+func countEntities(ctx context.Context, source ContextSource, query Query) (uint64, error) {
+	if counter, ok := source.(EntityCounter); ok {
+		return counter.CountEntities(ctx, query)
+	}
+
+	count := uint64(0)
+
+	err := NewContextAwareSource(source).GetEntitiesWithContext(ctx, withPagination(query, 0, math.MaxUint64), func(entity Entity) error {
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+//maxFilteredPages is the maximum number of pages that is requested from a context source
+//whose results have to be filtered, when trying to fill a window with matching entities
+const maxFilteredPages = 10
+
+func needsQueryFiltering(source ContextSource) bool {
+	fcs, ok := source.(FilteredContextSource)
+	return ok && fcs.NeedsQueryFiltering()
+}
+
+//getFilteredEntities returns the entities in a window of a context source that match the query.
+//The window is placed according to the source's own count, and entities that the source should
+//have left out are dropped. More entities are asked for to make up for the dropped ones, until
+//the window is full, the source runs out of entities, a page brings no entities that have not
+//already been seen, or maxFilteredPages pages have been requested.
+func getFilteredEntities(ctx context.Context, source ContextSource, query Query, window *sourceWindow) ([]Entity, error) {
+	entities := []Entity{}
+	seen := map[string]bool{}
+	offset := window.offset
+
+	for page := 0; page < maxFilteredPages && uint64(len(entities)) < window.limit; page++ {
+		pageSize := window.limit - uint64(len(entities))
+		received := uint64(0)
+		added := 0
+
+		err := NewContextAwareSource(source).GetEntitiesWithContext(ctx, withPagination(query, offset, pageSize), func(entity Entity) error {
+			if received == pageSize {
+				return nil
+			}
+			received++
+
+			if id := idOfEntity(entity); id != "" {
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+			added++
+
+			// Drop entities that the source should have left out
+			if query.Matches(entity) {
+				entities = append(entities, entity)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if received < pageSize || added == 0 {
+			break
+		}
+
+		offset = addWithoutOverflow(offset, received)
+	}
+
+	return entities, nil
+}
+
+//idOfEntity returns the id of an entity, or an empty string if it has none
+func idOfEntity(entity Entity) string {
+	e, err := entityAsMap(entity)
+	if err != nil {
+		return ""
+	}
+	id, _ := e["id"].(string)
+	return id
+}
+
+func addWithoutOverflow(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
@@ -172,6 +172,11 @@ func NewEntityConverter(property string, simplified bool, collection *GeoJSONFea
 			f, _ := v.(SpatialEntity).ToGeoJSONFeature(property, simplified)
 			collection.Features = append(collection.Features, f)
 			return f
+		// ... and so do entities that have been decoded into, or merged as, generic maps
+		case map[string]interface{}:
+			f := newGeoJSONFeatureFromMap(v, property, simplified)
+			collection.Features = append(collection.Features, f)
+			return f
 		// ... and some dont. How can we handle those in a better way?
 		default:
 			return &geoJSONFeatureImpl{Type: "Feature"}
@@ -179,6 +184,60 @@ func NewEntityConverter(property string, simplified bool, collection *GeoJSONFea
 	}
 }
 
+//newGeoJSONFeatureFromMap converts an NGSI-LD entity in the form of a map to a GeoJSON feature, with
+//the geometry taken from the GeoProperty with the supplied name. The feature gets no geometry if the
+//entity does not have such a property, or if it contains an unsupported type of geometry.
+func newGeoJSONFeatureFromMap(entity map[string]interface{}, property string, simplified bool) GeoJSONFeature {
+	id, _ := entity["id"].(string)
+	typ, _ := entity["type"].(string)
+
+	f := &geoJSONFeatureImpl{
+		ID:         id,
+		Type:       "Feature",
+		Properties: map[string]interface{}{"type": typ},
+	}
+
+	geometry := entity[property]
+	if geoProperty, ok := geometry.(map[string]interface{}); ok && geoProperty["type"] == "GeoProperty" {
+		geometry = geoProperty["value"]
+	}
+
+	if geometryBytes, err := json.Marshal(geometry); err == nil {
+		f.Geometry.UnmarshalJSON(geometryBytes)
+	}
+
+	for name, value := range entity {
+		if name == "id" || name == "type" || name == "@context" {
+			continue
+		}
+
+		if simplified {
+			value = simplifiedValue(value)
+		}
+
+		f.SetProperty(name, value)
+	}
+
+	return f
+}
+
+//simplifiedValue returns the value of a Property or GeoProperty, or the object of a Relationship
+func simplifiedValue(attribute interface{}) interface{} {
+	m, ok := attribute.(map[string]interface{})
+	if !ok {
+		return attribute
+	}
+
+	switch m["type"] {
+	case "Property", "GeoProperty":
+		return m["value"]
+	case "Relationship":
+		return m["object"]
+	}
+
+	return attribute
+}
+
 func UnpackGeoJSONToCallback(bytes []byte, callback func(GeoJSONFeature) error) error {
 
 	typeCheck := struct {
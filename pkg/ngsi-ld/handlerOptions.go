@@ -0,0 +1,55 @@
+package ngsi
+
+import "time"
+
+//HandlerOption is used to change the default behaviour of the handlers that are created
+//by this package
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	sourceTimeout       time.Duration
+	partialResults      bool
+	compensationTimeout time.Duration
+}
+
+//defaultCompensationTimeout limits the time that is spent on deleting a new entity from the
+//sources that created it, when another source failed to create it
+const defaultCompensationTimeout = 30 * time.Second
+
+func newHandlerOptions(options []HandlerOption) *handlerOptions {
+	opts := &handlerOptions{
+		compensationTimeout: defaultCompensationTimeout,
+	}
+
+	for _, option := range options {
+		option(opts)
+	}
+
+	return opts
+}
+
+//WithSourceTimeout sets the maximum time that a handler waits for each of the context
+//sources that it queries. A timeout of zero, which is the default, means no timeout.
+func WithSourceTimeout(timeout time.Duration) HandlerOption {
+	return func(opts *handlerOptions) {
+		opts.sourceTimeout = timeout
+	}
+}
+
+//WithPartialResults makes a handler respond with the results from the context sources
+//that did answer, rather than failing, when some of the queried sources fail or time out.
+//The sources that failed are reported in the NGSILD-Warning response header.
+func WithPartialResults() HandlerOption {
+	return func(opts *handlerOptions) {
+		opts.partialResults = true
+	}
+}
+
+//WithCompensationTimeout sets the maximum time that a handler spends on deleting a new entity
+//from the context sources that created it, when a coordinated create fails in another source.
+//The default is 30 seconds, and a timeout of zero means no timeout.
+func WithCompensationTimeout(timeout time.Duration) HandlerOption {
+	return func(opts *handlerOptions) {
+		opts.compensationTimeout = timeout
+	}
+}
@@ -14,8 +14,13 @@ type Query interface {
 	HasDeviceReference() bool
 	Device() string
 
+	HasFilter() bool
+	Filter() QueryExpression
+	FilterText() string
+
 	PaginationLimit() uint64
 	PaginationOffset() uint64
+	CountRequested() bool
 
 	IsGeoQuery() bool
 	Geo() GeoQuery
@@ -26,6 +31,8 @@ type Query interface {
 	EntityAttributes() []string
 	EntityTypes() []string
 
+	Matches(entity Entity) bool
+
 	Request() *http.Request
 }
 
@@ -106,8 +113,6 @@ func newQueryFromParameters(req *http.Request, types []string, attributes []stri
 
 	var err error
 
-	const refDevicePrefix string = "refDevice==\""
-
 	qw := &queryWrapper{request: req, types: types, attributes: attributes}
 
 	limitparam := req.URL.Query().Get("limit")
@@ -116,11 +121,24 @@ func newQueryFromParameters(req *http.Request, types []string, attributes []stri
 		if err != nil {
 			return nil, fmt.Errorf("unable to parse limit parameter %s into an int value", limitparam)
 		}
-		if limit > 0 {
-			qw.limit = uint64(limit)
+		if limit >= 0 {
+			l := uint64(limit)
+			qw.limit = &l
 		}
 	}
 
+	countparam := req.URL.Query().Get("count")
+	if countparam != "" {
+		qw.count, err = strconv.ParseBool(countparam)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse count parameter %s into a boolean value", countparam)
+		}
+	}
+
+	if qw.limit != nil && *qw.limit == 0 && !qw.count {
+		return nil, errors.New("a limit of 0 is only allowed when count=true is also requested")
+	}
+
 	offsetparam := req.URL.Query().Get("offset")
 	if offsetparam != "" {
 		offset, err := strconv.ParseInt(offsetparam, 10, 64)
@@ -132,14 +150,23 @@ func newQueryFromParameters(req *http.Request, types []string, attributes []stri
 		}
 	}
 
-	if strings.HasPrefix(q, refDevicePrefix) {
-		splitElems := strings.Split(q, "\"")
-		qw.device = &splitElems[1]
+	if q != "" {
+		qw.filter, err = ParseQueryExpression(q)
+		if err != nil {
+			return nil, err
+		}
+		qw.filterText = q
+		qw.device = findDeviceReference(qw.filter)
 	}
 
 	georel := req.URL.Query().Get("georel")
 	if len(georel) > 0 {
 		qw.geoQuery, err = newGeoQueryFromHTTPRequest(georel, req)
+		if qw.geoQuery != nil {
+			if geoproperty := req.URL.Query().Get("geoproperty"); geoproperty != "" {
+				qw.geoQuery.GeoProperty = &geoproperty
+			}
+		}
 	}
 
 	timerel := req.URL.Query().Get("timerel")
@@ -150,6 +177,30 @@ func newQueryFromParameters(req *http.Request, types []string, attributes []stri
 	return qw, err
 }
 
+//findDeviceReference looks for a refDevice=="<id>" term that must match for the whole
+//expression to match, i.e. either the expression itself or a term in a top level AND
+func findDeviceReference(expr QueryExpression) *string {
+	switch e := expr.(type) {
+	case *QueryComparison:
+		if e.Attribute.Name == "refDevice" && len(e.Attribute.SubAttributes) == 0 &&
+			len(e.Attribute.CompoundPath) == 0 && e.Operator == QueryOperatorEqual {
+			if device, ok := e.Value.(string); ok {
+				return &device
+			}
+		}
+	case *QueryLogicalExpression:
+		if e.Operator == QueryLogicalAnd {
+			for _, operand := range e.Operands {
+				if device := findDeviceReference(operand); device != nil {
+					return device
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func newGeoQueryFromHTTPRequest(georel string, req *http.Request) (*GeoQuery, error) {
 
 	var err error
@@ -365,9 +416,12 @@ type queryWrapper struct {
 	types      []string
 	attributes []string
 	device     *string
+	filter     QueryExpression
+	filterText string
 
-	limit  uint64
+	limit  *uint64
 	offset uint64
+	count  bool
 
 	geoQuery      *GeoQuery
 	temporalQuery *TemporalQuery
@@ -377,6 +431,22 @@ func (q *queryWrapper) HasDeviceReference() bool {
 	return q.device != nil
 }
 
+func (q *queryWrapper) HasFilter() bool {
+	return q.filter != nil
+}
+
+func (q *queryWrapper) Filter() QueryExpression {
+	if !q.HasFilter() {
+		panic("Filter called on Query without a filter")
+	}
+	return q.filter
+}
+
+//FilterText returns the q parameter that the filter was parsed from, as the client sent it
+func (q *queryWrapper) FilterText() string {
+	return q.filterText
+}
+
 func (q *queryWrapper) IsGeoQuery() bool {
 	return q.geoQuery != nil
 }
@@ -412,8 +482,8 @@ func (q *queryWrapper) EntityTypes() []string {
 }
 
 func (q *queryWrapper) PaginationLimit() uint64 {
-	if q.limit > 0 {
-		return q.limit
+	if q.limit != nil {
+		return *q.limit
 	}
 
 	return QueryDefaultPaginationLimit
@@ -423,6 +493,30 @@ func (q *queryWrapper) PaginationOffset() uint64 {
 	return q.offset
 }
 
+func (q *queryWrapper) CountRequested() bool {
+	return q.count
+}
+
 func (q *queryWrapper) Request() *http.Request {
 	return q.request
 }
+
+//paginatedQuery is used to pass a query on to a context source with other pagination
+//parameters than the ones that were requested by the client
+type paginatedQuery struct {
+	Query
+	offset uint64
+	limit  uint64
+}
+
+func withPagination(query Query, offset, limit uint64) Query {
+	return &paginatedQuery{Query: query, offset: offset, limit: limit}
+}
+
+func (pq *paginatedQuery) PaginationLimit() uint64 {
+	return pq.limit
+}
+
+func (pq *paginatedQuery) PaginationOffset() uint64 {
+	return pq.offset
+}
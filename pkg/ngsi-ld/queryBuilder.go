@@ -0,0 +1,283 @@
+package ngsi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//QueryBuilder is used to create queries programmatically, without an incoming HTTP request,
+//for instance from background jobs that need to query a ContextRegistry.
+//
+//	query, err := ngsi.NewQuery().WithTypes("WeatherObserved").WithLimit(10).Build()
+type QueryBuilder struct {
+	types      []string
+	attributes []string
+	q          string
+
+	limit  *uint64
+	offset uint64
+	count  bool
+
+	geoQuery      *GeoQuery
+	temporalQuery *TemporalQuery
+}
+
+//NewQuery returns a QueryBuilder for a query that does not yet have any restrictions
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+//WithTypes restricts the query to entities of any of the given types
+func (qb *QueryBuilder) WithTypes(types ...string) *QueryBuilder {
+	qb.types = append(qb.types, types...)
+	return qb
+}
+
+//WithAttributes restricts the query to entities that have any of the given attributes
+func (qb *QueryBuilder) WithAttributes(attributes ...string) *QueryBuilder {
+	qb.attributes = append(qb.attributes, attributes...)
+	return qb
+}
+
+//WithQ adds a query language expression, in the same format as the q parameter, that the
+//entities must match. The expression is parsed when the query is built.
+func (qb *QueryBuilder) WithQ(q string) *QueryBuilder {
+	qb.q = q
+	return qb
+}
+
+//WithGeo restricts the query to entities that match a geo-query
+func (qb *QueryBuilder) WithGeo(geoQuery GeoQuery) *QueryBuilder {
+	qb.geoQuery = &geoQuery
+	return qb
+}
+
+//WithTemporal restricts the query to entities that match a temporal query
+func (qb *QueryBuilder) WithTemporal(temporalQuery TemporalQuery) *QueryBuilder {
+	qb.temporalQuery = &temporalQuery
+	return qb
+}
+
+//WithLimit sets the maximum number of entities that should be returned
+func (qb *QueryBuilder) WithLimit(limit uint64) *QueryBuilder {
+	qb.limit = &limit
+	return qb
+}
+
+//WithOffset sets the number of matching entities that should be skipped
+func (qb *QueryBuilder) WithOffset(offset uint64) *QueryBuilder {
+	qb.offset = offset
+	return qb
+}
+
+//WithCount requests that the total number of matching entities is counted
+func (qb *QueryBuilder) WithCount() *QueryBuilder {
+	qb.count = true
+	return qb
+}
+
+//Build validates the query and returns it. The Request method of the returned query returns nil.
+func (qb *QueryBuilder) Build() (Query, error) {
+	if len(qb.types) == 0 && len(qb.attributes) == 0 {
+		return nil, errors.New("a query must specify at least one entity type or attribute")
+	}
+
+	if qb.limit != nil && *qb.limit == 0 && !qb.count {
+		return nil, errors.New("a limit of 0 is only allowed when count is also requested")
+	}
+
+	qw := &queryWrapper{
+		types:         qb.types,
+		attributes:    qb.attributes,
+		limit:         qb.limit,
+		offset:        qb.offset,
+		count:         qb.count,
+		geoQuery:      qb.geoQuery,
+		temporalQuery: qb.temporalQuery,
+	}
+
+	// An empty name means "any type" or "any attribute", just like in queries from HTTP requests
+	if len(qw.types) == 0 {
+		qw.types = []string{""}
+	}
+
+	if len(qw.attributes) == 0 {
+		qw.attributes = []string{""}
+	}
+
+	if qb.q != "" {
+		var err error
+		qw.filter, err = ParseQueryExpression(qb.q)
+		if err != nil {
+			return nil, err
+		}
+		qw.filterText = qb.q
+		qw.device = findDeviceReference(qw.filter)
+	}
+
+	return qw, nil
+}
+
+//NewGeoQueryNearPoint creates a geo-query that matches entities within maxDistance meters
+//from the position lon, lat
+func NewGeoQueryNearPoint(lon, lat float64, maxDistance uint32) GeoQuery {
+	return GeoQuery{
+		Geometry:    "Point",
+		Coordinates: []float64{lon, lat},
+		GeoRel:      GeoSpatialRelationNearPoint,
+		distance:    maxDistance,
+	}
+}
+
+//NewGeoQueryWithinRect creates a geo-query that matches entities within the rectangle that
+//has the positions lon0, lat0 and lon1, lat1 as its opposing corners
+func NewGeoQueryWithinRect(lon0, lat0, lon1, lat1 float64) GeoQuery {
+	return GeoQuery{
+		Geometry:    "Polygon",
+		Coordinates: []float64{lon0, lat0, lon1, lat0, lon1, lat1},
+		GeoRel:      GeoSpatialRelationWithinRect,
+	}
+}
+
+//NewTemporalQueryAfterTime creates a temporal query that matches entities observed at or after timeAt
+func NewTemporalQueryAfterTime(timeAt time.Time) TemporalQuery {
+	return TemporalQuery{timerel: TemporalRelationAfterTime, timeAt: timeAt, timeProperty: "observedAt"}
+}
+
+//NewTemporalQueryBeforeTime creates a temporal query that matches entities observed before endTimeAt
+func NewTemporalQueryBeforeTime(endTimeAt time.Time) TemporalQuery {
+	return TemporalQuery{timerel: TemporalRelationBeforeTime, endTimeAt: endTimeAt, timeProperty: "observedAt"}
+}
+
+//NewTemporalQueryBetweenTimes creates a temporal query that matches entities observed at or after
+//timeAt, but before endTimeAt
+func NewTemporalQueryBetweenTimes(timeAt, endTimeAt time.Time) TemporalQuery {
+	return TemporalQuery{timerel: TemporalRelationBetweenTimes, timeAt: timeAt, endTimeAt: endTimeAt, timeProperty: "observedAt"}
+}
+
+//WithTimeProperty returns a copy of the temporal query that is applied to another temporal
+//property than the default observedAt
+func (tq TemporalQuery) WithTimeProperty(timeProperty string) TemporalQuery {
+	tq.timeProperty = timeProperty
+	return tq
+}
+
+//queryParameters converts a query into the URL parameters that express the same query
+//in an NGSI-LD request
+func queryParameters(query Query) url.Values {
+	params := url.Values{}
+
+	join := func(values []string) string {
+		nonEmpty := []string{}
+		for _, v := range values {
+			if v != "" {
+				nonEmpty = append(nonEmpty, v)
+			}
+		}
+		return strings.Join(nonEmpty, ",")
+	}
+
+	if types := join(query.EntityTypes()); types != "" {
+		params.Set("type", types)
+	}
+
+	if attributes := join(query.EntityAttributes()); attributes != "" {
+		params.Set("attrs", attributes)
+	}
+
+	// The q parameter is forwarded as it was sent, since formatting the parsed filter would
+	// change how its values are written
+	if query.HasFilter() {
+		params.Set("q", query.FilterText())
+	}
+
+	if query.IsGeoQuery() {
+		geo := query.Geo()
+
+		georel := geo.GeoRel
+		if georel == GeoSpatialRelationNearPoint {
+			distance, _ := geo.Distance()
+			georel = fmt.Sprintf("%s;maxDistance==%d", georel, distance)
+		}
+
+		params.Set("georel", georel)
+		params.Set("geometry", geo.Geometry)
+		params.Set("coordinates", formatGeometryCoordinates(geo.Geometry, geo.Coordinates))
+
+		if geo.GeoProperty != nil {
+			params.Set("geoproperty", *geo.GeoProperty)
+		}
+	}
+
+	if query.IsTemporalQuery() {
+		temporal := query.Temporal()
+		timeAt, endTimeAt := temporal.TimeSpan()
+
+		params.Set("timerel", temporal.timerel)
+		if temporal.timerel == TemporalRelationBeforeTime {
+			params.Set("timeAt", endTimeAt.Format(time.RFC3339))
+		} else {
+			params.Set("timeAt", timeAt.Format(time.RFC3339))
+		}
+		if temporal.timerel == TemporalRelationBetweenTimes {
+			params.Set("endTimeAt", endTimeAt.Format(time.RFC3339))
+		}
+		params.Set("timeproperty", temporal.Property())
+	}
+
+	params.Set("limit", strconv.FormatUint(query.PaginationLimit(), 10))
+	params.Set("offset", strconv.FormatUint(query.PaginationOffset(), 10))
+
+	if query.CountRequested() {
+		params.Set("count", "true")
+	}
+
+	return params
+}
+
+//modelledQueryParameters are the URL parameters that queryParameters derives from a query. Any
+//other parameters in an incoming request are not understood by the query and have to be passed
+//on as they are.
+var modelledQueryParameters = []string{
+	"type", "attrs", "q",
+	"georel", "geometry", "coordinates", "geoproperty",
+	"timerel", "timeAt", "endTimeAt", "timeproperty",
+	"limit", "offset", "count",
+}
+
+//unmodelledQueryParameters returns the parameters of a request that a query does not model
+func unmodelledQueryParameters(req *http.Request) url.Values {
+	params := url.Values{}
+
+	for name, values := range req.URL.Query() {
+		if !containsString(modelledQueryParameters, name) {
+			params[name] = values
+		}
+	}
+
+	return params
+}
+
+//formatGeometryCoordinates formats a flat list of coordinates as the coordinates parameter
+//of a geo-query, i.e. [lon,lat] for a Point and [[lon,lat],[lon,lat],...] for other geometries
+func formatGeometryCoordinates(geometry string, coordinates []float64) string {
+	positions := []string{}
+
+	for i := 0; i+1 < len(coordinates); i += 2 {
+		positions = append(positions, fmt.Sprintf("[%s,%s]",
+			strconv.FormatFloat(coordinates[i], 'f', -1, 64),
+			strconv.FormatFloat(coordinates[i+1], 'f', -1, 64),
+		))
+	}
+
+	if geometry == "Point" && len(positions) == 1 {
+		return positions[0]
+	}
+
+	return "[" + strings.Join(positions, ",") + "]"
+}
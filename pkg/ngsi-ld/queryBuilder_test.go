@@ -0,0 +1,96 @@
+package ngsi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestBuildQuery(t *testing.T) {
+	is := is.New(t)
+
+	query, err := NewQuery().WithTypes("WeatherObserved").WithQ("temperature>5").WithLimit(10).WithOffset(20).Build()
+
+	is.NoErr(err)                                              // failed to build query
+	is.Equal(query.EntityTypes(), []string{"WeatherObserved"}) // unexpected entity types
+	is.True(query.HasFilter())                                 // query should have a filter
+	is.Equal(query.PaginationLimit(), uint64(10))              // unexpected pagination limit
+	is.Equal(query.PaginationOffset(), uint64(20))             // unexpected pagination offset
+	is.True(query.Request() == nil)                            // a built query should not have a request
+}
+
+func TestThatTheQIsForwardedAsItWasSent(t *testing.T) {
+	is := is.New(t)
+
+	q := `name==abc;dateObserved>2020-04-08T15:00:00Z;snowHeight>=0.50`
+	query, err := NewQuery().WithTypes("WeatherObserved").WithQ(q).Build()
+	is.NoErr(err) // failed to build query
+
+	is.Equal(queryParameters(query).Get("q"), q) // the q parameter should not be rewritten
+}
+
+func TestBuildQueryWithoutTypesOrAttributesFails(t *testing.T) {
+	is := is.New(t)
+
+	_, err := NewQuery().WithLimit(10).Build()
+	is.True(err != nil) // should return an error
+}
+
+func TestBuildQueryWithInvalidFilterFails(t *testing.T) {
+	is := is.New(t)
+
+	_, err := NewQuery().WithTypes("WeatherObserved").WithQ("temperature>").Build()
+	is.True(err != nil) // should return an error
+}
+
+func TestThatBuiltQueriesCanBeSentToRemoteContextSources(t *testing.T) {
+	is := is.New(t)
+
+	var forwardedQuery url.Values
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedQuery = r.URL.Query()
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(snowHeightResponseJSON))
+	}))
+	defer mockService.Close()
+
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight"}, mockService.URL, nil)
+	contextSource, _ := NewRemoteContextSource(registration)
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+
+	observedAt, _ := time.Parse(time.RFC3339, "2020-04-08T15:00:00Z")
+
+	query, err := NewQuery().
+		WithTypes("WeatherObserved").
+		WithQ(`snowHeight>=0;refDevice=="urn:ngsi-ld:Device:snow_10a52aaa84c35727"`).
+		WithGeo(NewGeoQueryNearPoint(16.5, 62.4, 10000)).
+		WithTemporal(NewTemporalQueryAfterTime(observedAt).WithTimeProperty("dateObserved")).
+		WithLimit(5).
+		Build()
+	is.NoErr(err) // failed to build query
+
+	numEntities := 0
+	for _, source := range ctxRegistry.GetContextSourcesForQuery(query) {
+		err = source.GetEntities(query, func(entity Entity) error {
+			numEntities++
+			return nil
+		})
+		is.NoErr(err) // failed to get entities from the remote source
+	}
+
+	is.Equal(numEntities, 1)                                                                                 // failed to get entities from remote endpoint
+	is.Equal(forwardedQuery.Get("type"), "WeatherObserved")                                                  // unexpected type parameter
+	is.Equal(forwardedQuery.Get("q"), `snowHeight>=0;refDevice=="urn:ngsi-ld:Device:snow_10a52aaa84c35727"`) // unexpected q parameter
+	is.Equal(forwardedQuery.Get("georel"), "near;maxDistance==10000")                                        // unexpected georel parameter
+	is.Equal(forwardedQuery.Get("coordinates"), "[16.5,62.4]")                                               // unexpected coordinates parameter
+	is.Equal(forwardedQuery.Get("timerel"), "after")                                                         // unexpected timerel parameter
+	is.Equal(forwardedQuery.Get("timeAt"), "2020-04-08T15:00:00Z")                                           // unexpected timeAt parameter
+	is.Equal(forwardedQuery.Get("timeproperty"), "dateObserved")                                             // unexpected timeproperty parameter
+	is.Equal(forwardedQuery.Get("limit"), "5")                                                               // unexpected limit parameter
+}
@@ -0,0 +1,484 @@
+package ngsi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//QueryExpression is a node in the syntax tree that results from parsing an NGSI-LD
+//query language expression, i.e. the contents of the q parameter
+type QueryExpression interface {
+	String() string
+}
+
+const (
+	//QueryLogicalAnd is the operator of a QueryLogicalExpression where all operands must match
+	QueryLogicalAnd = ";"
+	//QueryLogicalOr is the operator of a QueryLogicalExpression where any operand must match
+	QueryLogicalOr = "|"
+
+	//QueryOperatorExists is used for query terms that only name an attribute
+	QueryOperatorExists = ""
+	//QueryOperatorEqual matches values that are equal to, within the range of, or in the list of values
+	QueryOperatorEqual = "=="
+	//QueryOperatorUnequal matches values that are not equal to, outside the range of, or not in the list of values
+	QueryOperatorUnequal = "!="
+	//QueryOperatorGreater matches values that are greater than the query value
+	QueryOperatorGreater = ">"
+	//QueryOperatorGreaterEqual matches values that are greater than or equal to the query value
+	QueryOperatorGreaterEqual = ">="
+	//QueryOperatorLess matches values that are less than the query value
+	QueryOperatorLess = "<"
+	//QueryOperatorLessEqual matches values that are less than or equal to the query value
+	QueryOperatorLessEqual = "<="
+	//QueryOperatorMatchPattern matches string values against a regular expression
+	QueryOperatorMatchPattern = "~="
+	//QueryOperatorNotMatchPattern matches string values that do not match a regular expression
+	QueryOperatorNotMatchPattern = "!~="
+)
+
+//QueryLogicalExpression combines two or more expressions with either AND or OR
+type QueryLogicalExpression struct {
+	Operator string
+	Operands []QueryExpression
+}
+
+func (qle *QueryLogicalExpression) String() string {
+	operands := []string{}
+	for _, o := range qle.Operands {
+		if nested, ok := o.(*QueryLogicalExpression); ok && nested.Operator != qle.Operator {
+			operands = append(operands, "("+o.String()+")")
+		} else {
+			operands = append(operands, o.String())
+		}
+	}
+	return strings.Join(operands, qle.Operator)
+}
+
+//QueryAttributePath identifies the attribute, or a part of an attribute, that a query
+//term should be applied to. A dotted path such as temperature.observedAt is stored as
+//Name "temperature" and SubAttributes ["observedAt"], while a bracketed path such as
+//address[city] is stored as Name "address" and CompoundPath ["city"].
+type QueryAttributePath struct {
+	Name          string
+	SubAttributes []string
+	CompoundPath  []string
+}
+
+func (qap QueryAttributePath) String() string {
+	path := qap.Name
+	for _, sub := range qap.SubAttributes {
+		path = path + "." + sub
+	}
+	for _, key := range qap.CompoundPath {
+		path = path + "[" + key + "]"
+	}
+	return path
+}
+
+//QueryValueRange is used as the value in a query term such as temperature==10..20
+type QueryValueRange struct {
+	From interface{}
+	To   interface{}
+}
+
+//QueryValueList is used as the value in a query term such as color=="red","blue"
+type QueryValueList []interface{}
+
+//QueryComparison is a single query term that compares an attribute with a value. The
+//Value is a string, float64, bool, time.Time, QueryValueRange or QueryValueList and is
+//nil when the Operator is QueryOperatorExists.
+type QueryComparison struct {
+	Attribute QueryAttributePath
+	Operator  string
+	Value     interface{}
+
+	pattern queryPattern
+}
+
+//queryPattern holds the compiled regular expression of a pattern comparison, so that it is
+//compiled once rather than for every entity that the comparison is matched against
+type queryPattern struct {
+	once sync.Once
+	re   *regexp.Regexp
+}
+
+//compiledPattern returns the regular expression of a pattern comparison, or nil if the value
+//is not a valid regular expression
+func (qc *QueryComparison) compiledPattern() *regexp.Regexp {
+	qc.pattern.once.Do(func() {
+		if pattern, ok := qc.Value.(string); ok {
+			qc.pattern.re, _ = regexp.Compile(pattern)
+		}
+	})
+	return qc.pattern.re
+}
+
+func (qc *QueryComparison) String() string {
+	if qc.Operator == QueryOperatorExists {
+		return qc.Attribute.String()
+	}
+	return qc.Attribute.String() + qc.Operator + formatQueryValue(qc.Value)
+}
+
+func formatQueryValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case QueryValueRange:
+		return formatQueryValue(v.From) + ".." + formatQueryValue(v.To)
+	case QueryValueList:
+		values := []string{}
+		for _, lv := range v {
+			values = append(values, formatQueryValue(lv))
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+//QueryParseError is returned when a query language expression can not be parsed
+type QueryParseError struct {
+	Position int
+	Message  string
+}
+
+func (qpe *QueryParseError) Error() string {
+	return fmt.Sprintf("invalid q parameter at position %d: %s", qpe.Position, qpe.Message)
+}
+
+//ParseQueryExpression parses an NGSI-LD query language expression. The AND operator (;)
+//has precedence over the OR operator (|) and parentheses may be used to group terms.
+func ParseQueryExpression(q string) (QueryExpression, error) {
+	p := &queryParser{input: q}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.atEnd() {
+		return nil, p.errorf("unexpected character '%c'", p.peek())
+	}
+
+	return expr, nil
+}
+
+type queryParser struct {
+	input string
+	pos   int
+}
+
+func (p *queryParser) atEnd() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return &QueryParseError{Position: p.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *queryParser) parseOr() (QueryExpression, error) {
+	return p.parseLogical(QueryLogicalOr, p.parseAnd)
+}
+
+func (p *queryParser) parseAnd() (QueryExpression, error) {
+	return p.parseLogical(QueryLogicalAnd, p.parseTerm)
+}
+
+func (p *queryParser) parseLogical(operator string, parseOperand func() (QueryExpression, error)) (QueryExpression, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []QueryExpression{operand}
+
+	for !p.atEnd() && p.peek() == operator[0] {
+		p.pos++
+		operand, err = parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+
+	return &QueryLogicalExpression{Operator: operator, Operands: operands}, nil
+}
+
+func (p *queryParser) parseTerm() (QueryExpression, error) {
+	if p.atEnd() {
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	if p.peek() == '(' {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	}
+
+	attribute, err := p.parseAttributePath()
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := &QueryComparison{Attribute: attribute}
+
+	operatorPos := p.pos
+	comparison.Operator = p.parseOperator()
+
+	switch comparison.Operator {
+	case QueryOperatorExists:
+		return comparison, nil
+	case QueryOperatorMatchPattern, QueryOperatorNotMatchPattern:
+		comparison.Value, err = p.parsePattern()
+	case QueryOperatorEqual, QueryOperatorUnequal:
+		comparison.Value, err = p.parseEqualityValue()
+	default:
+		comparison.Value, err = p.parseValue()
+		if err == nil {
+			switch comparison.Value.(type) {
+			case bool:
+				err = &QueryParseError{Position: operatorPos, Message: "boolean values can only be compared with == or !="}
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return comparison, nil
+}
+
+func isAttributeNameByte(b byte) bool {
+	return !strings.ContainsRune("=!<>~;|()[].,\" \t", rune(b))
+}
+
+func (p *queryParser) parseName() (string, error) {
+	start := p.pos
+	for !p.atEnd() && isAttributeNameByte(p.peek()) {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.atEnd() {
+			return "", p.errorf("expected an attribute name but reached the end of the expression")
+		}
+		return "", p.errorf("expected an attribute name but found '%c'", p.peek())
+	}
+	return p.input[start:p.pos], nil
+}
+
+func (p *queryParser) parseAttributePath() (QueryAttributePath, error) {
+	path := QueryAttributePath{}
+
+	var err error
+	path.Name, err = p.parseName()
+	if err != nil {
+		return path, err
+	}
+
+	for p.peek() == '.' {
+		p.pos++
+		sub, err := p.parseName()
+		if err != nil {
+			return path, err
+		}
+		path.SubAttributes = append(path.SubAttributes, sub)
+	}
+
+	for p.peek() == '[' {
+		p.pos++
+		key, err := p.parseName()
+		if err != nil {
+			return path, err
+		}
+		if p.peek() != ']' {
+			return path, p.errorf("missing closing bracket in attribute path")
+		}
+		p.pos++
+		path.CompoundPath = append(path.CompoundPath, key)
+	}
+
+	return path, nil
+}
+
+func (p *queryParser) parseOperator() string {
+	// Longer operators must be tested before their prefixes
+	operators := []string{
+		QueryOperatorNotMatchPattern, QueryOperatorEqual, QueryOperatorUnequal,
+		QueryOperatorGreaterEqual, QueryOperatorLessEqual, QueryOperatorMatchPattern,
+		"=~", QueryOperatorGreater, QueryOperatorLess,
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			if op == "=~" {
+				// Accept =~ as an alias for the pattern operator ~=
+				return QueryOperatorMatchPattern
+			}
+			return op
+		}
+	}
+
+	return QueryOperatorExists
+}
+
+func (p *queryParser) parsePattern() (interface{}, error) {
+	if p.peek() == '"' {
+		return p.parseQuotedString()
+	}
+
+	// An unquoted pattern may use parentheses and alternation, so it ends at the first ; that
+	// is outside of its own parentheses, or at a ) that closes a group around the query term
+	start := p.pos
+	depth := 0
+	for ; !p.atEnd(); p.pos++ {
+		c := p.peek()
+		if c == '\\' && p.pos+1 < len(p.input) {
+			p.pos++
+		} else if c == '(' {
+			depth++
+		} else if c == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		} else if c == ';' && depth == 0 {
+			break
+		}
+	}
+
+	if start == p.pos {
+		return nil, p.errorf("missing regular expression")
+	}
+
+	return p.input[start:p.pos], nil
+}
+
+func (p *queryParser) parseEqualityValue() (interface{}, error) {
+	first, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(p.input[p.pos:], "..") {
+		p.pos += 2
+		last, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return QueryValueRange{From: first, To: last}, nil
+	}
+
+	if p.peek() != ',' {
+		return first, nil
+	}
+
+	values := QueryValueList{first}
+	for p.peek() == ',' {
+		p.pos++
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func (p *queryParser) parseValue() (interface{}, error) {
+	if p.atEnd() {
+		return nil, p.errorf("expected a value but reached the end of the expression")
+	}
+
+	if p.peek() == '"' {
+		return p.parseQuotedString()
+	}
+
+	start := p.pos
+	for !p.atEnd() && !strings.ContainsRune(";|),", rune(p.peek())) {
+		if strings.HasPrefix(p.input[p.pos:], "..") {
+			break
+		}
+		p.pos++
+	}
+
+	token := p.input[start:p.pos]
+	if token == "" {
+		return nil, p.errorf("expected a value but found '%c'", p.peek())
+	}
+
+	if token == "true" || token == "false" {
+		return token == "true", nil
+	}
+
+	if number, err := strconv.ParseFloat(token, 64); err == nil {
+		return number, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, token); err == nil {
+			return t, nil
+		}
+	}
+
+	if strings.ContainsAny(token, "()[]\"=<>!~") {
+		return nil, &QueryParseError{Position: start, Message: fmt.Sprintf("invalid value %s", token)}
+	}
+
+	// Anything else, such as URIs and times of day, is treated as an unquoted string
+	return token, nil
+}
+
+func (p *queryParser) parseQuotedString() (interface{}, error) {
+	start := p.pos
+	p.pos++ // skip the opening quote
+
+	var sb strings.Builder
+
+	for !p.atEnd() {
+		b := p.peek()
+		p.pos++
+
+		if b == '\\' && !p.atEnd() {
+			sb.WriteByte(p.peek())
+			p.pos++
+		} else if b == '"' {
+			return sb.String(), nil
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+
+	return nil, &QueryParseError{Position: start, Message: "unterminated string"}
+}
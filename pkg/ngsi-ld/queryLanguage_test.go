@@ -0,0 +1,156 @@
+package ngsi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestParseSimpleComparison(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression("temperature>=20.5")
+	is.NoErr(err) // failed to parse expression
+
+	comparison, ok := expr.(*QueryComparison)
+	is.True(ok)                                              // expected a comparison
+	is.Equal(comparison.Attribute.Name, "temperature")       // unexpected attribute name
+	is.Equal(comparison.Operator, QueryOperatorGreaterEqual) // unexpected operator
+	is.Equal(comparison.Value, 20.5)                         // unexpected value
+}
+
+func TestParseAllComparisonOperators(t *testing.T) {
+	is := is.New(t)
+
+	operators := map[string]string{
+		"a==1": QueryOperatorEqual, "a!=1": QueryOperatorUnequal,
+		"a>1": QueryOperatorGreater, "a>=1": QueryOperatorGreaterEqual,
+		"a<1": QueryOperatorLess, "a<=1": QueryOperatorLessEqual,
+		"a~=x.*": QueryOperatorMatchPattern, "a=~x.*": QueryOperatorMatchPattern,
+		"a!~=x.*": QueryOperatorNotMatchPattern, "a": QueryOperatorExists,
+	}
+
+	for q, expectedOperator := range operators {
+		expr, err := ParseQueryExpression(q)
+		is.NoErr(err) // failed to parse expression
+		is.Equal(expr.(*QueryComparison).Operator, expectedOperator)
+	}
+}
+
+func TestParseQuotedStringWithEscapedQuote(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression(`name=="say \"hi\"";other==1`)
+	is.NoErr(err) // failed to parse expression
+
+	and := expr.(*QueryLogicalExpression)
+	is.Equal(and.Operands[0].(*QueryComparison).Value, `say "hi"`) // escaped quotes were not handled
+}
+
+func TestParseRangeAndValueList(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression(`temperature==10..20;color=="red","blue"`)
+	is.NoErr(err) // failed to parse expression
+
+	and := expr.(*QueryLogicalExpression)
+	is.Equal(and.Operator, QueryLogicalAnd) // expected an AND expression
+	is.Equal(len(and.Operands), 2)          // expected two operands
+
+	is.Equal(and.Operands[0].(*QueryComparison).Value, QueryValueRange{From: 10.0, To: 20.0}) // unexpected range
+	is.Equal(and.Operands[1].(*QueryComparison).Value, QueryValueList{"red", "blue"})         // unexpected value list
+}
+
+func TestParseDateTimeRange(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression(`dateObserved==2020-04-08T15:00:00Z..2020-04-08T16:00:00.5Z`)
+	is.NoErr(err) // failed to parse expression
+
+	from, _ := time.Parse(time.RFC3339, "2020-04-08T15:00:00Z")
+	rng := expr.(*QueryComparison).Value.(QueryValueRange)
+	is.Equal(rng.From, from) // unexpected start of range
+}
+
+func TestParseAndHasPrecedenceOverOr(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression("a==1|b==2;c==3")
+	is.NoErr(err) // failed to parse expression
+
+	or := expr.(*QueryLogicalExpression)
+	is.Equal(or.Operator, QueryLogicalOr) // top level operator should be OR
+	is.Equal(len(or.Operands), 2)
+
+	and := or.Operands[1].(*QueryLogicalExpression)
+	is.Equal(and.Operator, QueryLogicalAnd) // second operand should be an AND expression
+}
+
+func TestParseParentheses(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression("(a==1|b==2);c==3")
+	is.NoErr(err) // failed to parse expression
+
+	and := expr.(*QueryLogicalExpression)
+	is.Equal(and.Operator, QueryLogicalAnd)                                      // top level operator should be AND
+	is.Equal(and.Operands[0].(*QueryLogicalExpression).Operator, QueryLogicalOr) // grouped terms should form an OR expression
+	is.Equal(expr.String(), `(a==1|b==2);c==3`)                                  // unexpected string representation
+}
+
+func TestParseUnquotedPatterns(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression(`name~=(a|b)c;other==1`)
+	is.NoErr(err) // failed to parse expression
+
+	and := expr.(*QueryLogicalExpression)
+	is.Equal(and.Operands[0].(*QueryComparison).Value, "(a|b)c") // the pattern should run until the first ; outside parentheses
+
+	expr, err = ParseQueryExpression(`(name~=a|b);other==1`)
+	is.NoErr(err) // failed to parse expression
+
+	and = expr.(*QueryLogicalExpression)
+	is.Equal(and.Operands[0].(*QueryComparison).Value, "a|b") // the pattern should end where its group is closed
+}
+
+func TestParseAttributePaths(t *testing.T) {
+	is := is.New(t)
+
+	expr, err := ParseQueryExpression(`temperature.observedAt>=2020-01-01T00:00:00Z;address[addressLocality]=="Sundsvall"`)
+	is.NoErr(err) // failed to parse expression
+
+	and := expr.(*QueryLogicalExpression)
+	dotted := and.Operands[0].(*QueryComparison).Attribute
+	is.Equal(dotted.Name, "temperature")
+	is.Equal(dotted.SubAttributes, []string{"observedAt"})
+
+	bracketed := and.Operands[1].(*QueryComparison).Attribute
+	is.Equal(bracketed.Name, "address")
+	is.Equal(bracketed.CompoundPath, []string{"addressLocality"})
+}
+
+func TestParseErrorsReportPosition(t *testing.T) {
+	is := is.New(t)
+
+	invalid := map[string]int{
+		"a==1;":      5,
+		"(a==1":      5,
+		`a=="abc`:    3,
+		"a==1)":      4,
+		"a[b==1":     3,
+		"a>true":     1,
+		"a==1;;b==2": 5,
+	}
+
+	for q, position := range invalid {
+		_, err := ParseQueryExpression(q)
+		is.True(err != nil) // expected a parse error
+
+		var parseErr *QueryParseError
+		is.True(errors.As(err, &parseErr))    // expected a QueryParseError
+		is.Equal(parseErr.Position, position) // unexpected error position
+	}
+}
@@ -0,0 +1,539 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Matches evaluates the type, attrs, q, geo and temporal parts of the query against an
+//entity. Entities can be generic maps as well as the typed structs in pkg/datamodels,
+//in either normalized or simplified (keyValues) form, or GeoJSON features. Parts of the
+//query that can not be evaluated against the entity, such as a temporal query against an
+//entity without any timestamps, are not held against it.
+func (q *queryWrapper) Matches(entity Entity) bool {
+	return matchQuery(q, entity)
+}
+
+func matchQuery(q Query, entity Entity) bool {
+	e, err := entityAsMap(entity)
+	if err != nil {
+		return true
+	}
+
+	if !matchesEntityType(q.EntityTypes(), e) {
+		return false
+	}
+
+	if !matchesEntityAttributes(q.EntityAttributes(), e) {
+		return false
+	}
+
+	if q.HasFilter() && matchesQueryExpression(q.Filter(), e) == noMatch {
+		return false
+	}
+
+	if q.IsGeoQuery() && matchesGeoQuery(q.Geo(), e) == noMatch {
+		return false
+	}
+
+	if q.IsTemporalQuery() && matchesTemporalQuery(q.Temporal(), e) == noMatch {
+		return false
+	}
+
+	return true
+}
+
+//matchResult is the outcome of evaluating a part of a query against an entity
+type matchResult int
+
+const (
+	noMatch matchResult = iota
+	match
+	//unknownMatch means that the entity does not hold what is needed to evaluate the query,
+	//or holds it in a form that can not be compared with the query
+	unknownMatch
+)
+
+func matchedIf(matched bool) matchResult {
+	if matched {
+		return match
+	}
+	return noMatch
+}
+
+//not negates a result, leaving an unknown result as it is
+func (mr matchResult) not() matchResult {
+	switch mr {
+	case match:
+		return noMatch
+	case noMatch:
+		return match
+	}
+	return unknownMatch
+}
+
+//entityAsMap converts an entity into a generic map representation. GeoJSON features are
+//flattened so that their properties appear as entity attributes.
+func entityAsMap(entity Entity) (map[string]interface{}, error) {
+	e, ok := entity.(map[string]interface{})
+
+	if !ok {
+		bytes, err := json.Marshal(entity)
+		if err != nil {
+			return nil, err
+		}
+
+		e = map[string]interface{}{}
+		err = json.Unmarshal(bytes, &e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if e["type"] == "Feature" {
+		if properties, ok := e["properties"].(map[string]interface{}); ok {
+			flattened := map[string]interface{}{}
+			for k, v := range properties {
+				flattened[k] = v
+			}
+			if id, ok := e["id"]; ok {
+				flattened["id"] = id
+			}
+			if _, ok := flattened["location"]; !ok && e["geometry"] != nil {
+				flattened["location"] = e["geometry"]
+			}
+			e = flattened
+		}
+	}
+
+	return e, nil
+}
+
+func matchesEntityType(entityTypes []string, e map[string]interface{}) bool {
+	requested := false
+
+	for _, typeName := range entityTypes {
+		if typeName == "" {
+			continue
+		}
+		requested = true
+		if e["type"] == typeName {
+			return true
+		}
+	}
+
+	return !requested
+}
+
+func matchesEntityAttributes(attributes []string, e map[string]interface{}) bool {
+	requested := false
+
+	for _, attributeName := range attributes {
+		if attributeName == "" {
+			continue
+		}
+		requested = true
+		if _, ok := e[attributeName]; ok {
+			return true
+		}
+	}
+
+	return !requested
+}
+
+func matchesQueryExpression(expr QueryExpression, e map[string]interface{}) matchResult {
+	switch x := expr.(type) {
+	case *QueryLogicalExpression:
+		return matchesLogicalExpression(x, e)
+	case *QueryComparison:
+		return matchesComparison(x, e)
+	}
+
+	return unknownMatch
+}
+
+//matchesLogicalExpression combines the results of the operands. An AND expression fails as soon
+//as one operand fails and an OR expression succeeds as soon as one operand succeeds, no matter
+//how many of the other operands are unknown.
+func matchesLogicalExpression(x *QueryLogicalExpression, e map[string]interface{}) matchResult {
+	decisive, result := noMatch, match
+	if x.Operator == QueryLogicalOr {
+		decisive, result = match, noMatch
+	}
+
+	for _, operand := range x.Operands {
+		switch matchesQueryExpression(operand, e) {
+		case decisive:
+			return decisive
+		case unknownMatch:
+			result = unknownMatch
+		}
+	}
+
+	return result
+}
+
+func matchesComparison(qc *QueryComparison, e map[string]interface{}) matchResult {
+	value, ok := resolveAttributePath(qc.Attribute, e)
+	if !ok {
+		return noMatch
+	}
+
+	if qc.Operator == QueryOperatorExists {
+		return match
+	}
+
+	// An array of values matches if any of its elements does
+	if values, isArray := value.([]interface{}); isArray {
+		result := noMatch
+		for _, v := range values {
+			switch matchesComparisonValue(qc, v) {
+			case match:
+				return match
+			case unknownMatch:
+				result = unknownMatch
+			}
+		}
+		return result
+	}
+
+	return matchesComparisonValue(qc, value)
+}
+
+func matchesComparisonValue(qc *QueryComparison, value interface{}) matchResult {
+	operator, queryValue := qc.Operator, qc.Value
+
+	switch operator {
+	case QueryOperatorEqual:
+		return equalsQueryValue(value, queryValue)
+	case QueryOperatorUnequal:
+		return equalsQueryValue(value, queryValue).not()
+	case QueryOperatorMatchPattern, QueryOperatorNotMatchPattern:
+		str, ok := value.(string)
+		re := qc.compiledPattern()
+		if !ok || re == nil {
+			return unknownMatch
+		}
+		return matchedIf(re.MatchString(str) == (operator == QueryOperatorMatchPattern))
+	}
+
+	cmp, ok := compareValues(value, queryValue)
+	if !ok {
+		return unknownMatch
+	}
+
+	switch operator {
+	case QueryOperatorGreater:
+		return matchedIf(cmp > 0)
+	case QueryOperatorGreaterEqual:
+		return matchedIf(cmp >= 0)
+	case QueryOperatorLess:
+		return matchedIf(cmp < 0)
+	case QueryOperatorLessEqual:
+		return matchedIf(cmp <= 0)
+	}
+
+	return unknownMatch
+}
+
+func equalsQueryValue(value, queryValue interface{}) matchResult {
+	switch qv := queryValue.(type) {
+	case QueryValueRange:
+		from, fromOK := compareValues(value, qv.From)
+		to, toOK := compareValues(value, qv.To)
+		if !fromOK || !toOK {
+			return unknownMatch
+		}
+		return matchedIf(from >= 0 && to <= 0)
+	case QueryValueList:
+		result := noMatch
+		for _, listValue := range qv {
+			switch equalsQueryValue(value, listValue) {
+			case match:
+				return match
+			case unknownMatch:
+				result = unknownMatch
+			}
+		}
+		return result
+	case bool:
+		b, ok := value.(bool)
+		if !ok {
+			return unknownMatch
+		}
+		return matchedIf(b == qv)
+	}
+
+	cmp, ok := compareValues(value, queryValue)
+	if !ok {
+		return unknownMatch
+	}
+	return matchedIf(cmp == 0)
+}
+
+//compareValues compares an entity value with a query value and returns -1, 0 or 1 together
+//with a flag telling if the two values could be compared at all
+func compareValues(value, queryValue interface{}) (int, bool) {
+	switch qv := queryValue.(type) {
+	case float64:
+		switch v := value.(type) {
+		case float64:
+			return compareFloats(v, qv), true
+		case string:
+			// An unquoted number in the query may just as well be meant as a string, such
+			// as a postal code, so compare it with string attributes as it was written
+			return strings.Compare(v, strconv.FormatFloat(qv, 'f', -1, 64)), true
+		}
+	case string:
+		if v, ok := value.(string); ok {
+			return strings.Compare(v, qv), true
+		}
+	case time.Time:
+		if v, ok := value.(string); ok {
+			if t, ok := parseTimeValue(v); ok {
+				if t.Before(qv) {
+					return -1, true
+				} else if t.After(qv) {
+					return 1, true
+				}
+				return 0, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func parseTimeValue(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+//resolveAttributePath finds the value that an attribute path refers to. Normalized
+//attributes are unwrapped so that their value (or object for relationships) is returned.
+func resolveAttributePath(path QueryAttributePath, e map[string]interface{}) (interface{}, bool) {
+	attribute, ok := e[path.Name]
+	if !ok {
+		return nil, false
+	}
+
+	for _, sub := range path.SubAttributes {
+		m, ok := attribute.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		attribute, ok = m[sub]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	value := attributeValue(attribute)
+
+	for _, key := range path.CompoundPath {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+//attributeValue unwraps the value of a normalized attribute, or returns the attribute
+//itself if it is in simplified form
+func attributeValue(attribute interface{}) interface{} {
+	m, ok := attribute.(map[string]interface{})
+	if !ok {
+		return attribute
+	}
+
+	switch m["type"] {
+	case "Property", "GeoProperty":
+		value := m["value"]
+		// Unwrap typed JSON-LD values such as {"@type": "DateTime", "@value": "..."}
+		if typed, ok := value.(map[string]interface{}); ok {
+			if v, ok := typed["@value"]; ok {
+				return v
+			}
+		}
+		return value
+	case "Relationship":
+		return m["object"]
+	}
+
+	return attribute
+}
+
+func matchesGeoQuery(gq GeoQuery, e map[string]interface{}) matchResult {
+	propertyName := "location"
+	if gq.GeoProperty != nil {
+		propertyName = *gq.GeoProperty
+	}
+
+	property, ok := e[propertyName]
+	if !ok {
+		return noMatch
+	}
+
+	geometry, ok := attributeValue(property).(map[string]interface{})
+	if !ok {
+		return unknownMatch
+	}
+
+	positions := geometryPositions(geometry["coordinates"])
+	if len(positions) == 0 {
+		return unknownMatch
+	}
+
+	switch gq.GeoRel {
+	case GeoSpatialRelationNearPoint:
+		lon, lat, err := gq.Point()
+		if err != nil {
+			return unknownMatch
+		}
+		maxDistance, _ := gq.Distance()
+		for _, pos := range positions {
+			if haversineDistance(lon, lat, pos[0], pos[1]) <= float64(maxDistance) {
+				return match
+			}
+		}
+		return noMatch
+	case GeoSpatialRelationWithinRect:
+		lon0, lat0, lon1, lat1, err := gq.Rectangle()
+		if err != nil {
+			return unknownMatch
+		}
+		minLon, maxLon := math.Min(lon0, lon1), math.Max(lon0, lon1)
+		minLat, maxLat := math.Min(lat0, lat1), math.Max(lat0, lat1)
+		for _, pos := range positions {
+			if pos[0] < minLon || pos[0] > maxLon || pos[1] < minLat || pos[1] > maxLat {
+				return noMatch
+			}
+		}
+		return match
+	}
+
+	return unknownMatch
+}
+
+//geometryPositions collects all the [lon, lat] positions in a GeoJSON coordinates
+//member, regardless of how deeply they are nested
+func geometryPositions(coordinates interface{}) [][2]float64 {
+	positions := [][2]float64{}
+
+	c, ok := coordinates.([]interface{})
+	if !ok {
+		return positions
+	}
+
+	if len(c) >= 2 {
+		lon, lonOK := c[0].(float64)
+		lat, latOK := c[1].(float64)
+		if lonOK && latOK {
+			return append(positions, [2]float64{lon, lat})
+		}
+	}
+
+	for _, nested := range c {
+		positions = append(positions, geometryPositions(nested)...)
+	}
+
+	return positions
+}
+
+//haversineDistance returns the great circle distance in meters between two WGS84 positions
+func haversineDistance(lon0, lat0, lon1, lat1 float64) float64 {
+	const earthRadius float64 = 6371000.0
+
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180.0 }
+
+	dLat := toRadians(lat1 - lat0)
+	dLon := toRadians(lon1 - lon0)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat0))*math.Cos(toRadians(lat1))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+//temporalPropertyFallbacks maps the NGSI-LD temporal properties to the attributes
+//that the FIWARE data models use for the same purpose
+var temporalPropertyFallbacks = map[string]string{
+	"observedAt": "dateObserved",
+	"createdAt":  "dateCreated",
+	"modifiedAt": "dateModified",
+}
+
+func matchesTemporalQuery(tq TemporalQuery, e map[string]interface{}) matchResult {
+	timestamps := temporalValues(tq.Property(), e)
+
+	if len(timestamps) == 0 {
+		if fallback, ok := temporalPropertyFallbacks[tq.Property()]; ok {
+			timestamps = temporalValues(fallback, e)
+		}
+	}
+
+	// Simplified (keyValues) entities do not carry any timestamps, so there is nothing to go on
+	if len(timestamps) == 0 {
+		return unknownMatch
+	}
+
+	from, to := tq.TimeSpan()
+
+	for _, t := range timestamps {
+		if (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to)) {
+			return match
+		}
+	}
+
+	return noMatch
+}
+
+//temporalValues collects the timestamps stored in a temporal property, either as an entity
+//member (such as modifiedAt) or as a sub property of any of the attributes (such as observedAt)
+func temporalValues(property string, e map[string]interface{}) []time.Time {
+	timestamps := []time.Time{}
+
+	add := func(v interface{}) {
+		if str, ok := attributeValue(v).(string); ok {
+			if t, ok := parseTimeValue(str); ok {
+				timestamps = append(timestamps, t)
+			}
+		}
+	}
+
+	if v, ok := e[property]; ok {
+		add(v)
+	}
+
+	for _, attribute := range e {
+		if m, ok := attribute.(map[string]interface{}); ok {
+			if v, ok := m[property]; ok {
+				add(v)
+			}
+		}
+	}
+
+	return timestamps
+}
@@ -0,0 +1,287 @@
+package ngsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+	"github.com/matryer/is"
+)
+
+func newTestQuery(is *is.I, typeName, attributeName, q string, params ...string) Query {
+	req, _ := http.NewRequest("GET", createURL("/entities", params...), nil)
+	query, err := newQueryFromParameters(req, []string{typeName}, []string{attributeName}, q)
+	is.NoErr(err) // failed to create query
+	return query
+}
+
+func newTestWeatherObserved(observedAt string, temperature float64) *fiware.WeatherObserved {
+	wo := fiware.NewWeatherObserved("snow_10a52aaa84c35727", 62.4081681, 16.5687632, observedAt)
+	wo.Temperature = types.NewNumberProperty(temperature)
+	return wo
+}
+
+func TestQueryMatchesEntityType(t *testing.T) {
+	is := is.New(t)
+
+	wo := newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0)
+
+	is.True(newTestQuery(is, "WeatherObserved", "", "").Matches(wo)) // entity should match its own type
+	is.True(!newTestQuery(is, "RoadSegment", "", "").Matches(wo))    // entity should not match another type
+	is.True(newTestQuery(is, "", "temperature", "").Matches(wo))     // entity should match an attribute it has
+	is.True(!newTestQuery(is, "", "snowHeight", "").Matches(wo))     // entity should not match a missing attribute
+}
+
+func TestQueryMatchesFilterOnTypedEntity(t *testing.T) {
+	is := is.New(t)
+
+	wo := newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0)
+
+	is.True(newTestQuery(is, "WeatherObserved", "", "temperature>3").Matches(wo))                     // 4 > 3
+	is.True(!newTestQuery(is, "WeatherObserved", "", "temperature>=5").Matches(wo))                   // 4 < 5
+	is.True(newTestQuery(is, "WeatherObserved", "", "temperature==3..5").Matches(wo))                 // 4 is within range
+	is.True(newTestQuery(is, "WeatherObserved", "", "temperature==1,4,7").Matches(wo))                // 4 is in list
+	is.True(newTestQuery(is, "WeatherObserved", "", "temperature!=5").Matches(wo))                    // 4 != 5
+	is.True(!newTestQuery(is, "WeatherObserved", "", "temperature>3;snowHeight>0").Matches(wo))       // missing attribute in AND
+	is.True(newTestQuery(is, "WeatherObserved", "", "temperature>3|snowHeight>0").Matches(wo))        // missing attribute in OR
+	is.True(newTestQuery(is, "WeatherObserved", "", `refDevice~="snow_.+"`).Matches(wo))              // relationship object should match pattern
+	is.True(newTestQuery(is, "WeatherObserved", "", "dateObserved<2021-01-01T00:00:00Z").Matches(wo)) // date time values should be comparable
+}
+
+func TestThatPatternsAreCompiledOncePerQuery(t *testing.T) {
+	is := is.New(t)
+
+	query := newTestQuery(is, "WeatherObserved", "", `refDevice~="snow_.+"`)
+	comparison := query.Filter().(*QueryComparison)
+
+	is.True(query.Matches(newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0))) // the pattern should match
+	compiled := comparison.pattern.re
+	is.True(compiled != nil) // the pattern should have been compiled
+
+	is.True(query.Matches(newTestWeatherObserved("2020-04-08T15:02:32Z", 5.0))) // the pattern should match
+	is.True(comparison.pattern.re == compiled)                                  // the pattern should not be compiled again
+}
+
+func TestQueryMatchesFilterOnMapEntity(t *testing.T) {
+	is := is.New(t)
+
+	entity := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"id": "urn:ngsi-ld:Building:1", "type": "Building",
+		"address": {"type": "Property", "value": {"addressLocality": "Sundsvall"}},
+		"category": ["office", "shop"],
+		"open": true
+	}`), &entity)
+	is.NoErr(err)
+
+	is.True(newTestQuery(is, "Building", "", `address[addressLocality]=="Sundsvall"`).Matches(entity)) // compound path should match
+	is.True(newTestQuery(is, "Building", "", `category=="shop"`).Matches(entity))                      // simplified array should match any element
+	is.True(newTestQuery(is, "Building", "", `open==true`).Matches(entity))                            // booleans should match
+	is.True(!newTestQuery(is, "Building", "", `open==false`).Matches(entity))                          // booleans should not match
+}
+
+func TestQueryMatchesGeoQueryNearPoint(t *testing.T) {
+	is := is.New(t)
+
+	wo := newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0)
+
+	near := func(distance int) Query {
+		return newTestQuery(is, "WeatherObserved", "", "",
+			fmt.Sprintf("georel=near%%3BmaxDistance==%d", distance), "geometry=Point", "coordinates=[16.57,62.41]")
+	}
+
+	is.True(near(1000).Matches(wo)) // entity is within 1000 meters of the point
+	is.True(!near(100).Matches(wo)) // entity is further away than 100 meters
+}
+
+func TestQueryMatchesGeoQueryWithinRect(t *testing.T) {
+	is := is.New(t)
+
+	wo := newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0)
+
+	within := func(coords string) Query {
+		return newTestQuery(is, "WeatherObserved", "", "", "georel=within", "geometry=Polygon", "coordinates="+coords)
+	}
+
+	is.True(within("[[16,62],[17,62],[17,63]]").Matches(wo))  // entity is inside the rect
+	is.True(!within("[[17,62],[18,62],[18,63]]").Matches(wo)) // entity is outside the rect
+}
+
+func TestQueryMatchesTemporalQuery(t *testing.T) {
+	is := is.New(t)
+
+	entity := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"id": "urn:ngsi-ld:WeatherObserved:1", "type": "WeatherObserved",
+		"temperature": {"type": "Property", "value": 4.0, "observedAt": "2020-04-08T15:01:32Z"}
+	}`), &entity)
+
+	after := func(timeAt string) Query {
+		return newTestQuery(is, "WeatherObserved", "", "", "timerel=after", "timeAt="+timeAt)
+	}
+
+	is.True(after("2020-04-08T15:00:00Z").Matches(entity))  // observedAt is after timeAt
+	is.True(!after("2020-04-08T16:00:00Z").Matches(entity)) // observedAt is before timeAt
+
+	wo := newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0)
+	is.True(after("2020-04-08T15:00:00Z").Matches(wo)) // dateObserved should be used when there is no observedAt
+}
+
+func TestQueryMatchesGeoJSONFeature(t *testing.T) {
+	is := is.New(t)
+
+	feature := map[string]interface{}{}
+	json.Unmarshal([]byte(beachFeatureJSON), &feature)
+
+	is.True(newTestQuery(is, "Beach", "", `name=="Stranden"`).Matches(feature)) // feature properties should be matched
+}
+
+func TestQueryMatchesWhatItCanNotEvaluate(t *testing.T) {
+	is := is.New(t)
+
+	entity := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"id": "urn:ngsi-ld:Building:1", "type": "Building",
+		"postalCode": "85231", "temperature": 4.0
+	}`), &entity)
+
+	after := newTestQuery(is, "Building", "", "", "timerel=after", "timeAt=2020-04-08T15:00:00Z")
+
+	is.True(after.Matches(entity))                                                                 // an entity without timestamps should not be dropped
+	is.True(newTestQuery(is, "Building", "", "postalCode==85231").Matches(entity))                 // unquoted numbers should match strings
+	is.True(!newTestQuery(is, "Building", "", "postalCode==85232").Matches(entity))                // unquoted numbers should still be compared
+	is.True(newTestQuery(is, "Building", "", `temperature>"cold"`).Matches(entity))                // values of different types can not be compared
+	is.True(!newTestQuery(is, "Building", "", `temperature>"cold";temperature>5`).Matches(entity)) // a failing operand decides an AND
+}
+
+func TestQueryEntitiesHandlerDropsNonMatchingRemoteEntities(t *testing.T) {
+	is := is.New(t)
+
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Header().Add(ResultsCountHeader, "2")
+		if r.URL.Query().Get("offset") != "0" || r.URL.Query().Get("limit") == "0" {
+			w.Write([]byte("[]"))
+			return
+		}
+		// This source ignores the query and returns everything it has
+		warm := newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0)
+		cold := newTestWeatherObserved("2020-04-08T16:01:32Z", 2.0)
+		cold.ID = cold.ID + "2"
+		entities, _ := json.Marshal([]interface{}{warm, cold})
+		w.Write(entities)
+	}))
+	defer mockService.Close()
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newTestRemoteContextSource(mockService.URL))
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "q=temperature%3E3", "count=true"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	entities := []interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	is.Equal(w.Code, http.StatusOK)                   // unexpected response code
+	is.Equal(len(entities), 1)                        // the non matching entity should have been dropped
+	is.Equal(w.Header().Get(ResultsCountHeader), "2") // the count of the remote source should be trusted
+}
+
+func TestThatFilteringRemoteEntitiesRequestsALimitedNumberOfPages(t *testing.T) {
+	is := is.New(t)
+
+	var numRequests int32
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Header().Add(ResultsCountHeader, "1000")
+
+		// This source ignores both the query and the offset, and never runs out of entities
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		entities := []interface{}{}
+		for i := 0; i < limit; i++ {
+			wo := newTestWeatherObserved("2020-04-08T16:01:32Z", 2.0)
+			wo.ID = fmt.Sprintf("%s%d", wo.ID, int(atomic.LoadInt32(&numRequests))*limit+i)
+			entities = append(entities, wo)
+		}
+		body, _ := json.Marshal(entities)
+		w.Write(body)
+	}))
+	defer mockService.Close()
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newTestRemoteContextSource(mockService.URL))
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "q=temperature%3E3", "limit=10", "offset=10", "count=true"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                                      // unexpected response code
+	is.Equal(w.Header().Get(ResultsCountHeader), "1000")                 // the count of the remote source should be trusted
+	is.True(atomic.LoadInt32(&numRequests) <= int32(1+maxFilteredPages)) // the number of requested pages should be limited
+}
+
+func TestQueryEntitiesHandlerDoesNotFilterLocalEntities(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "q=temperature%3E3"), nil)
+	w := httptest.NewRecorder()
+
+	contextRegistry := NewContextRegistry()
+	contextSource := newMockedContextSource("WeatherObserved", "")
+	contextSource.GetEntitiesFunc = func(q Query, callback QueryEntitiesCallback) error {
+		// A local source is trusted to have applied the query itself
+		callback(newTestWeatherObserved("2020-04-08T15:01:32Z", 4.0))
+		callback(newTestWeatherObserved("2020-04-08T16:01:32Z", 2.0))
+		return nil
+	}
+	contextRegistry.Register(contextSource)
+
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	entities := []interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+
+	is.Equal(w.Code, http.StatusOK) // unexpected response code
+	is.Equal(len(entities), 2)      // entities from local sources should not be filtered
+}
+
+func TestThatFilteringRemoteEntitiesStopsWhenAPageBringsNothingNew(t *testing.T) {
+	is := is.New(t)
+
+	var numRequests int32
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.Header().Add("Content-Type", "application/ld+json")
+
+		// This source ignores both the query and the offset, and returns the same page every time
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		entities := []interface{}{}
+		for i := 0; i < limit; i++ {
+			wo := newTestWeatherObserved("2020-04-08T16:01:32Z", 2.0)
+			wo.ID = fmt.Sprintf("%s%d", wo.ID, i)
+			entities = append(entities, wo)
+		}
+		body, _ := json.Marshal(entities)
+		w.Write(body)
+	}))
+	defer mockService.Close()
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newTestRemoteContextSource(mockService.URL))
+
+	req, _ := http.NewRequest("GET", createURL("/entities", "type=WeatherObserved", "q=temperature%3E3", "limit=10"), nil)
+	w := httptest.NewRecorder()
+	NewQueryEntitiesHandler(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                    // unexpected response code
+	is.Equal(w.Body.String(), "[]")                    // none of the entities match the query
+	is.Equal(atomic.LoadInt32(&numRequests), int32(2)) // the scan should stop when a page brings nothing new
+}
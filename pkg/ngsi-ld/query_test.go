@@ -31,6 +31,27 @@ func TestCreateQueryFromParameters(t *testing.T) {
 	is.Equal(query.PaginationOffset(), uint64(5)) // failed to parse correct pagination offset
 }
 
+func TestCreateQueryWithDeviceReferenceInCompoundFilter(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities"), nil)
+
+	query, err := newQueryFromParameters(req, []string{"T"}, []string{"a"}, `a>5;refDevice=="urn:ngsi-ld:Device:mydevice"`)
+	is.NoErr(err)                                           // newQueryFromParameters failed
+	is.True(query.HasFilter())                              // query should have a filter
+	is.True(query.HasDeviceReference())                     // device reference should be derived from the filter
+	is.Equal(query.Device(), "urn:ngsi-ld:Device:mydevice") // unexpected device
+}
+
+func TestCreateQueryWithInvalidFilterFails(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("GET", createURL("/entities"), nil)
+
+	_, err := newQueryFromParameters(req, []string{"T"}, []string{"a"}, "a==")
+	is.True(err != nil) // should return an error
+}
+
 const (
 	DateTimeAt    string = "2017-12-13T14:20:00Z"
 	DateEndTimeAt string = "2017-12-13T14:40:00Z"
@@ -0,0 +1,395 @@
+package ngsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RemoteContextSourceOption is used to configure how a remote context source communicates
+//with its endpoint, and which requests it is used for
+type RemoteContextSourceOption func(*remoteContextSource)
+
+//WithHTTPClient makes the remote context source use the supplied http.Client, and thereby
+//its Transport, for all outbound requests. By default http.DefaultClient is used.
+func WithHTTPClient(client *http.Client) RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.client.httpClient = client
+	}
+}
+
+//WithRequestTimeout sets the maximum time that each outbound request, including reading
+//the response, is allowed to take. Each retry gets a timeout of its own.
+func WithRequestTimeout(timeout time.Duration) RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.client.requestTimeout = timeout
+	}
+}
+
+//WithRetries makes the remote context source retry idempotent requests up to maxRetries times
+//when they fail with a network error or a 5xx response. The delay before the first retry is
+//backoff, and it is doubled for each retry after that.
+func WithRetries(maxRetries int, backoff time.Duration) RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.client.maxRetries = maxRetries
+		rcs.client.backoff = backoff
+	}
+}
+
+//WithRetriedPatches makes the remote context source treat PATCH requests as idempotent, so that
+//they are retried in the same way as GET requests. Use it only for sources where applying the
+//same attribute update twice is harmless.
+func WithRetriedPatches() RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.client.retryPatch = true
+	}
+}
+
+//WithMaxResponseSize limits the number of bytes that are read from a response body. Larger
+//responses fail with a RemoteResponseTooLargeError.
+func WithMaxResponseSize(maxBytes int64) RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.client.maxResponseSize = maxBytes
+	}
+}
+
+//RemoteNetworkError is returned when a request to a remote context source could not be
+//completed, for instance because the endpoint could not be reached or did not respond in time
+type RemoteNetworkError struct {
+	Err error
+}
+
+func (rne *RemoteNetworkError) Error() string {
+	return fmt.Sprintf("failed to communicate with remote context source: %s", rne.Err.Error())
+}
+
+//Unwrap returns the underlying error
+func (rne *RemoteNetworkError) Unwrap() error {
+	return rne.Err
+}
+
+//RemoteServerError is returned when a remote context source responds with a 5xx status code
+type RemoteServerError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (rse *RemoteServerError) Error() string {
+	return remoteResponseErrorMessage(rse.StatusCode, rse.Body)
+}
+
+//RemoteRequestError is returned when a remote context source responds with a 4xx status code
+type RemoteRequestError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (rre *RemoteRequestError) Error() string {
+	return remoteResponseErrorMessage(rre.StatusCode, rre.Body)
+}
+
+//RemoteResponseTooLargeError is returned when a response from a remote context source is larger
+//than the configured max response size
+type RemoteResponseTooLargeError struct {
+	Limit int64
+}
+
+func (rtl *RemoteResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response from remote context source exceeds the limit of %d bytes", rtl.Limit)
+}
+
+//EntityAlreadyExistsError should be returned, or wrapped, by context sources that are asked to
+//create an entity that already exists
+type EntityAlreadyExistsError struct {
+	EntityID string
+}
+
+func (eae *EntityAlreadyExistsError) Error() string {
+	return fmt.Sprintf("entity %s already exists", eae.EntityID)
+}
+
+//isAlreadyExistsError returns true if an error tells that an entity already exists, either
+//because a local source said so or because a remote source responded with a 409
+func isAlreadyExistsError(err error) bool {
+	alreadyExists := &EntityAlreadyExistsError{}
+	if errors.As(err, &alreadyExists) {
+		return true
+	}
+
+	requestError := &RemoteRequestError{}
+	return errors.As(err, &requestError) && requestError.StatusCode == http.StatusConflict
+}
+
+func remoteResponseErrorMessage(statusCode int, body []byte) string {
+	if len(body) > 0 {
+		return string(body)
+	}
+	return fmt.Sprintf("received %d response with empty body", statusCode)
+}
+
+type remoteResponse struct {
+	responseCode int
+	headers      http.Header
+	bytes        []byte
+}
+
+func (rr *remoteResponse) Header() http.Header {
+	if rr.headers == nil {
+		rr.headers = make(http.Header)
+	}
+	return rr.headers
+}
+
+func (rr *remoteResponse) MatchesContentType(contentType string) bool {
+	responseType := rr.Header().Get("Content-Type")
+	return strings.HasPrefix(responseType, contentType)
+}
+
+//remoteClient sends outbound requests to a remote context source
+type remoteClient struct {
+	httpClient      *http.Client
+	requestTimeout  time.Duration
+	maxRetries      int
+	backoff         time.Duration
+	retryPatch      bool
+	maxResponseSize int64
+	breaker         *circuitBreaker
+}
+
+func newRemoteClient() *remoteClient {
+	return &remoteClient{httpClient: http.DefaultClient}
+}
+
+func (rc *remoteClient) isIdempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead ||
+		(method == http.MethodPatch && rc.retryPatch)
+}
+
+//send sends a request and reads the response, retrying idempotent requests that fail in a
+//way that may be temporary. Responses with a status code of 400 or above are returned together
+//with an error that describes them. Requests fail immediately while the circuit is open.
+func (rc *remoteClient) send(req *http.Request) (remoteResponse, error) {
+	if rc.breaker == nil {
+		return rc.sendWithRetries(req)
+	}
+
+	if err := rc.breaker.allow(); err != nil {
+		return remoteResponse{}, err
+	}
+
+	response, err := rc.sendWithRetries(req)
+	rc.breaker.record(err, req.Context().Err() == context.Canceled)
+
+	return response, err
+}
+
+//circuitState returns the state of the circuit breaker, or CircuitClosed if there is none
+func (rc *remoteClient) circuitState() CircuitState {
+	if rc.breaker == nil {
+		return CircuitClosed
+	}
+	return rc.breaker.State()
+}
+
+func (rc *remoteClient) sendWithRetries(req *http.Request) (remoteResponse, error) {
+	retries := 0
+	if rc.isIdempotent(req.Method) {
+		retries = rc.maxRetries
+	}
+
+	delay := rc.backoff
+
+	for attempt := 0; ; attempt++ {
+		response, err := rc.sendOnce(req)
+
+		if err == nil || attempt >= retries || !isTemporaryRemoteError(err) {
+			return response, err
+		}
+
+		select {
+		case <-req.Context().Done():
+			return response, err
+		case <-time.After(delay):
+		}
+
+		delay = delay * 2
+
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return response, err
+			}
+		}
+	}
+}
+
+func (rc *remoteClient) sendOnce(req *http.Request) (remoteResponse, error) {
+	response := remoteResponse{}
+
+	if rc.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), rc.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := rc.httpClient.Do(req)
+	if err != nil {
+		return response, &RemoteNetworkError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if rc.maxResponseSize > 0 {
+		// Read one byte more than allowed, so that we can tell if the limit was exceeded
+		body = io.LimitReader(resp.Body, rc.maxResponseSize+1)
+	}
+
+	response.responseCode = resp.StatusCode
+	response.headers = resp.Header
+	response.bytes, err = ioutil.ReadAll(body)
+
+	if err != nil {
+		return response, &RemoteNetworkError{Err: err}
+	}
+
+	if rc.maxResponseSize > 0 && int64(len(response.bytes)) > rc.maxResponseSize {
+		return response, &RemoteResponseTooLargeError{Limit: rc.maxResponseSize}
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return response, &RemoteServerError{StatusCode: resp.StatusCode, Body: response.bytes}
+	} else if resp.StatusCode >= http.StatusBadRequest {
+		return response, &RemoteRequestError{StatusCode: resp.StatusCode, Body: response.bytes}
+	}
+
+	return response, nil
+}
+
+func isTemporaryRemoteError(err error) bool {
+	switch err.(type) {
+	case *RemoteNetworkError, *RemoteServerError:
+		return true
+	}
+	return false
+}
+
+//CircuitState describes whether a remote context source is currently being used
+type CircuitState string
+
+const (
+	//CircuitClosed means that the source is healthy and that all requests are sent to it
+	CircuitClosed CircuitState = "closed"
+	//CircuitOpen means that the source has failed too many times in a row and that no requests
+	//are sent to it until the cool-down period has passed
+	CircuitOpen CircuitState = "open"
+	//CircuitHalfOpen means that the cool-down period has passed and that a single probing request
+	//is allowed through to find out if the source has recovered
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+//WithCircuitBreaker makes the remote context source keep track of its health. After maxFailures
+//consecutive network errors or 5xx responses the circuit is opened and requests fail immediately
+//with a RemoteCircuitOpenError. When coolDown has passed a single request is let through, and the
+//circuit is closed again if it succeeds.
+func WithCircuitBreaker(maxFailures int, coolDown time.Duration) RemoteContextSourceOption {
+	return func(rcs *remoteContextSource) {
+		rcs.client.breaker = &circuitBreaker{
+			maxFailures: maxFailures,
+			coolDown:    coolDown,
+			state:       CircuitClosed,
+			now:         time.Now,
+		}
+	}
+}
+
+//RemoteCircuitOpenError is returned, without contacting the remote context source, when the
+//circuit of the source is open
+type RemoteCircuitOpenError struct {
+	RetryAfter time.Time
+}
+
+func (rco *RemoteCircuitOpenError) Error() string {
+	return fmt.Sprintf("remote context source is unavailable until %s", rco.RetryAfter.Format(time.RFC3339))
+}
+
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	maxFailures int
+	coolDown    time.Duration
+
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	now func() time.Time
+}
+
+//State returns the current state of the circuit. An open circuit whose cool-down has passed is
+//reported as half-open, as the next request will be let through.
+func (cb *circuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && !cb.now().Before(cb.openedAt.Add(cb.coolDown)) {
+		return CircuitHalfOpen
+	}
+
+	return cb.state
+}
+
+//allow returns an error if a request should not be sent. Only one request at a time is let
+//through while the circuit is half-open.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		retryAfter := cb.openedAt.Add(cb.coolDown)
+		if cb.now().Before(retryAfter) {
+			return &RemoteCircuitOpenError{RetryAfter: retryAfter}
+		}
+		cb.state = CircuitHalfOpen
+	case CircuitHalfOpen:
+		if cb.probing {
+			return &RemoteCircuitOpenError{RetryAfter: cb.now()}
+		}
+	}
+
+	cb.probing = cb.state == CircuitHalfOpen
+	return nil
+}
+
+//record updates the circuit with the outcome of a request that was allowed through. Requests
+//that were cancelled by the caller tell nothing about the health of the source, and are ignored.
+func (cb *circuitBreaker) record(err error, cancelled bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+
+	if cancelled {
+		return
+	}
+
+	if err == nil || !isTemporaryRemoteError(err) {
+		cb.failures = 0
+		cb.state = CircuitClosed
+		return
+	}
+
+	cb.failures++
+
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.maxFailures {
+		cb.state = CircuitOpen
+		cb.openedAt = cb.now()
+	}
+}
@@ -0,0 +1,235 @@
+package ngsi
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestThatFailedQueriesAreRetried(t *testing.T) {
+	is := is.New(t)
+
+	var numRequests int32
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&numRequests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(snowHeightResponseJSON))
+	}))
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL, WithRetries(2, time.Millisecond))
+
+	numEntities := 0
+	err := contextSource.GetEntities(newTestQuery(is, "WeatherObserved", "", ""), func(e Entity) error {
+		numEntities++
+		return nil
+	})
+
+	is.NoErr(err)                                      // query should succeed after retries
+	is.Equal(numEntities, 1)                           // unexpected number of entities
+	is.Equal(atomic.LoadInt32(&numRequests), int32(3)) // expected two retries
+}
+
+func TestThatNonIdempotentRequestsAreNotRetried(t *testing.T) {
+	is := is.New(t)
+
+	var numRequests int32
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL, WithRetries(2, time.Millisecond))
+
+	body, _ := newEntityAsByteBuffer("urn:ngsi-ld:Device:mydevice")
+	req, _ := http.NewRequest("POST", createURL("/entities"), body)
+	req.Header.Set("Content-Type", "application/ld+json")
+	err := contextSource.CreateEntity("Device", "urn:ngsi-ld:Device:mydevice", newRequestWrapper(req))
+
+	serverError := &RemoteServerError{}
+	is.True(errors.As(err, &serverError))                           // expected a RemoteServerError
+	is.Equal(serverError.StatusCode, http.StatusServiceUnavailable) // unexpected status code
+	is.Equal(atomic.LoadInt32(&numRequests), int32(1))              // POST requests must not be retried
+}
+
+func TestThatPatchRequestsCanBeRetried(t *testing.T) {
+	is := is.New(t)
+
+	var numRequests int32
+	var lastBody string
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lastBody = string(body)
+
+		if atomic.AddInt32(&numRequests, 1) < 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL, WithRetries(1, time.Millisecond), WithRetriedPatches())
+
+	req, _ := http.NewRequest("PATCH", createURL("/entities/urn:ngsi-ld:Device:mydevice/attrs"), strings.NewReader(`{"value":"on"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	err := contextSource.UpdateEntityAttributes("urn:ngsi-ld:Device:mydevice", newRequestWrapper(req))
+
+	is.NoErr(err)                                      // patch should succeed after a retry
+	is.Equal(atomic.LoadInt32(&numRequests), int32(2)) // expected one retry
+	is.Equal(lastBody, `{"value":"on"}`)               // the body should be sent again when retrying
+}
+
+func TestThatNetworkErrorsHaveTheirOwnType(t *testing.T) {
+	is := is.New(t)
+
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL)
+
+	err := contextSource.GetEntities(newTestQuery(is, "WeatherObserved", "", ""), func(e Entity) error {
+		return nil
+	})
+
+	networkError := &RemoteNetworkError{}
+	is.True(errors.As(err, &networkError)) // expected a RemoteNetworkError
+
+	req, _ := http.NewRequest("POST", createURL("/entities"), strings.NewReader(`{"id":"urn:ngsi-ld:WeatherObserved:1"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	err = contextSource.CreateEntity("WeatherObserved", "urn:ngsi-ld:WeatherObserved:1", newRequestWrapper(req))
+
+	is.True(errors.As(err, &networkError))                 // expected a RemoteNetworkError
+	is.True(!strings.Contains(err.Error(), "status code")) // there was no response to take a status code from
+}
+
+func TestThatLargeResponsesAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	mockService := setupMockServiceThatReturns(200, "application/ld+json", snowHeightResponseJSON)
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL, WithMaxResponseSize(64))
+
+	err := contextSource.GetEntities(newTestQuery(is, "WeatherObserved", "", ""), func(e Entity) error {
+		return nil
+	})
+
+	tooLarge := &RemoteResponseTooLargeError{}
+	is.True(errors.As(err, &tooLarge)) // expected a RemoteResponseTooLargeError
+}
+
+func TestThatTheSuppliedHTTPClientIsUsed(t *testing.T) {
+	is := is.New(t)
+
+	mockService := setupMockServiceThatReturns(200, "application/ld+json", snowHeightResponseJSON)
+	defer mockService.Close()
+
+	transport := &countingTransport{}
+	contextSource := newTestRemoteContextSource(
+		mockService.URL,
+		WithHTTPClient(&http.Client{Transport: transport}),
+		WithRequestTimeout(5*time.Second),
+	)
+
+	err := contextSource.GetEntities(newTestQuery(is, "WeatherObserved", "", ""), func(e Entity) error {
+		return nil
+	})
+
+	is.NoErr(err)                                          // query should succeed
+	is.Equal(atomic.LoadInt32(&transport.count), int32(1)) // the request should go through the supplied client
+}
+
+type countingTransport struct {
+	count int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.count, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestRemoteContextSource(endpoint string, options ...RemoteContextSourceOption) ContextSource {
+	registration, _ := NewCsourceRegistration("WeatherObserved", []string{"snowHeight"}, endpoint, nil)
+	contextSource, _ := NewRemoteContextSource(registration, options...)
+	return contextSource
+}
+
+func TestThatTheCircuitOpensAfterConsecutiveFailures(t *testing.T) {
+	is := is.New(t)
+
+	var numRequests int32
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL, WithCircuitBreaker(2, time.Hour))
+	query := newTestQuery(is, "WeatherObserved", "", "")
+	noop := func(e Entity) error { return nil }
+
+	contextSource.GetEntities(query, noop)
+	is.Equal(contextSource.(*remoteContextSource).CircuitState(), CircuitClosed) // one failure should not open the circuit
+
+	contextSource.GetEntities(query, noop)
+	is.Equal(contextSource.(*remoteContextSource).CircuitState(), CircuitOpen) // two failures should open the circuit
+
+	err := contextSource.GetEntities(query, noop)
+
+	circuitOpen := &RemoteCircuitOpenError{}
+	is.True(errors.As(err, &circuitOpen))              // expected a RemoteCircuitOpenError
+	is.Equal(atomic.LoadInt32(&numRequests), int32(2)) // no request should be sent while the circuit is open
+
+	ctxRegistry := NewContextRegistry()
+	ctxRegistry.Register(contextSource)
+	is.Equal(len(ctxRegistry.GetContextSourcesForQuery(query)), 0) // sources with an open circuit should be left out
+}
+
+func TestThatAHalfOpenCircuitClosesWhenTheProbeSucceeds(t *testing.T) {
+	is := is.New(t)
+
+	var healthy int32
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(snowHeightResponseJSON))
+	}))
+	defer mockService.Close()
+
+	contextSource := newTestRemoteContextSource(mockService.URL, WithCircuitBreaker(1, time.Hour))
+	rcs := contextSource.(*remoteContextSource)
+	query := newTestQuery(is, "WeatherObserved", "", "")
+	noop := func(e Entity) error { return nil }
+
+	contextSource.GetEntities(query, noop)
+	is.Equal(rcs.CircuitState(), CircuitOpen) // the circuit should be open after a failure
+
+	// Pretend that the cool-down period has passed
+	rcs.client.breaker.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	is.Equal(rcs.CircuitState(), CircuitHalfOpen) // the circuit should be half-open after the cool-down
+
+	contextSource.GetEntities(query, noop)
+	is.Equal(rcs.CircuitState(), CircuitOpen) // a failed probe should open the circuit again
+
+	rcs.client.breaker.now = func() time.Time { return time.Now().Add(4 * time.Hour) }
+	atomic.StoreInt32(&healthy, 1)
+
+	err := contextSource.GetEntities(query, noop)
+	is.NoErr(err)                               // the probe should succeed
+	is.Equal(rcs.CircuitState(), CircuitClosed) // a successful probe should close the circuit
+}
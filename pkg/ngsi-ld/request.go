@@ -28,6 +28,12 @@ func newRequestWrapper(req *http.Request) Request {
 	return rw
 }
 
+//newRequestWrapperWithBody wraps an incoming request but replaces its body, which is
+//useful when a request carries several entities that are handled one at a time
+func newRequestWrapperWithBody(req *http.Request, body []byte) Request {
+	return &requestWrapper{request: req, body: body}
+}
+
 type requestWrapper struct {
 	request *http.Request
 	body    []byte
@@ -0,0 +1,381 @@
+package ngsi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	//PathParamEntityID is the name of the path parameter that holds an entity id
+	PathParamEntityID = "entityId"
+	//PathParamAttributeName is the name of the path parameter that holds an attribute name
+	PathParamAttributeName = "attrId"
+	//PathParamRegistrationID is the name of the path parameter that holds the id of a
+	//context source registration
+	PathParamRegistrationID = "registrationId"
+)
+
+//PathParamExtractor returns the decoded value of a named path parameter of a request, or
+//an empty string if the request has no such parameter. The signature matches chi.URLParam.
+type PathParamExtractor func(r *http.Request, name string) string
+
+type pathParamExtractorKey struct{}
+
+//UsePathParamExtractor returns a middleware that makes the handlers in this package use the
+//supplied extractor to find the entity ids, attribute names and registration ids in the
+//request path, instead of searching the path for them. It is meant for applications that
+//mount the handlers in their own router, using the path parameter names in this package:
+//
+//	r.Use(ngsi.UsePathParamExtractor(chi.URLParam))
+//	r.Get("/ngsi-ld/v1/entities/{entityId}", ngsi.NewRetrieveEntityHandler(ctxReg))
+func UsePathParamExtractor(extractor PathParamExtractor) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), pathParamExtractorKey{}, extractor)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+//pathParam returns the value of a path parameter if the request carries a path param extractor
+//and the parameter is not empty
+func pathParam(r *http.Request, name string) (string, bool) {
+	extractor, ok := r.Context().Value(pathParamExtractorKey{}).(PathParamExtractor)
+	if !ok {
+		return "", false
+	}
+
+	value := extractor(r, name)
+	return value, value != ""
+}
+
+//findPathParams returns the parameters in a pattern such as /entities/{entityId}/attrs/{attrId},
+//using the path param extractor of the request if it has one, or else by matching the pattern
+//against the request path. A problem is reported to the response writer if the parameters can
+//not be found.
+func findPathParams(w http.ResponseWriter, r *http.Request, pattern string) (map[string]string, bool) {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	params := map[string]string{}
+	found := true
+
+	for _, segment := range segments {
+		if name, isParam := paramName(segment); isParam {
+			params[name], found = pathParam(r, name)
+			if !found {
+				break
+			}
+		}
+	}
+
+	if !found {
+		params, found = matchPathFromEnd(r.URL.Path, segments)
+	}
+
+	if !found {
+		errors.ReportNewBadRequestData(w, "The supplied URL is invalid.")
+	}
+
+	return params, found
+}
+
+//matchPathFromEnd matches the segments of a pattern against a path that may be mounted under
+//any base path. The first segment is looked for from the start of the path and the others from
+//its end, so that the parameter that follows the first segment may contain slashes, as entity
+//ids sometimes do. The parameter must be the second segment of the pattern.
+func matchPathFromEnd(path string, segments []string) (map[string]string, bool) {
+	prefix := "/" + segments[0] + "/"
+	prefixIdx := strings.Index(path, prefix)
+	if prefixIdx == -1 {
+		return nil, false
+	}
+
+	rest := path[prefixIdx+len(prefix):]
+	params := map[string]string{}
+
+	// A single trailing slash is accepted after a pattern that ends with a fixed segment
+	if _, isParam := paramName(segments[len(segments)-1]); !isParam {
+		rest = strings.TrimSuffix(rest, "/")
+	}
+
+	for idx := len(segments) - 1; idx > 1; idx-- {
+		slashIdx := strings.LastIndex(rest, "/")
+		if slashIdx == -1 {
+			return nil, false
+		}
+
+		value := rest[slashIdx+1:]
+		if name, isParam := paramName(segments[idx]); isParam && value != "" {
+			params[name] = value
+		} else if value != segments[idx] {
+			return nil, false
+		}
+
+		rest = rest[:slashIdx]
+	}
+
+	name, isParam := paramName(segments[1])
+	if !isParam || rest == "" {
+		return nil, false
+	}
+	params[name] = rest
+
+	return params, true
+}
+
+func paramName(segment string) (string, bool) {
+	if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+//RouterOption is used to change the default behaviour of the router that is returned by NewRouter
+type RouterOption func(*routerOptions)
+
+type routerOptions struct {
+	basePath       string
+	createMode     CreateMode
+	handlerOptions []HandlerOption
+	sourceOptions  []RemoteContextSourceOption
+	logger         zerolog.Logger
+
+	onCreated          CreateEntityCompletionCallback
+	onUpdated          UpdateEntityAttributesCompletionCallback
+	onAppended         AppendEntityAttributesCompletionCallback
+	onAttributeDeleted DeleteEntityAttributeCompletionCallback
+	onDeleted          DeleteEntityCompletionCallback
+}
+
+//WithBasePath sets the path that the NGSI-LD API is mounted under. The default is /ngsi-ld/v1.
+func WithBasePath(basePath string) RouterOption {
+	return func(opts *routerOptions) {
+		opts.basePath = basePath
+	}
+}
+
+//WithCreateMode sets the mode that is used when an entity should be created in more than one
+//context source. The default is CreateModeBestEffort.
+func WithCreateMode(mode CreateMode) RouterOption {
+	return func(opts *routerOptions) {
+		opts.createMode = mode
+	}
+}
+
+//WithHandlerOptions passes options to the handlers that accept them
+func WithHandlerOptions(options ...HandlerOption) RouterOption {
+	return func(opts *routerOptions) {
+		opts.handlerOptions = append(opts.handlerOptions, options...)
+	}
+}
+
+//WithRemoteContextSourceOptions passes options to the remote context sources that are created
+//when context sources are registered through the router
+func WithRemoteContextSourceOptions(options ...RemoteContextSourceOption) RouterOption {
+	return func(opts *routerOptions) {
+		opts.sourceOptions = append(opts.sourceOptions, options...)
+	}
+}
+
+//WithLogger sets the logger that is passed to the handlers that log. The default is the global
+//zerolog logger.
+func WithLogger(logger zerolog.Logger) RouterOption {
+	return func(opts *routerOptions) {
+		opts.logger = logger
+	}
+}
+
+//WithCreateEntityCallback sets the callback that is called when an entity has been created
+func WithCreateEntityCallback(callback CreateEntityCompletionCallback) RouterOption {
+	return func(opts *routerOptions) {
+		opts.onCreated = callback
+	}
+}
+
+//WithUpdateEntityAttributesCallback sets the callback that is called when the attributes of
+//an entity have been updated
+func WithUpdateEntityAttributesCallback(callback UpdateEntityAttributesCompletionCallback) RouterOption {
+	return func(opts *routerOptions) {
+		opts.onUpdated = callback
+	}
+}
+
+//WithAppendEntityAttributesCallback sets the callback that is called when attributes have been
+//appended to an entity
+func WithAppendEntityAttributesCallback(callback AppendEntityAttributesCompletionCallback) RouterOption {
+	return func(opts *routerOptions) {
+		opts.onAppended = callback
+	}
+}
+
+//WithDeleteEntityAttributeCallback sets the callback that is called when an attribute of an
+//entity has been deleted
+func WithDeleteEntityAttributeCallback(callback DeleteEntityAttributeCompletionCallback) RouterOption {
+	return func(opts *routerOptions) {
+		opts.onAttributeDeleted = callback
+	}
+}
+
+//WithDeleteEntityCallback sets the callback that is called when an entity has been deleted
+func WithDeleteEntityCallback(callback DeleteEntityCompletionCallback) RouterOption {
+	return func(opts *routerOptions) {
+		opts.onDeleted = callback
+	}
+}
+
+type route struct {
+	segments []string
+	handlers map[string]http.Handler
+}
+
+type router struct {
+	basePath string
+	routes   []*route
+}
+
+//NewRouter returns a handler that mounts all the handlers in this package under a base path.
+//The path is split into segments before the segments are decoded, so that entity ids and
+//attribute names may contain encoded slashes or anything else that is not allowed in a path.
+func NewRouter(ctxReg ContextRegistry, options ...RouterOption) http.Handler {
+	noop := func(string, string, Request, zerolog.Logger) {}
+
+	opts := &routerOptions{
+		basePath:           ngsiLDBasePath,
+		createMode:         CreateModeBestEffort,
+		logger:             log.With().Logger(),
+		onCreated:          noop,
+		onUpdated:          noop,
+		onAppended:         noop,
+		onAttributeDeleted: func(string, string, string, Request, zerolog.Logger) {},
+		onDeleted:          noop,
+	}
+
+	for _, option := range options {
+		option(opts)
+	}
+
+	rtr := &router{basePath: "/" + strings.Trim(opts.basePath, "/")}
+	if rtr.basePath == "/" {
+		rtr.basePath = ""
+	}
+
+	rtr.handle(http.MethodGet, "/entities", NewQueryEntitiesHandler(ctxReg, opts.handlerOptions...))
+	rtr.handle(http.MethodPost, "/entities", NewCreateEntityHandlerWithMode(ctxReg, opts.createMode, opts.logger, opts.onCreated, opts.handlerOptions...))
+	rtr.handle(http.MethodGet, "/entities/{entityId}", NewRetrieveEntityHandler(ctxReg))
+	rtr.handle(http.MethodDelete, "/entities/{entityId}", NewDeleteEntityHandlerWithCallback(ctxReg, opts.logger, opts.onDeleted))
+	rtr.handle(http.MethodPost, "/entities/{entityId}/attrs", NewAppendEntityAttributesHandlerWithCallback(ctxReg, opts.logger, opts.onAppended))
+	rtr.handle(http.MethodPatch, "/entities/{entityId}/attrs", NewUpdateEntityAttributesHandlerWithCallback(ctxReg, opts.logger, opts.onUpdated))
+	rtr.handle(http.MethodDelete, "/entities/{entityId}/attrs/{attrId}", NewDeleteEntityAttributeHandlerWithCallback(ctxReg, opts.logger, opts.onAttributeDeleted))
+
+	rtr.handle(http.MethodPost, "/entityOperations/create", NewBatchCreateEntitiesHandler(ctxReg))
+	rtr.handle(http.MethodPost, "/entityOperations/upsert", NewBatchUpsertEntitiesHandler(ctxReg))
+	rtr.handle(http.MethodPost, "/entityOperations/update", NewBatchUpdateEntitiesHandler(ctxReg))
+	rtr.handle(http.MethodPost, "/entityOperations/delete", NewBatchDeleteEntitiesHandler(ctxReg))
+
+	rtr.handle(http.MethodGet, "/csourceRegistrations", NewQueryContextSourceRegistrationsHandler(ctxReg))
+	rtr.handle(http.MethodPost, "/csourceRegistrations", NewRegisterContextSourceHandler(ctxReg, opts.sourceOptions...))
+	rtr.handle(http.MethodGet, "/csourceRegistrations/{registrationId}", NewRetrieveContextSourceRegistrationHandler(ctxReg))
+	rtr.handle(http.MethodPatch, "/csourceRegistrations/{registrationId}", NewUpdateContextSourceRegistrationHandler(ctxReg))
+	rtr.handle(http.MethodDelete, "/csourceRegistrations/{registrationId}", NewDeleteContextSourceRegistrationHandler(ctxReg))
+
+	return rtr
+}
+
+func (rtr *router) handle(method, pattern string, handler http.Handler) {
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+
+	for _, rt := range rtr.routes {
+		if strings.Join(rt.segments, "/") == strings.Join(segments, "/") {
+			rt.handlers[method] = handler
+			return
+		}
+	}
+
+	rtr.routes = append(rtr.routes, &route{
+		segments: segments,
+		handlers: map[string]http.Handler{method: handler},
+	})
+}
+
+func (rtr *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+
+	if !strings.HasPrefix(path, rtr.basePath+"/") {
+		errors.ReportNewResourceNotFound(w, "No resource found at "+r.URL.Path)
+		return
+	}
+
+	// A single trailing slash, as in PATCH /entities/{entityId}/attrs/, is accepted
+	path = strings.TrimSuffix(strings.TrimPrefix(path, rtr.basePath+"/"), "/")
+	segments := strings.Split(path, "/")
+
+	for idx, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			errors.ReportNewBadRequestData(w, "The supplied URL is invalid.")
+			return
+		}
+		segments[idx] = decoded
+	}
+
+	for _, rt := range rtr.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+
+		handler, ok := rt.handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", rt.allowedMethods())
+			errors.ReportNewMethodNotAllowed(w, r.Method+" is not supported by "+r.URL.Path)
+			return
+		}
+
+		extractor := PathParamExtractor(func(_ *http.Request, name string) string {
+			return params[name]
+		})
+
+		ctx := context.WithValue(r.Context(), pathParamExtractorKey{}, extractor)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	errors.ReportNewResourceNotFound(w, "No resource found at "+r.URL.Path)
+}
+
+//match returns the path parameters of the route if the decoded segments of a path match it
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+
+	for idx, segment := range rt.segments {
+		if name, isParam := paramName(segment); isParam {
+			if segments[idx] == "" {
+				return nil, false
+			}
+			params[name] = segments[idx]
+		} else if segment != segments[idx] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func (rt *route) allowedMethods() string {
+	methods := []string{}
+	for method := range rt.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
@@ -0,0 +1,194 @@
+package ngsi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/matryer/is"
+	"github.com/rs/zerolog"
+)
+
+func TestThatTheRouterDecodesEntityIDs(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("Device", "value")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/ngsi-ld/v1/entities/urn:ngsi-ld:Device:a%2Fattrs%2Fb", nil)
+	w := httptest.NewRecorder()
+	NewRouter(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                                                           // unexpected response code
+	is.Equal(contextSource.RetrieveEntityCalls()[0].EntityID, "urn:ngsi-ld:Device:a/attrs/b") // the entity id should be decoded
+}
+
+func TestThatTheRouterFindsAttributesUnderABasePath(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("Device", "value")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.UpdateEntityAttributesFunc = func(string, Request) error { return nil }
+	contextSource.DeleteEntityAttributeFunc = func(string, string, Request) error { return nil }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+	router := NewRouter(contextRegistry, WithBasePath("/api/ngsi-ld/"))
+
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080/api/ngsi-ld/entities/urn:ngsi-ld:Device:%2Fattrs%2F/attrs/", strings.NewReader(`{"value":"on"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                                                          // unexpected response code
+	is.Equal(contextSource.UpdateEntityAttributesCalls()[0].EntityID, "urn:ngsi-ld:Device:/attrs/") // unexpected entity id
+
+	req, _ = http.NewRequest("DELETE", "http://localhost:8080/api/ngsi-ld/entities/urn:ngsi-ld:Device:1/attrs/value", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                                                   // unexpected response code
+	is.Equal(contextSource.DeleteEntityAttributeCalls()[0].EntityID, "urn:ngsi-ld:Device:1") // unexpected entity id
+	is.Equal(contextSource.DeleteEntityAttributeCalls()[0].AttributeName, "value")           // unexpected attribute name
+}
+
+func TestThatTheRouterRejectsUnknownPathsAndMethods(t *testing.T) {
+	is := is.New(t)
+
+	router := NewRouter(NewContextRegistry())
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/ngsi-ld/v1/subscriptions", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusNotFound) // unknown paths should not be found
+
+	req, _ = http.NewRequest("PUT", "http://localhost:8080/ngsi-ld/v1/entities/urn:ngsi-ld:Device:1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusMethodNotAllowed)                             // unsupported methods should not be allowed
+	is.Equal(w.Header().Get("Allow"), "DELETE, GET")                          // the allowed methods should be listed
+	is.Equal(w.Header().Get("Content-Type"), errors.ProblemReportContentType) // the problem should be described
+}
+
+func TestThatTheRouterCallsTheSuppliedCallbacks(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("Device", "value")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+	contextSource.DeleteEntityFunc = func(string, Request) error { return nil }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	deletedID := ""
+	router := NewRouter(
+		contextRegistry,
+		WithLogger(zerolog.Nop()),
+		WithDeleteEntityCallback(func(entityType, entityID string, request Request, logger zerolog.Logger) {
+			deletedID = entityID
+		}),
+	)
+
+	req, _ := http.NewRequest("DELETE", "http://localhost:8080/ngsi-ld/v1/entities/urn:ngsi-ld:Device:1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)      // unexpected response code
+	is.Equal(deletedID, "urn:ngsi-ld:Device:1") // the callback should be called
+}
+
+func TestThatRequestsUnderABasePathAreForwardedToTheNGSILDPath(t *testing.T) {
+	is := is.New(t)
+
+	requestedPath := ""
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath = r.URL.EscapedPath()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer mockService.Close()
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newTestRemoteContextSource(mockService.URL+"/remote", WithEntityTypesFromIDs()))
+	router := NewRouter(contextRegistry, WithBasePath("/api"))
+
+	req, _ := http.NewRequest("PATCH", "http://localhost:8080/api/entities/urn:ngsi-ld:WeatherObserved:a%2Fb/attrs/", strings.NewReader(`{"snowHeight":{"type":"Property","value":1}}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)                                                          // unexpected response code
+	is.Equal(requestedPath, "/remote/ngsi-ld/v1/entities/urn:ngsi-ld:WeatherObserved:a%2Fb/attrs/") // the base path should be replaced
+}
+
+func TestThatHandlersUseAPluggablePathParamExtractor(t *testing.T) {
+	is := is.New(t)
+
+	contextSource := newMockedContextSource("Device", "value")
+	contextSource.ProvidesEntitiesWithMatchingIDFunc = func(string) bool { return true }
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(contextSource)
+
+	extractor := func(r *http.Request, name string) string {
+		if name == PathParamEntityID {
+			return "urn:ngsi-ld:Device:" + strings.TrimPrefix(r.URL.Path, "/devices/")
+		}
+		return ""
+	}
+	handler := UsePathParamExtractor(extractor)(NewRetrieveEntityHandler(contextRegistry))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/devices/mydevice", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                                                          // unexpected response code
+	is.Equal(contextSource.RetrieveEntityCalls()[0].EntityID, "urn:ngsi-ld:Device:mydevice") // the extractor should be used
+}
+
+func TestThatEncodedEntityIDsAreForwardedToRemoteSources(t *testing.T) {
+	is := is.New(t)
+
+	requestedPath := ""
+	mockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath = r.URL.EscapedPath()
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.Write([]byte(`{"id":"urn:ngsi-ld:WeatherObserved:a/b","type":"WeatherObserved"}`))
+	}))
+	defer mockService.Close()
+
+	contextRegistry := NewContextRegistry()
+	contextRegistry.Register(newTestRemoteContextSource(mockService.URL+"/remote", WithEntityTypesFromIDs()))
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/ngsi-ld/v1/entities/urn:ngsi-ld:WeatherObserved:a%2Fb", nil)
+	w := httptest.NewRecorder()
+	NewRouter(contextRegistry).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)                                                          // unexpected response code
+	is.Equal(requestedPath, "/remote/ngsi-ld/v1/entities/urn:ngsi-ld:WeatherObserved:a%2Fb") // the encoding of the id should be kept
+}
+
+func TestThatPathParamsAreFoundWithoutARouter(t *testing.T) {
+	is := is.New(t)
+
+	req, _ := http.NewRequest("POST", createURL("/entities/urn:ngsi-ld:Device:a/attrsb/attrs/"), nil)
+	params, found := findPathParams(httptest.NewRecorder(), req, "/entities/{entityId}/attrs")
+	is.True(found)                                                     // the path params should be found
+	is.Equal(params[PathParamEntityID], "urn:ngsi-ld:Device:a/attrsb") // unexpected entity id
+
+	req, _ = http.NewRequest("DELETE", createURL("/entities/urn:ngsi-ld:Device:/attrs//attrs/value"), nil)
+	params, found = findPathParams(httptest.NewRecorder(), req, "/entities/{entityId}/attrs/{attrId}")
+	is.True(found)                                                    // the path params should be found
+	is.Equal(params[PathParamEntityID], "urn:ngsi-ld:Device:/attrs/") // unexpected entity id
+	is.Equal(params[PathParamAttributeName], "value")                 // unexpected attribute name
+
+	w := httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", createURL("/entities/urn:ngsi-ld:Device:1/attrs/"), nil)
+	_, found = findPathParams(w, req, "/entities/{entityId}/attrs/{attrId}")
+	is.True(!found)                         // a missing attribute name should not be accepted
+	is.Equal(w.Code, http.StatusBadRequest) // unexpected response code
+}